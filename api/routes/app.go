@@ -17,17 +17,24 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package routes
 
 import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
 	"net/http"
+	"time"
 
 	"github.com/gin-gonic/gin"
 
 	"github.com/statiko-dev/statiko/fs"
+	"github.com/statiko-dev/statiko/uploads"
 	"github.com/statiko-dev/statiko/utils"
 )
 
 // AppUploadHandler is the handler for POST /app, which is used to upload new app bundles
 // The request body must be a multipart/form-data with a "file" field containing the bundle, a "name" field containing the name, and a "type" one containing the type (file extension)
-// Optionally, pass a "signature" and/or "hash" fielld
+// Optionally, pass a "signature" and/or "hash" fielld; for signatures created with a key in the keyring, pass its "keyId" too
+// The SHA-256 hash of the data is always computed, and the request is rejected if it doesn't match the "hash" field; the archive must be valid for the declared type, and the number of files, uncompressed size and presence of the manifest are stored in the metadata
 func AppUploadHandler(c *gin.Context) {
 	// Get the file from the body
 	file, err := c.FormFile("file")
@@ -38,7 +45,7 @@ func AppUploadHandler(c *gin.Context) {
 
 	// Get and sanitize the app's name
 	name := utils.SanitizeAppName(c.PostForm("name"))
-	if name == "" {
+	if name == "" || name == reservedAppName {
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
 			"error": "Filename for the file is empty or invalid",
 		})
@@ -69,34 +76,70 @@ func AppUploadHandler(c *gin.Context) {
 	// Check if we have a signature to store together with the file
 	signature := c.PostForm("signature")
 	if signature != "" {
-		if len(signature) > 1024 {
+		if len(signature) > 2048 {
 			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
-				"error": "Value for 'signature' cannot be longer than 1024 characters",
+				"error": "Value for 'signature' cannot be longer than 2048 characters",
 			})
 			return
 		}
 		metadata["signature"] = signature
 	}
+	keyID := c.PostForm("keyId")
+	if !validateSigningKeyID(c, keyID, signature) {
+		return
+	}
+	if keyID != "" {
+		metadata["keyId"] = keyID
+		metadata["signedTime"] = time.Now().UTC().Format(time.RFC3339)
+	}
 
 	// Check if we have a hash
-	hash := c.PostForm("hash")
-	if hash != "" {
-		if len(hash) > 64 {
+	var expectHash []byte
+	if hashStr := c.PostForm("hash"); hashStr != "" {
+		expectHash, err = utils.DecodeSHA256Hash(hashStr)
+		if err != nil {
 			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
-				"error": "Value for 'hash' cannot be longer than 64 characters",
+				"error": "Invalid value for 'hash': " + err.Error(),
 			})
 			return
 		}
-		metadata["hash"] = hash
 	}
 
+	// Compute the hash of the data received while ensuring the archive can be opened for the declared type
+	// The hash is compared with the one passed by the client, if any, then information on the archive's contents is stored
+	hash, info, err := utils.HashInspectArchive(in, file.Size, utils.ArchiveTypeByExtension("."+typ))
+	if hash == nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	if expectHash != nil && !bytes.Equal(hash, expectHash) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"error": fmt.Sprintf("Hash does not match: got %x, wanted %x", hash, expectHash),
+		})
+		return
+	}
+	metadata["hash"] = base64.StdEncoding.EncodeToString(hash)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"error": "File is not a valid archive of type " + typ + ": " + err.Error(),
+		})
+		return
+	}
+	info.SetMetadata(metadata)
+
 	// Store the file
+	_, err = in.Seek(0, io.SeekStart)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
 	err = fs.Instance.SetWithContext(c.Request.Context(), name, in, metadata)
 	if err != nil {
 		if err == fs.ErrExist {
 			c.AbortWithStatusJSON(http.StatusConflict, gin.H{
 				"error": "File already exists",
 			})
+			return
 		}
 		c.AbortWithError(http.StatusInternalServerError, err)
 		return
@@ -106,14 +149,133 @@ func AppUploadHandler(c *gin.Context) {
 	c.Status(http.StatusNoContent)
 }
 
+// Name that can't be used for apps, as POST /app/import is routed to AppUpdateHandler
+const reservedAppName = "import"
+
+type appImportRequest struct {
+	URL       string            `json:"url" form:"url"`
+	Name      string            `json:"name" form:"name"`
+	Type      string            `json:"type" form:"type"`
+	Signature string            `json:"signature" form:"signature"`
+	KeyID     string            `json:"keyId" form:"keyId"`
+	Hash      string            `json:"hash" form:"hash"`
+	Headers   map[string]string `json:"headers"`
+}
+
+// AppImportHandler is the handler for POST /app/import, which imports an app bundle from a URL
+// The request must contain the "url" of the file, and the "name" and "type" of the app; optionally, pass the "headers" to send with the request, and a "signature" and/or the expected "hash"
+// The file is imported in background, and the response contains the ID of the job, whose status can be requested with GET /app/import/:id
+func AppImportHandler(c *gin.Context) {
+	// Get data from the form body
+	data := &appImportRequest{}
+	if err := c.Bind(data); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request body: " + err.Error(),
+		})
+		return
+	}
+
+	// Validate the request
+	if data.URL == "" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"error": "Field 'url' is required",
+		})
+		return
+	}
+	name := utils.SanitizeAppName(data.Name)
+	if name == "" || name == reservedAppName {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"error": "Filename for the file is empty or invalid",
+		})
+		return
+	}
+	if data.Type == "" || !utils.StringInSlice(utils.ArchiveExtensions, "."+data.Type) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"error": "File extension is empty or invalid",
+		})
+		return
+	}
+	if len(data.Signature) > 2048 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"error": "Value for 'signature' cannot be longer than 2048 characters",
+		})
+		return
+	}
+	if !validateSigningKeyID(c, data.KeyID, data.Signature) {
+		return
+	}
+	var hash []byte
+	if data.Hash != "" {
+		var err error
+		hash, err = utils.DecodeSHA256Hash(data.Hash)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+				"error": "Invalid value for 'hash': " + err.Error(),
+			})
+			return
+		}
+	}
+
+	// Check if the app exists already
+	_, err := fs.Instance.GetMetadata(name)
+	if err == nil {
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{
+			"error": "File already exists",
+		})
+		return
+	} else if err != fs.ErrNotExist {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	// Start the import
+	job, err := uploads.Instance.Import(uploads.ImportRequest{
+		URL:       data.URL,
+		Name:      name,
+		Type:      data.Type,
+		Signature: data.Signature,
+		KeyID:     data.KeyID,
+		Headers:   data.Headers,
+		Hash:      hash,
+	})
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, job)
+}
+
+// AppImportStatusHandler is the handler for GET /app/import/:id, which returns the status and progress of an import job
+func AppImportStatusHandler(c *gin.Context) {
+	job := uploads.Instance.GetImport(c.Param("id"))
+	if job == nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{
+			"error": "Import job not found",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, job)
+}
+
 type appUpdateRequest struct {
 	Signature string `json:"signature" form:"signature"`
+	KeyID     string `json:"keyId" form:"keyId"`
 	Hash      string `json:"hash" form:"hash"`
 }
 
 // AppUpdateHandler is the handler for POST /app/:name, which updates the signature of a file
-// The request may contain a "signature" field or a "hash" onne
+// The request may contain a "signature" field (with the "keyId" of the key in the keyring that created it, if any); the "hash" field, if present, must match the hash of the file, which can't be changed
 func AppUpdateHandler(c *gin.Context) {
+	// The router doesn't allow a static route next to the :name parameter, so imports are handled here
+	if c.Param("name") == reservedAppName {
+		AppImportHandler(c)
+		return
+	}
+
 	// Get the app to update
 	name := c.Param("name")
 	name = utils.SanitizeAppName(name)
@@ -149,28 +311,45 @@ func AppUpdateHandler(c *gin.Context) {
 		metadata = make(map[string]string)
 	}
 
-	// Reset the signature and hash
+	// Reset the signature
+	// The hash was computed when the file was stored, so it's kept
 	metadata["signature"] = ""
-	metadata["hash"] = ""
+	metadata["keyId"] = ""
+	metadata["signedTime"] = ""
 
-	// Fields could be empty if we're trying to remove a signature/hash
+	// Fields could be empty if we're trying to remove a signature
 	if data.Signature != "" {
-		if len(data.Signature) > 1024 {
+		if len(data.Signature) > 2048 {
 			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
-				"error": "Value for 'signature' cannot be longer than 1024 characters",
+				"error": "Value for 'signature' cannot be longer than 2048 characters",
 			})
 			return
 		}
 		metadata["signature"] = data.Signature
 	}
+	if !validateSigningKeyID(c, data.KeyID, data.Signature) {
+		return
+	}
+	if data.KeyID != "" {
+		metadata["keyId"] = data.KeyID
+		metadata["signedTime"] = time.Now().UTC().Format(time.RFC3339)
+	}
 	if data.Hash != "" {
-		if len(data.Hash) > 64 {
+		// The hash can't be changed, but clients can pass it to make sure they're signing the right file
+		hash, err := utils.DecodeSHA256Hash(data.Hash)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+				"error": "Invalid value for 'hash': " + err.Error(),
+			})
+			return
+		}
+		stored, err := base64.StdEncoding.DecodeString(metadata["hash"])
+		if err != nil || !bytes.Equal(hash, stored) {
 			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
-				"error": "Value for 'hash' cannot be longer than 64 characters",
+				"error": "Value for 'hash' does not match the hash of the file",
 			})
 			return
 		}
-		metadata["hash"] = data.Hash
 	}
 
 	// Update the metadata
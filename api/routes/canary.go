@@ -0,0 +1,139 @@
+/*
+Copyright © 2020 Alessandro Segala (@ItalyPaleAle)
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published
+by the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package routes
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/statiko-dev/statiko/state"
+	"github.com/statiko-dev/statiko/sync"
+)
+
+// CanarySetHandler is the handler for POST/PUT /site/{domain}/canary, which deploys an app as canary for a site
+func CanarySetHandler(c *gin.Context) {
+	site := getCanarySite(c)
+	if site == nil {
+		return
+	}
+
+	// A canary requires an app already deployed
+	if site.App == nil {
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{
+			"error": "Site does not have an app deployed",
+		})
+		return
+	}
+
+	// Get the canary from the body
+	var canary state.SiteCanary
+	if err := c.Bind(&canary); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request body: " + err.Error(),
+		})
+		return
+	}
+	if !canary.App.Validate() {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid app name",
+		})
+		return
+	}
+	if canary.App.Name == site.App.Name {
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{
+			"error": "App is already deployed on the site",
+		})
+		return
+	}
+	if !checkAppsClientCert(c, site.TLS, canary.App) {
+		return
+	}
+
+	site.Canary = &canary
+	updateCanarySite(c, site)
+}
+
+// CanaryPromoteHandler is the handler for POST /site/{domain}/canary/promote, which makes the canary app the main one for the site
+func CanaryPromoteHandler(c *gin.Context) {
+	site := getCanarySite(c)
+	if site == nil {
+		return
+	}
+	if site.Canary == nil {
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{
+			"error": "Site does not have a canary app",
+		})
+		return
+	}
+
+	site.App = site.Canary.App
+	site.Canary = nil
+	updateCanarySite(c, site)
+}
+
+// CanaryAbortHandler is the handler for DELETE /site/{domain}/canary, which removes the canary app and sends all traffic to the main one
+func CanaryAbortHandler(c *gin.Context) {
+	site := getCanarySite(c)
+	if site == nil {
+		return
+	}
+	if site.Canary == nil {
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{
+			"error": "Site does not have a canary app",
+		})
+		return
+	}
+
+	site.Canary = nil
+	updateCanarySite(c, site)
+}
+
+// Returns the site from the domain parameter, or nil if the request was aborted
+func getCanarySite(c *gin.Context) *state.SiteState {
+	domain := c.Param("domain")
+	if len(domain) == 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid parameter 'domain'",
+		})
+		return nil
+	}
+
+	// Get the site from the state object
+	site := state.Instance.GetSite(domain)
+	if site == nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{
+			"error": "Domain name not found",
+		})
+		return nil
+	}
+	return site
+}
+
+// Stores the updated site and queues a sync
+func updateCanarySite(c *gin.Context, site *state.SiteState) {
+	if err := state.Instance.UpdateSite(site, true); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	// Queue a sync
+	sync.QueueRun()
+
+	// Respond with "No content"
+	c.Status(http.StatusNoContent)
+}
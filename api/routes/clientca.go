@@ -0,0 +1,239 @@
+/*
+Copyright © 2020 Alessandro Segala (@ItalyPaleAle)
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published
+by the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package routes
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/statiko-dev/statiko/appmanager"
+	"github.com/statiko-dev/statiko/state"
+	"github.com/statiko-dev/statiko/sync"
+)
+
+type clientCAAddRequest struct {
+	Name string `json:"name" form:"name"`
+	CA   string `json:"ca" form:"ca"`
+}
+
+// ImportClientCAHandler is the handler for POST /clientca, which stores a bundle of CA certificates used to authenticate clients
+// The bundle must contain one or more PEM-encoded certificates
+// Name must be a lowercase string with letters, numbers, dashes and dots only, and must begin with a letter
+func ImportClientCAHandler(c *gin.Context) {
+	// Get data from the form body
+	data := &clientCAAddRequest{}
+	if err := c.Bind(data); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request body: " + err.Error(),
+		})
+		return
+	}
+	if data.Name == "" || data.CA == "" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"error": "Fields 'name' and 'ca' must not be empty",
+		})
+		return
+	}
+
+	// Validate the name
+	if certNameRegEx == nil {
+		certNameRegEx = regexp.MustCompile("^([a-z][a-z0-9\\.\\-]*)$")
+	}
+	data.Name = strings.ToLower(data.Name)
+	if !certNameRegEx.MatchString(data.Name) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"error": "Name must contain letters, numbers, dots and dashes only, and it must begin with a letter",
+		})
+		return
+	}
+
+	// Validate all certificates in the bundle
+	rest := []byte(data.CA)
+	count := 0
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+				"error": "Bundle must contain certificates only",
+			})
+			return
+		}
+		if _, err := x509.ParseCertificate(block.Bytes); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+				"error": "Invalid certificate: " + err.Error(),
+			})
+			return
+		}
+		count++
+	}
+	if count == 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid certificate PEM block",
+		})
+		return
+	}
+
+	// Store the bundle
+	if err := state.Instance.SetClientCA(data.Name, []byte(data.CA)); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	// We'll trigger a sync in case an existing bundle was updated
+	sync.QueueRun()
+
+	// Respond with "No Content"
+	c.Status(http.StatusNoContent)
+}
+
+// ListClientCAHandler is the handler for GET /clientca, which lists all bundles of CA certificates used to authenticate clients (names only)
+func ListClientCAHandler(c *gin.Context) {
+	// Get the list from the state object
+	list := state.Instance.ListClientCAs()
+	sort.Strings(list)
+	c.JSON(http.StatusOK, list)
+}
+
+// DeleteClientCAHandler is the handler for DELETE /clientca/{name}, which removes a bundle of CA certificates from the store
+// Only bundles not used by any site can be deleted
+func DeleteClientCAHandler(c *gin.Context) {
+	if name := c.Param("name"); len(name) > 0 {
+		name = strings.ToLower(name)
+
+		// Check if the bundle exists in the store
+		ca, err := state.Instance.GetClientCA(name)
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		if len(ca) == 0 {
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{
+				"error": "Client CA does not exist in store",
+			})
+			return
+		}
+
+		// Check if any site is using the bundle
+		sites := state.Instance.GetSites()
+		for _, s := range sites {
+			if s.TLS != nil && s.TLS.ClientCA != nil && *s.TLS.ClientCA == name {
+				c.AbortWithStatusJSON(http.StatusConflict, gin.H{
+					"error": "Client CA is in use and can't be removed",
+				})
+				return
+			}
+		}
+
+		// Delete the bundle
+		if err := state.Instance.RemoveClientCA(name); err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+
+		c.Status(http.StatusNoContent)
+	} else {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid parameter 'name'",
+		})
+	}
+}
+
+// Validates the options for authenticating clients with certificates and sets them in the TLS object
+// Returns false if the request was aborted
+func setSiteClientAuth(c *gin.Context, tls *state.SiteTLS, clientCA *string, clientAuth string) bool {
+	// Client certificates are disabled
+	if clientCA == nil || *clientCA == "" {
+		tls.ClientCA = nil
+		tls.ClientAuth = ""
+		return true
+	}
+
+	// Check if the bundle exists
+	name := strings.ToLower(*clientCA)
+	ca, err := state.Instance.GetClientCA(name)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return false
+	}
+	if len(ca) == 0 {
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{
+			"error": "Client CA does not exist in store",
+		})
+		return false
+	}
+
+	// Client certificates are required by default
+	switch clientAuth {
+	case "":
+		clientAuth = state.TLSClientAuthRequired
+	case state.TLSClientAuthRequired, state.TLSClientAuthOptional:
+		// Nothing to do
+	default:
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid value for tls.clientAuth",
+		})
+		return false
+	}
+
+	tls.ClientCA = &name
+	tls.ClientAuth = clientAuth
+	return true
+}
+
+// Checks that the site can serve its apps that require client certificates, which is possible only if it has a client CA
+// Only apps that are staged in this node can be checked here; the others are checked when they're synced
+// Returns false if the request was aborted
+func checkAppsClientCert(c *gin.Context, tls *state.SiteTLS, apps ...*state.SiteApp) bool {
+	if tls != nil && tls.ClientCA != nil && *tls.ClientCA != "" {
+		return true
+	}
+	for _, app := range apps {
+		if app == nil {
+			continue
+		}
+		bundle := app.Name
+		if name, tag, ok := app.Tag(); ok {
+			// If the tag can't be resolved, the error is reported when the site is synced
+			var err error
+			if bundle, err = state.Instance.ResolveAppTag(name, tag); err != nil {
+				continue
+			}
+		}
+		manifest, err := appmanager.Instance.StagedManifest(bundle)
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return false
+		}
+		if manifest != nil && manifest.RequiresClientCert() {
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{
+				"error": "App " + app.Name + " requires client certificates, but the site doesn't have a client CA",
+			})
+			return false
+		}
+	}
+	return true
+}
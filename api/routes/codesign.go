@@ -0,0 +1,278 @@
+/*
+Copyright © 2020 Alessandro Segala (@ItalyPaleAle)
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published
+by the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package routes
+
+import (
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/statiko-dev/statiko/state"
+	"github.com/statiko-dev/statiko/sync"
+	"github.com/statiko-dev/statiko/utils"
+)
+
+type codeSignKeyAddRequest struct {
+	ID        string     `json:"id" form:"id"`
+	PublicKey string     `json:"publicKey" form:"publicKey"`
+	NotBefore *time.Time `json:"notBefore" form:"notBefore"`
+	NotAfter  *time.Time `json:"notAfter" form:"notAfter"`
+}
+
+type codeSignKeyUpdateRequest struct {
+	NotBefore *time.Time `json:"notBefore" form:"notBefore"`
+	NotAfter  *time.Time `json:"notAfter" form:"notAfter"`
+}
+
+// CodeSignKeyListHandler is the handler for GET /codesign/key, which returns the keyring of trusted keys for code signing, including revoked ones
+func CodeSignKeyListHandler(c *gin.Context) {
+	keys := state.Instance.GetCodeSignKeys()
+	if keys == nil {
+		keys = make(map[string]*state.CodeSignKey)
+	}
+
+	c.JSON(http.StatusOK, keys)
+}
+
+// CodeSignKeyRevokedHandler is the handler for GET /codesign/revoked, which returns the IDs of the revoked keys
+func CodeSignKeyRevokedHandler(c *gin.Context) {
+	list := make([]string, 0)
+	for id, key := range state.Instance.GetCodeSignKeys() {
+		if key != nil && key.Revoked != nil {
+			list = append(list, id)
+		}
+	}
+	sort.Strings(list)
+
+	c.JSON(http.StatusOK, list)
+}
+
+// CodeSignKeyAddHandler is the handler for POST /codesign/key, which adds a key to the keyring
+// The request must contain the "id" of the key and the PEM-encoded "publicKey"; optionally, pass "notBefore" and "notAfter" to limit the key's validity
+func CodeSignKeyAddHandler(c *gin.Context) {
+	// Get data from the form body
+	data := &codeSignKeyAddRequest{}
+	if err := c.Bind(data); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request body: " + err.Error(),
+		})
+		return
+	}
+
+	// Validate the request
+	id := utils.SanitizeKeyID(data.ID)
+	if id == "" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid value for 'id'",
+		})
+		return
+	}
+	if _, err := utils.ParseCodeSignKey([]byte(data.PublicKey)); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid value for 'publicKey': " + err.Error(),
+		})
+		return
+	}
+	if data.NotBefore != nil && data.NotAfter != nil && !data.NotAfter.After(*data.NotBefore) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"error": "Value for 'notAfter' must be after 'notBefore'",
+		})
+		return
+	}
+
+	// IDs of revoked keys can't be reused
+	if state.Instance.GetCodeSignKey(id) != nil {
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{
+			"error": "Key already exists in the keyring",
+		})
+		return
+	}
+
+	// Store the key
+	key := &state.CodeSignKey{
+		PublicKey: data.PublicKey,
+		NotBefore: data.NotBefore,
+		NotAfter:  data.NotAfter,
+	}
+	if err := state.Instance.SetCodeSignKey(id, key); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, key)
+}
+
+// CodeSignKeyUpdateHandler is the handler for PUT /codesign/key/:id, which updates the validity window of a key
+// Pass null values to remove the limits
+func CodeSignKeyUpdateHandler(c *gin.Context) {
+	id := c.Param("id")
+	key := state.Instance.GetCodeSignKey(id)
+	if key == nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{
+			"error": "Key not found in the keyring",
+		})
+		return
+	}
+	if key.Revoked != nil {
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{
+			"error": "Key was revoked",
+		})
+		return
+	}
+
+	// Get data from the form body
+	data := &codeSignKeyUpdateRequest{}
+	if err := c.Bind(data); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request body: " + err.Error(),
+		})
+		return
+	}
+	if data.NotBefore != nil && data.NotAfter != nil && !data.NotAfter.After(*data.NotBefore) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"error": "Value for 'notAfter' must be after 'notBefore'",
+		})
+		return
+	}
+
+	// Update the key
+	key.NotBefore = data.NotBefore
+	key.NotAfter = data.NotAfter
+	if err := state.Instance.SetCodeSignKey(id, key); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	// Queue a sync so apps signed with the key are checked again
+	sync.QueueRun()
+
+	c.JSON(http.StatusOK, key)
+}
+
+// CodeSignKeyRevokeHandler is the handler for POST /codesign/key/:id/revoke, which revokes a key
+// Apps signed with revoked keys aren't deployed anymore, even if they were deployed before
+func CodeSignKeyRevokeHandler(c *gin.Context) {
+	id := c.Param("id")
+	key := state.Instance.GetCodeSignKey(id)
+	if key == nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{
+			"error": "Key not found in the keyring",
+		})
+		return
+	}
+	if key.Revoked != nil {
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{
+			"error": "Key was already revoked",
+		})
+		return
+	}
+
+	now := time.Now()
+	key.Revoked = &now
+	if err := state.Instance.SetCodeSignKey(id, key); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	// Queue a sync so apps signed with the key are removed
+	sync.QueueRun()
+
+	c.JSON(http.StatusOK, key)
+}
+
+// CodeSignKeyDeleteHandler is the handler for DELETE /codesign/key/:id, which removes a key from the keyring
+// Only keys not in the list of allowed keys of any site can be removed
+func CodeSignKeyDeleteHandler(c *gin.Context) {
+	id := c.Param("id")
+	if state.Instance.GetCodeSignKey(id) == nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{
+			"error": "Key not found in the keyring",
+		})
+		return
+	}
+
+	// Check if any site is using the key
+	for _, s := range state.Instance.GetSites() {
+		if utils.StringInSlice(s.AllowedKeys, id) {
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{
+				"error": "Key is allowed by site " + s.Domain + " and can't be removed",
+			})
+			return
+		}
+	}
+
+	if err := state.Instance.SetCodeSignKey(id, nil); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	// Queue a sync so apps signed with the key are removed
+	sync.QueueRun()
+
+	c.Status(http.StatusNoContent)
+}
+
+// Validates the ID of the key in the keyring that created a signature, if any
+// Returns false if the request was aborted
+func validateSigningKeyID(c *gin.Context, keyID string, signature string) bool {
+	if keyID == "" {
+		return true
+	}
+	if signature == "" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"error": "Field 'keyId' requires a 'signature'",
+		})
+		return false
+	}
+	key := state.Instance.GetCodeSignKey(keyID)
+	if key == nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"error": "Key not found in the keyring: " + keyID,
+		})
+		return false
+	}
+	if err := key.Usable(time.Now()); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"error": "Key " + keyID + " cannot be used: " + err.Error(),
+		})
+		return false
+	}
+	return true
+}
+
+// Validates the list of keys allowed to sign apps for a site, which must be in the keyring and not revoked
+// Returns false if the request was aborted
+func validateAllowedKeys(c *gin.Context, keys []string) bool {
+	for _, id := range keys {
+		key := state.Instance.GetCodeSignKey(id)
+		if key == nil {
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{
+				"error": "Key not found in the keyring: " + id,
+			})
+			return false
+		}
+		if key.Revoked != nil {
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{
+				"error": "Key was revoked: " + id,
+			})
+			return false
+		}
+	}
+	return true
+}
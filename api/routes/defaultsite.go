@@ -0,0 +1,112 @@
+/*
+Copyright © 2020 Alessandro Segala (@ItalyPaleAle)
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published
+by the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package routes
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/statiko-dev/statiko/certificates/azurekeyvault"
+	"github.com/statiko-dev/statiko/state"
+	"github.com/statiko-dev/statiko/sync"
+)
+
+// DefaultSiteGetHandler is the handler for GET /defaultsite, which returns the configuration of the site served for unknown hosts
+func DefaultSiteGetHandler(c *gin.Context) {
+	defaultSite := state.Instance.GetDefaultSite()
+	if defaultSite == nil {
+		defaultSite = &state.NodeDefaultSite{}
+	}
+
+	c.JSON(http.StatusOK, defaultSite)
+}
+
+// DefaultSiteSetHandler is the handler for POST/PUT /defaultsite, which configures the site served for unknown hosts
+// The default site can serve an app, or drop connections (with no app and `drop` set to true); it can also have its own TLS certificate
+func DefaultSiteSetHandler(c *gin.Context) {
+	// Get data from the form body
+	defaultSite := &state.NodeDefaultSite{}
+	if err := c.Bind(defaultSite); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request body: " + err.Error(),
+		})
+		return
+	}
+	if !defaultSite.Validate() {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid default site configuration",
+		})
+		return
+	}
+
+	// Check if the TLS certificate exists
+	if defaultSite.TLS != nil {
+		var exists bool
+		switch defaultSite.TLS.Type {
+		case state.TLSCertificateImported:
+			key, cert, err := state.Instance.GetCertificate(state.TLSCertificateImported, []string{*defaultSite.TLS.Certificate})
+			if err != nil {
+				c.AbortWithError(http.StatusInternalServerError, err)
+				return
+			}
+			exists = len(key) > 0 && len(cert) > 0
+		case state.TLSCertificateAzureKeyVault:
+			var err error
+			exists, err = azurekeyvault.GetInstance().CertificateExists(*defaultSite.TLS.Certificate)
+			if err != nil {
+				c.AbortWithError(http.StatusInternalServerError, err)
+				return
+			}
+		}
+		if !exists {
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{
+				"error": "TLS certificate does not exist",
+			})
+			return
+		}
+
+		// Ensure an empty version is stored as nil
+		if defaultSite.TLS.Version != nil && *defaultSite.TLS.Version == "" {
+			defaultSite.TLS.Version = nil
+		}
+	}
+
+	// Store the configuration
+	if err := state.Instance.SetDefaultSite(defaultSite); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	// Queue a sync
+	sync.QueueRun()
+
+	c.JSON(http.StatusOK, defaultSite)
+}
+
+// DefaultSiteResetHandler is the handler for DELETE /defaultsite, which restores the built-in default site
+func DefaultSiteResetHandler(c *gin.Context) {
+	if err := state.Instance.SetDefaultSite(nil); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	// Queue a sync
+	sync.QueueRun()
+
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,158 @@
+/*
+Copyright © 2020 Alessandro Segala (@ItalyPaleAle)
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published
+by the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package routes
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/statiko-dev/statiko/fs"
+	"github.com/statiko-dev/statiko/state"
+	"github.com/statiko-dev/statiko/uploads"
+	"github.com/statiko-dev/statiko/utils"
+)
+
+type deltaCreateRequest struct {
+	Name      string              `json:"name" form:"name"`
+	Base      string              `json:"base" form:"base"`
+	Files     utils.FilesManifest `json:"files" form:"files"`
+	Signature string              `json:"signature" form:"signature"`
+	KeyID     string              `json:"keyId" form:"keyId"`
+}
+
+// DeltaCreateHandler is the handler for POST /delta, which starts a delta deploy
+// The request must contain the "name" of the new bundle and the list of "files", each with its "path" and hex-encoded SHA-256 "hash"; "base" is the bundle (or the "app:tag" in the registry) the new bundle is based on
+// If code signing is used, "signature" is for the list of files in the canonical format (the same as the output of sha256sum, sorted by path), and "keyId" is the ID of the key in the keyring that created it
+// The response contains the hashes of the blobs that are "missing" and need to be uploaded
+func DeltaCreateHandler(c *gin.Context) {
+	// Get data from the body
+	data := &deltaCreateRequest{}
+	if err := c.BindJSON(data); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request body: " + err.Error(),
+		})
+		return
+	}
+
+	// Validate the request
+	name := utils.SanitizeAppName(data.Name)
+	if name == "" || name == reservedAppName {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"error": "Filename for the file is empty or invalid",
+		})
+		return
+	}
+	if err := data.Files.Validate(); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid value for 'files': " + err.Error(),
+		})
+		return
+	}
+	if len(data.Signature) > 2048 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"error": "Value for 'signature' cannot be longer than 2048 characters",
+		})
+		return
+	}
+	if !validateSigningKeyID(c, data.KeyID, data.Signature) {
+		return
+	}
+	base := data.Base
+	if base != "" {
+		app := &state.SiteApp{Name: base}
+		if appName, tag, ok := app.Tag(); ok {
+			bundle, err := state.Instance.ResolveAppTag(appName, tag)
+			if err != nil {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+					"error": "Invalid value for 'base': " + err.Error(),
+				})
+				return
+			}
+			base = bundle
+		} else if utils.SanitizeAppName(base) == "" {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+				"error": "Invalid value for 'base'",
+			})
+			return
+		}
+	}
+
+	// Check if the app exists already
+	_, err := fs.Instance.GetMetadata(name)
+	if err == nil {
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{
+			"error": "File already exists",
+		})
+		return
+	} else if err != fs.ErrNotExist {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	// Create the session
+	session, err := uploads.Instance.CreateDelta(c.Request.Context(), name, base, data.Files, data.Signature, data.KeyID)
+	if err != nil {
+		abortUploadError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, session)
+}
+
+// DeltaShowHandler is the handler for GET /delta/:id, which returns the status of a delta deploy, including the blobs that are still missing
+func DeltaShowHandler(c *gin.Context) {
+	session, err := uploads.Instance.GetDelta(c.Param("id"))
+	if err != nil {
+		abortUploadError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, session)
+}
+
+// DeltaBlobHandler is the handler for PUT /delta/:id/blob/:hash, which uploads one of the missing blobs of a delta deploy
+// The body of the request contains the raw content of the file
+func DeltaBlobHandler(c *gin.Context) {
+	session, err := uploads.Instance.WriteBlob(c.Request.Context(), c.Param("id"), c.Param("hash"), c.Request.Body)
+	if err != nil {
+		abortUploadError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, session)
+}
+
+// DeltaFinalizeHandler is the handler for POST /delta/:id/finalize, which assembles the new bundle and stores it in the repo
+func DeltaFinalizeHandler(c *gin.Context) {
+	if err := uploads.Instance.FinalizeDelta(c.Request.Context(), c.Param("id")); err != nil {
+		abortUploadError(c, err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// DeltaDeleteHandler is the handler for DELETE /delta/:id, which aborts a delta deploy
+func DeltaDeleteHandler(c *gin.Context) {
+	if err := uploads.Instance.DeleteDelta(c.Param("id")); err != nil {
+		abortUploadError(c, err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
@@ -21,11 +21,14 @@ import (
 
 	"github.com/gin-gonic/gin"
 
+	"github.com/statiko-dev/statiko/appconfig"
 	"github.com/statiko-dev/statiko/state"
 	"github.com/statiko-dev/statiko/sync"
+	"github.com/statiko-dev/statiko/utils"
 )
 
 // DeploySiteHandler is the handler for POST/PUT /site/{domain}/app, which deploys an app
+// With the `preview` querystring parameter, the app is served on a temporary domain until it's promoted
 func DeploySiteHandler(c *gin.Context) {
 	// Get the site to update (domain name)
 	domain := c.Param("domain")
@@ -59,8 +62,91 @@ func DeploySiteHandler(c *gin.Context) {
 		})
 		return
 	}
+	if !checkAppsClientCert(c, site.TLS, &app) {
+		return
+	}
+
+	// If the app is deployed for preview, it's served on a temporary domain until it's promoted
+	preview := utils.IsTruthy(c.Query("preview"))
+	if preview {
+		if site.PreviewDomain == "" {
+			tempDomain := appconfig.Config.GetString("temporarySites.domain")
+			if tempDomain == "" {
+				c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
+					"error": "Configuration option `temporarySites.domain` must be set before deploying an app for preview",
+				})
+				return
+			}
+			if tempDomain[0] != '.' {
+				// Ensure there's a dot at the beginning
+				tempDomain = "." + tempDomain
+			}
+			site.PreviewDomain = generateTemporaryDomain(tempDomain)
+			for previewDomainExists(site.PreviewDomain) {
+				site.PreviewDomain = generateTemporaryDomain(tempDomain)
+			}
+		}
+		site.PendingApp = &app
+	} else {
+		if site.App != nil && site.App.Name != app.Name {
+			site.PreviousApp = site.App
+		}
+		site.App = &app
+	}
+
+	// Update the app
+	if err := state.Instance.UpdateSite(site, true); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	// Queue a sync
+	sync.QueueRun()
+
+	// When deploying for preview, respond with the site, which contains the preview domain
+	if preview {
+		c.JSON(http.StatusOK, site)
+		return
+	}
+
+	// Respond with "No content"
+	c.Status(http.StatusNoContent)
+}
+
+// PromoteSiteAppHandler is the handler for POST /site/{domain}/app/promote, which makes the app deployed for preview the active one
+func PromoteSiteAppHandler(c *gin.Context) {
+	// Get the site to update (domain name)
+	domain := c.Param("domain")
+	if len(domain) == 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid parameter 'domain'",
+		})
+		return
+	}
+
+	// Get the site from the state object
+	site := state.Instance.GetSite(domain)
+	if site == nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{
+			"error": "Domain name not found",
+		})
+		return
+	}
+	if site.PendingApp == nil {
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{
+			"error": "Site does not have an app deployed for preview",
+		})
+		return
+	}
 
-	site.App = &app
+	// The pending app is already staged, so switching the symbolic link is atomic
+	if site.App != nil && site.App.Name != site.PendingApp.Name {
+		site.PreviousApp = site.App
+	}
+	previewDomain := site.PreviewDomain
+	site.App = site.PendingApp
+	site.PendingApp = nil
+	site.PreviewDomain = ""
 
 	// Update the app
 	if err := state.Instance.UpdateSite(site, true); err != nil {
@@ -68,9 +154,130 @@ func DeploySiteHandler(c *gin.Context) {
 		return
 	}
 
+	// Remove the certificate of the preview site
+	if err := removePreviewCertificate(previewDomain); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
 	// Queue a sync
 	sync.QueueRun()
 
 	// Respond with "No content"
 	c.Status(http.StatusNoContent)
 }
+
+// AbortSiteAppHandler is the handler for POST /site/{domain}/app/abort, which discards the app deployed for preview
+func AbortSiteAppHandler(c *gin.Context) {
+	// Get the site to update (domain name)
+	domain := c.Param("domain")
+	if len(domain) == 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid parameter 'domain'",
+		})
+		return
+	}
+
+	// Get the site from the state object
+	site := state.Instance.GetSite(domain)
+	if site == nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{
+			"error": "Domain name not found",
+		})
+		return
+	}
+	if site.PendingApp == nil {
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{
+			"error": "Site does not have an app deployed for preview",
+		})
+		return
+	}
+
+	// Remove the pending app and the preview site
+	previewDomain := site.PreviewDomain
+	site.PendingApp = nil
+	site.PreviewDomain = ""
+
+	// Update the site
+	if err := state.Instance.UpdateSite(site, true); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	// Remove the certificate of the preview site
+	if err := removePreviewCertificate(previewDomain); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	// Queue a sync
+	sync.QueueRun()
+
+	// Respond with "No content"
+	c.Status(http.StatusNoContent)
+}
+
+// RollbackSiteAppHandler is the handler for POST /site/{domain}/app/rollback, which restores the previously active app
+func RollbackSiteAppHandler(c *gin.Context) {
+	// Get the site to update (domain name)
+	domain := c.Param("domain")
+	if len(domain) == 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid parameter 'domain'",
+		})
+		return
+	}
+
+	// Get the site from the state object
+	site := state.Instance.GetSite(domain)
+	if site == nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{
+			"error": "Domain name not found",
+		})
+		return
+	}
+	if site.PreviousApp == nil {
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{
+			"error": "Site does not have a previous app",
+		})
+		return
+	}
+
+	// Swap the apps, so the rollback can be reverted too
+	site.App, site.PreviousApp = site.PreviousApp, site.App
+
+	// Update the app
+	if err := state.Instance.UpdateSite(site, true); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	// Queue a sync
+	sync.QueueRun()
+
+	// Respond with "No content"
+	c.Status(http.StatusNoContent)
+}
+
+// Returns true if the domain is used by a site or by the preview of a site
+func previewDomainExists(domain string) bool {
+	return state.Instance.GetSite(domain) != nil || isPreviewDomain(domain)
+}
+
+// Returns true if the domain is used by the preview of a site
+func isPreviewDomain(domain string) bool {
+	for _, s := range state.Instance.GetSites() {
+		if s.PreviewDomain != "" && s.PreviewDomain == domain {
+			return true
+		}
+	}
+	return false
+}
+
+// Removes the self-signed certificate generated for the preview site
+func removePreviewCertificate(previewDomain string) error {
+	if previewDomain == "" {
+		return nil
+	}
+	return state.Instance.RemoveCertificate(state.TLSCertificateSelfSigned, []string{previewDomain})
+}
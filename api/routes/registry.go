@@ -0,0 +1,277 @@
+/*
+Copyright © 2020 Alessandro Segala (@ItalyPaleAle)
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published
+by the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package routes
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/statiko-dev/statiko/fs"
+	"github.com/statiko-dev/statiko/state"
+	"github.com/statiko-dev/statiko/sync"
+	"github.com/statiko-dev/statiko/utils"
+)
+
+// Tag that always points to the most recent version of an app
+const latestAppTag = "latest"
+
+type registryVersionRequest struct {
+	Bundle string   `json:"bundle" form:"bundle"`
+	Tags   []string `json:"tags" form:"tags"`
+}
+
+type registryTagRequest struct {
+	Bundle string `json:"bundle" form:"bundle"`
+}
+
+// RegistryListHandler is the handler for GET /registry, which lists all apps in the registry
+func RegistryListHandler(c *gin.Context) {
+	apps := state.Instance.GetApps()
+	if apps == nil {
+		apps = make(map[string]*state.NodeApp)
+	}
+
+	c.JSON(http.StatusOK, apps)
+}
+
+// RegistryShowHandler is the handler for GET /registry/:app, which returns the versions and tags of an app
+func RegistryShowHandler(c *gin.Context) {
+	app := state.Instance.GetApp(c.Param("app"))
+	if app == nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{
+			"error": "App not found in the registry",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, app)
+}
+
+// RegistryAddVersionHandler is the handler for POST /registry/:app/version, which adds a bundle as the most recent version of an app, creating the app if needed
+// The "latest" tag is moved to the new version, together with any other tag in the "tags" field
+func RegistryAddVersionHandler(c *gin.Context) {
+	name := utils.SanitizeAppName(c.Param("app"))
+	if name == "" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid parameter 'app'",
+		})
+		return
+	}
+
+	// Get data from the form body
+	data := &registryVersionRequest{}
+	if err := c.Bind(data); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request body: " + err.Error(),
+		})
+		return
+	}
+	bundle := utils.SanitizeAppName(data.Bundle)
+	if bundle == "" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid value for 'bundle'",
+		})
+		return
+	}
+	tags := []string{latestAppTag}
+	for _, t := range data.Tags {
+		tag := utils.SanitizeAppTag(t)
+		if tag == "" {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+				"error": "Invalid tag: " + t,
+			})
+			return
+		}
+		tags = append(tags, tag)
+	}
+
+	// Ensure the bundle exists in the repo
+	if !registryBundleExists(c, bundle) {
+		return
+	}
+
+	// Add the version
+	app, err := state.Instance.AddAppVersion(name, bundle, tags)
+	if err == state.ErrVersionExists {
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{
+			"error": "Bundle is already a version of this app",
+		})
+		return
+	} else if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	// If any site is using the tags, queue a sync to deploy the new version
+	queueSyncForTags(name, tags)
+
+	c.JSON(http.StatusOK, app)
+}
+
+// RegistryTagHandler is the handler for POST/PUT /registry/:app/tag/:tag, which points a tag to a version of an app
+// All sites using the tag are re-deployed with the new version
+func RegistryTagHandler(c *gin.Context) {
+	name := c.Param("app")
+	tag := utils.SanitizeAppTag(c.Param("tag"))
+	if tag == "" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid parameter 'tag'",
+		})
+		return
+	}
+
+	// Get data from the form body
+	data := &registryTagRequest{}
+	if err := c.Bind(data); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request body: " + err.Error(),
+		})
+		return
+	}
+
+	// Move the tag; the bundle must be a version of the app
+	app, err := state.Instance.SetAppTag(name, tag, data.Bundle)
+	switch err {
+	case nil:
+		// Nothing to do
+	case state.ErrAppNotFound:
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{
+			"error": "App not found in the registry",
+		})
+		return
+	case state.ErrVersionNotFound:
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"error": "Bundle is not a version of this app",
+		})
+		return
+	default:
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	// If any site is using the tag, queue a sync to deploy the new version
+	queueSyncForTags(name, []string{tag})
+
+	c.JSON(http.StatusOK, app)
+}
+
+// RegistryUntagHandler is the handler for DELETE /registry/:app/tag/:tag, which removes a tag that isn't used by any site
+func RegistryUntagHandler(c *gin.Context) {
+	name := c.Param("app")
+	tag := c.Param("tag")
+
+	app := state.Instance.GetApp(name)
+	if app == nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{
+			"error": "App not found in the registry",
+		})
+		return
+	}
+	if _, ok := app.Tags[tag]; !ok {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{
+			"error": "Tag not found",
+		})
+		return
+	}
+	if appTagInUse(name, tag) {
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{
+			"error": "Tag is used by a site",
+		})
+		return
+	}
+
+	delete(app.Tags, tag)
+	if err := state.Instance.SetApp(name, app); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// RegistryDeleteHandler is the handler for DELETE /registry/:app, which removes an app from the registry if none of its tags is used by a site
+// Bundles are not deleted from the repo
+func RegistryDeleteHandler(c *gin.Context) {
+	name := c.Param("app")
+
+	app := state.Instance.GetApp(name)
+	if app == nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{
+			"error": "App not found in the registry",
+		})
+		return
+	}
+	for tag := range app.Tags {
+		if appTagInUse(name, tag) {
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{
+				"error": "Tag " + tag + " is used by a site",
+			})
+			return
+		}
+	}
+
+	if err := state.Instance.SetApp(name, nil); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// Returns true if the bundle exists in the repo; otherwise, responds with an error
+func registryBundleExists(c *gin.Context, bundle string) bool {
+	_, err := fs.Instance.GetMetadata(bundle)
+	if err == fs.ErrNotExist {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{
+			"error": "Bundle not found in the repo",
+		})
+		return false
+	} else if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return false
+	}
+	return true
+}
+
+// Queues a sync if any of the tags of the app is used by a site
+func queueSyncForTags(name string, tags []string) {
+	for _, tag := range tags {
+		if appTagInUse(name, tag) {
+			sync.QueueRun()
+			return
+		}
+	}
+}
+
+// Returns true if a tag of an app in the registry is used by a site, including the default site
+func appTagInUse(name string, tag string) bool {
+	ref := name + ":" + tag
+	uses := func(app *state.SiteApp) bool {
+		return app != nil && app.Name == ref
+	}
+
+	for _, s := range state.Instance.GetSites() {
+		if uses(s.App) || uses(s.PendingApp) || (s.Canary != nil && uses(s.Canary.App)) {
+			return true
+		}
+	}
+	if defaultSite := state.Instance.GetDefaultSite(); defaultSite != nil && uses(defaultSite.App) {
+		return true
+	}
+	return false
+}
@@ -17,11 +17,13 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package routes
 
 import (
+	"encoding/json"
 	"fmt"
 	"math/rand"
 	"net/http"
 	"reflect"
 	"strings"
+	"time"
 
 	petname "github.com/dustinkirkland/golang-petname"
 	"github.com/gin-gonic/gin"
@@ -44,6 +46,11 @@ func CreateSiteHandler(c *gin.Context) {
 		return
 	}
 
+	// Previews and rollbacks are set by deploys only
+	site.PendingApp = nil
+	site.PreviewDomain = ""
+	site.PreviousApp = nil
+
 	// If we're creating a temporary site, generate a domain name
 	if site.Temporary {
 		// Ensure a domain is set
@@ -73,7 +80,13 @@ func CreateSiteHandler(c *gin.Context) {
 			})
 			return
 		}
-		site.Domain = fmt.Sprintf("%s-%d%s", petname.Generate(3, "-"), (rand.Intn(899) + 100), tempDomain)
+		site.Domain = generateTemporaryDomain(tempDomain)
+
+		// Temporary sites expire after the default TTL, unless an expiry time was set in the request
+		if ttl := appconfig.Config.GetDuration("temporarySites.ttl"); site.Expires == nil && ttl > 0 {
+			expires := time.Now().Add(ttl)
+			site.Expires = &expires
+		}
 	} else {
 		// Ensure that the domain name is set
 		if site.Domain == "" {
@@ -82,6 +95,52 @@ func CreateSiteHandler(c *gin.Context) {
 			})
 			return
 		}
+
+		// Only temporary sites can expire
+		if site.Expires != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+				"error": "Only temporary sites can have an expiry time",
+			})
+			return
+		}
+	}
+
+	// Validate the maintenance mode options, if any
+	if site.Maintenance != nil && !site.Maintenance.Validate() {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid maintenance page, retryAfter or allowIPs",
+		})
+		return
+	}
+
+	// Validate the canary, if any, like in CanarySetHandler
+	if site.Canary != nil {
+		if site.App == nil {
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{
+				"error": "Site does not have an app deployed",
+			})
+			return
+		}
+		if site.Canary.App == nil || !site.Canary.App.Validate() {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+				"error": "Invalid app name",
+			})
+			return
+		}
+		if site.Canary.App.Name == site.App.Name {
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{
+				"error": "App is already deployed on the site",
+			})
+			return
+		}
+	}
+
+	// Validate the rate limit, if any
+	if site.RateLimit != nil && !site.RateLimit.Validate() {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid rate, burst or status for rateLimit",
+		})
+		return
 	}
 
 	// Check if site exists already
@@ -89,7 +148,7 @@ func CreateSiteHandler(c *gin.Context) {
 	copy(domains, site.Aliases)
 	domains[len(site.Aliases)] = site.Domain
 	for _, el := range domains {
-		if state.Instance.GetSite(el) != nil {
+		if previewDomainExists(el) {
 			c.AbortWithStatusJSON(http.StatusConflict, gin.H{
 				"error": "Domain or alias already exists",
 			})
@@ -97,6 +156,14 @@ func CreateSiteHandler(c *gin.Context) {
 		}
 	}
 
+	// Options for client certificates are set separately, as the TLS object can be replaced below
+	var clientCA *string
+	clientAuth := ""
+	if site.TLS != nil {
+		clientCA = site.TLS.ClientCA
+		clientAuth = site.TLS.ClientAuth
+	}
+
 	// Self-signed TLS certificates are default when no value is specified
 	// If the value is "acme", request a certificate from ACME
 	if site.TLS == nil || site.TLS.Type == "" || site.TLS.Type == state.TLSCertificateSelfSigned {
@@ -153,6 +220,23 @@ func CreateSiteHandler(c *gin.Context) {
 		site.TLS.Version = nil
 	}
 
+	// Client certificates
+	if !setSiteClientAuth(c, site.TLS, clientCA, clientAuth) {
+		return
+	}
+	var canaryApp *state.SiteApp
+	if site.Canary != nil {
+		canaryApp = site.Canary.App
+	}
+	if !checkAppsClientCert(c, site.TLS, site.App, canaryApp) {
+		return
+	}
+
+	// Keys allowed to sign the site's apps
+	if !validateAllowedKeys(c, site.AllowedKeys) {
+		return
+	}
+
 	// Add the website to the store
 	if err := state.Instance.AddSite(site); err != nil {
 		c.AbortWithError(http.StatusInternalServerError, err)
@@ -314,6 +398,7 @@ func PatchSiteHandler(c *gin.Context) {
 		case "tls":
 			if t != nil && t.Kind() == reflect.Map {
 				vMap := v.(map[string]interface{})
+				prevTLS := site.TLS
 				certType, ok := vMap["type"].(string)
 				if !ok {
 					c.AbortWithStatusJSON(http.StatusConflict, gin.H{
@@ -405,6 +490,112 @@ func PatchSiteHandler(c *gin.Context) {
 					})
 					return
 				}
+
+				// Client certificates
+				// If the request doesn't contain the "clientCA" key, the previous options are kept
+				if _, ok := vMap["clientCA"]; ok {
+					var clientCA *string
+					if name, ok := vMap["clientCA"].(string); ok {
+						clientCA = &name
+					}
+					clientAuth, _ := vMap["clientAuth"].(string)
+					if !setSiteClientAuth(c, site.TLS, clientCA, clientAuth) {
+						return
+					}
+				} else if prevTLS != nil {
+					site.TLS.ClientCA = prevTLS.ClientCA
+					site.TLS.ClientAuth = prevTLS.ClientAuth
+				}
+				var canaryApp *state.SiteApp
+				if site.Canary != nil {
+					canaryApp = site.Canary.App
+				}
+				if !checkAppsClientCert(c, site.TLS, site.App, site.PendingApp, canaryApp) {
+					return
+				}
+				updated = true
+			}
+		case "maintenance":
+			if t == nil {
+				// Disable maintenance mode
+				site.Maintenance = nil
+				updated = true
+			} else if t.Kind() == reflect.Map {
+				// Convert the value back to JSON and parse it as a SiteMaintenance object
+				enc, err := json.Marshal(v)
+				if err != nil {
+					c.AbortWithError(http.StatusInternalServerError, err)
+					return
+				}
+				maintenance := &state.SiteMaintenance{}
+				if err := json.Unmarshal(enc, maintenance); err != nil {
+					c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+						"error": "Invalid value for maintenance: " + err.Error(),
+					})
+					return
+				}
+				if !maintenance.Validate() {
+					c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+						"error": "Invalid maintenance page, retryAfter or allowIPs",
+					})
+					return
+				}
+				site.Maintenance = maintenance
+				updated = true
+			}
+		case "ratelimit":
+			if t == nil {
+				// Remove the rate limit
+				site.RateLimit = nil
+				updated = true
+			} else if t.Kind() == reflect.Map {
+				// Convert the value back to JSON and parse it as a RateLimit object
+				enc, err := json.Marshal(v)
+				if err != nil {
+					c.AbortWithError(http.StatusInternalServerError, err)
+					return
+				}
+				rateLimit := &utils.RateLimit{}
+				if err := json.Unmarshal(enc, rateLimit); err != nil {
+					c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+						"error": "Invalid value for rateLimit: " + err.Error(),
+					})
+					return
+				}
+				if !rateLimit.Validate() {
+					c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+						"error": "Invalid rate, burst or status for rateLimit",
+					})
+					return
+				}
+				site.RateLimit = rateLimit
+				updated = true
+			}
+		case "allowedkeys":
+			if t == nil {
+				// Allow any trusted key
+				site.AllowedKeys = nil
+				updated = true
+			} else if t.Kind() == reflect.Slice {
+				keys := make([]string, 0)
+				for _, k := range v.([]interface{}) {
+					// Element must be a string
+					str, ok := k.(string)
+					if !ok {
+						c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+							"error": "Invalid type for element in the allowedKeys list",
+						})
+						return
+					}
+					keys = append(keys, str)
+				}
+				if !validateAllowedKeys(c, keys) {
+					return
+				}
+				if len(keys) == 0 {
+					keys = nil
+				}
+				site.AllowedKeys = keys
 				updated = true
 			}
 		case "aliases":
@@ -438,7 +629,7 @@ func PatchSiteHandler(c *gin.Context) {
 
 					// Aliases can't be defined somewhere else (but can be defined in this same site!)
 					ok := state.Instance.GetSite(str)
-					if ok != nil && ok.Domain != site.Domain {
+					if (ok != nil && ok.Domain != site.Domain) || isPreviewDomain(str) {
 						c.AbortWithStatusJSON(http.StatusNotFound, gin.H{
 							"error": "Alias " + str + " already exists",
 						})
@@ -466,3 +657,70 @@ func PatchSiteHandler(c *gin.Context) {
 	// Respond with the site
 	c.JSON(http.StatusOK, site)
 }
+
+// ExtendSiteHandler is the handler for POST /site/:domain/extend, which extends the expiry time of a site
+func ExtendSiteHandler(c *gin.Context) {
+	// Get the site to update (domain name)
+	domain := c.Param("domain")
+	if len(domain) == 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid parameter 'domain'",
+		})
+		return
+	}
+
+	// Get the site from the state object
+	site := state.Instance.GetSite(domain)
+	if site == nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{
+			"error": "Domain name not found",
+		})
+		return
+	}
+	if !site.Temporary || site.Expires == nil {
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{
+			"error": "Site is not temporary or does not have an expiry time",
+		})
+		return
+	}
+
+	// Get the TTL from the body
+	var args struct {
+		TTL string `json:"ttl" binding:"required"`
+	}
+	if err := c.Bind(&args); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request body: " + err.Error(),
+		})
+		return
+	}
+	ttl, err := time.ParseDuration(args.TTL)
+	if err != nil || ttl <= 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid value for ttl",
+		})
+		return
+	}
+
+	// Extend the expiry time, starting from now if the site has already expired but hasn't been deleted yet
+	expires := *site.Expires
+	if now := time.Now(); expires.Before(now) {
+		expires = now
+	}
+	expires = expires.Add(ttl)
+	site.Expires = &expires
+
+	if err := state.Instance.UpdateSite(site, true); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	// Respond with the site
+	c.JSON(http.StatusOK, site)
+}
+
+// Generates a random domain name for a temporary site
+// The suffix is the value of `temporarySites.domain`, beginning with a dot
+func generateTemporaryDomain(suffix string) string {
+	return fmt.Sprintf("%s-%d%s", petname.Generate(3, "-"), (rand.Intn(899) + 100), suffix)
+}
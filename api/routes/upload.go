@@ -0,0 +1,215 @@
+/*
+Copyright © 2020 Alessandro Segala (@ItalyPaleAle)
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published
+by the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package routes
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/statiko-dev/statiko/fs"
+	"github.com/statiko-dev/statiko/uploads"
+	"github.com/statiko-dev/statiko/utils"
+)
+
+type uploadCreateRequest struct {
+	Name      string `json:"name" form:"name"`
+	Type      string `json:"type" form:"type"`
+	Size      int64  `json:"size" form:"size"`
+	Signature string `json:"signature" form:"signature"`
+	KeyID     string `json:"keyId" form:"keyId"`
+}
+
+type uploadFinalizeRequest struct {
+	Hash string `json:"hash" form:"hash"`
+}
+
+// UploadCreateHandler is the handler for POST /upload, which starts a resumable upload of an app bundle
+// The request must contain the "name", "type" and "size" (in bytes) of the bundle, and optionally a "signature" and the "keyId" of the key in the keyring that created it
+// Sessions are stored on the node that receives the request, so all requests for the same session must be sent to the same node
+func UploadCreateHandler(c *gin.Context) {
+	// Get data from the form body
+	data := &uploadCreateRequest{}
+	if err := c.Bind(data); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request body: " + err.Error(),
+		})
+		return
+	}
+
+	// Validate the request
+	name := utils.SanitizeAppName(data.Name)
+	if name == "" || name == reservedAppName {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"error": "Filename for the file is empty or invalid",
+		})
+		return
+	}
+	if data.Type == "" || !utils.StringInSlice(utils.ArchiveExtensions, "."+data.Type) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"error": "File extension is empty or invalid",
+		})
+		return
+	}
+	if data.Size <= 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"error": "Value for 'size' must be greater than zero",
+		})
+		return
+	}
+	if len(data.Signature) > 2048 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"error": "Value for 'signature' cannot be longer than 2048 characters",
+		})
+		return
+	}
+
+	if !validateSigningKeyID(c, data.KeyID, data.Signature) {
+		return
+	}
+
+	// Check if the app exists already, so clients don't upload the whole file before finding out
+	_, err := fs.Instance.GetMetadata(name)
+	if err == nil {
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{
+			"error": "File already exists",
+		})
+		return
+	} else if err != fs.ErrNotExist {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	// Create the session
+	session, err := uploads.Instance.Create(name, data.Type, data.Size, data.Signature, data.KeyID)
+	if err != nil {
+		abortUploadError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, session)
+}
+
+// UploadShowHandler is the handler for GET /upload/:id, which returns the status of an upload session, including the offset to resume from
+func UploadShowHandler(c *gin.Context) {
+	session, err := uploads.Instance.Get(c.Param("id"))
+	if err != nil {
+		abortUploadError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, session)
+}
+
+// UploadChunkHandler is the handler for PUT /upload/:id, which appends a chunk of data to an upload session
+// The body of the request contains the raw data, and the "offset" querystring parameter must match the number of bytes received so far
+func UploadChunkHandler(c *gin.Context) {
+	offset, err := strconv.ParseInt(c.Query("offset"), 10, 64)
+	if err != nil || offset < 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid parameter 'offset'",
+		})
+		return
+	}
+
+	session, err := uploads.Instance.WriteChunk(c.Request.Context(), c.Param("id"), offset, c.Request.Body)
+	if err != nil {
+		if err == uploads.ErrOffsetMismatch {
+			// Include the current offset so clients can resume
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{
+				"error":  err.Error(),
+				"offset": session.Offset,
+			})
+			return
+		}
+		abortUploadError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, session)
+}
+
+// UploadFinalizeHandler is the handler for POST /upload/:id/finalize, which completes an upload session
+// The request must contain the SHA-256 "hash" of the bundle (hex or base64-encoded), which is verified before storing the bundle
+func UploadFinalizeHandler(c *gin.Context) {
+	// Get data from the form body
+	data := &uploadFinalizeRequest{}
+	if err := c.Bind(data); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request body: " + err.Error(),
+		})
+		return
+	}
+	hash, err := utils.DecodeSHA256Hash(data.Hash)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid value for 'hash': " + err.Error(),
+		})
+		return
+	}
+
+	if err := uploads.Instance.Finalize(c.Request.Context(), c.Param("id"), hash); err != nil {
+		abortUploadError(c, err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// UploadDeleteHandler is the handler for DELETE /upload/:id, which aborts an upload session
+func UploadDeleteHandler(c *gin.Context) {
+	if err := uploads.Instance.Delete(c.Param("id")); err != nil {
+		abortUploadError(c, err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// Responds with the status code for an error returned by the uploads manager, for both uploads and delta deploys
+func abortUploadError(c *gin.Context, err error) {
+	// Errors for invalid archives are wrapped, so they contain the details of the issue
+	if errors.Is(err, uploads.ErrInvalidArchive) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	switch err {
+	case uploads.ErrNotExist:
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{
+			"error": err.Error(),
+		})
+	case uploads.ErrBusy, uploads.ErrIncomplete, fs.ErrExist:
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{
+			"error": err.Error(),
+		})
+	case uploads.ErrTooLarge:
+		c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H{
+			"error": err.Error(),
+		})
+	case uploads.ErrSizeExceeded, uploads.ErrHashMismatch, uploads.ErrBaseNotExist, uploads.ErrBlobNotRequested:
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+	default:
+		c.AbortWithError(http.StatusInternalServerError, err)
+	}
+}
@@ -191,9 +191,18 @@ func (s *APIServer) setupRoutes() {
 		group.GET("/site/:domain", routes.ShowSiteHandler)
 		group.DELETE("/site/:domain", routes.DeleteSiteHandler)
 		group.PATCH("/site/:domain", routes.PatchSiteHandler)
+		group.POST("/site/:domain/extend", routes.ExtendSiteHandler)
 
 		group.POST("/site/:domain/app", routes.DeploySiteHandler)
 		group.PUT("/site/:domain/app", routes.DeploySiteHandler) // Alias
+		group.POST("/site/:domain/app/promote", routes.PromoteSiteAppHandler)
+		group.POST("/site/:domain/app/abort", routes.AbortSiteAppHandler)
+		group.POST("/site/:domain/app/rollback", routes.RollbackSiteAppHandler)
+
+		group.POST("/site/:domain/canary", routes.CanarySetHandler)
+		group.PUT("/site/:domain/canary", routes.CanarySetHandler) // Alias
+		group.POST("/site/:domain/canary/promote", routes.CanaryPromoteHandler)
+		group.DELETE("/site/:domain/canary", routes.CanaryAbortHandler)
 
 		group.GET("/clusterstatus", routes.ClusterStatusHandler)
 
@@ -203,13 +212,50 @@ func (s *APIServer) setupRoutes() {
 
 		group.GET("/app", routes.AppListHandler)
 		group.POST("/app", routes.AppUploadHandler)
-		group.POST("/app/:name", routes.AppUpdateHandler)
+		group.POST("/app/:name", routes.AppUpdateHandler) // Also handles POST /app/import
+		group.GET("/app/import/:id", routes.AppImportStatusHandler)
 		group.DELETE("/app/:name", routes.AppDeleteHandler)
 
+		group.GET("/registry", routes.RegistryListHandler)
+		group.GET("/registry/:app", routes.RegistryShowHandler)
+		group.DELETE("/registry/:app", routes.RegistryDeleteHandler)
+		group.POST("/registry/:app/version", routes.RegistryAddVersionHandler)
+		group.POST("/registry/:app/tag/:tag", routes.RegistryTagHandler)
+		group.PUT("/registry/:app/tag/:tag", routes.RegistryTagHandler) // Alias
+		group.DELETE("/registry/:app/tag/:tag", routes.RegistryUntagHandler)
+
+		group.POST("/upload", routes.UploadCreateHandler)
+		group.GET("/upload/:id", routes.UploadShowHandler)
+		group.PUT("/upload/:id", routes.UploadChunkHandler)
+		group.POST("/upload/:id/finalize", routes.UploadFinalizeHandler)
+		group.DELETE("/upload/:id", routes.UploadDeleteHandler)
+
+		group.POST("/delta", routes.DeltaCreateHandler)
+		group.GET("/delta/:id", routes.DeltaShowHandler)
+		group.PUT("/delta/:id/blob/:hash", routes.DeltaBlobHandler)
+		group.POST("/delta/:id/finalize", routes.DeltaFinalizeHandler)
+		group.DELETE("/delta/:id", routes.DeltaDeleteHandler)
+
 		group.POST("/certificate", routes.ImportCertificateHandler)
 		group.GET("/certificate", routes.ListCertificateHandler)
 		group.DELETE("/certificate/:name", routes.DeleteCertificateHandler)
 
+		group.POST("/clientca", routes.ImportClientCAHandler)
+		group.GET("/clientca", routes.ListClientCAHandler)
+		group.DELETE("/clientca/:name", routes.DeleteClientCAHandler)
+
+		group.GET("/codesign/key", routes.CodeSignKeyListHandler)
+		group.POST("/codesign/key", routes.CodeSignKeyAddHandler)
+		group.PUT("/codesign/key/:id", routes.CodeSignKeyUpdateHandler)
+		group.DELETE("/codesign/key/:id", routes.CodeSignKeyDeleteHandler)
+		group.POST("/codesign/key/:id/revoke", routes.CodeSignKeyRevokeHandler)
+		group.GET("/codesign/revoked", routes.CodeSignKeyRevokedHandler)
+
+		group.GET("/defaultsite", routes.DefaultSiteGetHandler)
+		group.POST("/defaultsite", routes.DefaultSiteSetHandler)
+		group.PUT("/defaultsite", routes.DefaultSiteSetHandler) // Alias
+		group.DELETE("/defaultsite", routes.DefaultSiteResetHandler)
+
 		group.GET("/dhparams", routes.DHParamsGetHandler)
 		group.POST("/dhparams", routes.DHParamsSetHandler)
 
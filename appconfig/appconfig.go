@@ -19,6 +19,7 @@ package appconfig
 import (
 	"log"
 	"os"
+	"time"
 
 	"github.com/spf13/viper"
 
@@ -101,26 +102,40 @@ func (c *appConfig) setDefaults() {
 	// Other default values
 	viper.SetDefault("acme.endpoint", "https://acme-v02.api.letsencrypt.org/directory")
 	viper.SetDefault("appRoot", "/var/statiko/")
+	viper.SetDefault("cache.keepPerSite", 3)
+	viper.SetDefault("cache.maxSize", 10240)
 	viper.SetDefault("codesign.required", false)
 	viper.SetDefault("disallowLeadership", false)
+	viper.SetDefault("extract.maxDepth", 32)
+	viper.SetDefault("extract.maxFiles", 100000)
+	viper.SetDefault("extract.maxSize", 4096)
+	viper.SetDefault("import.allowPrivateAddresses", false)
+	viper.SetDefault("import.maxSize", 2048)
 	viper.SetDefault("manifestFile", "_statiko.yaml")
 	viper.SetDefault("nginx.commands.restart", "systemctl is-active --quiet nginx && systemctl reload nginx || systemctl restart nginx")
 	viper.SetDefault("nginx.commands.start", "systemctl start nginx")
 	viper.SetDefault("nginx.commands.status", "systemctl is-active --quiet nginx && echo 1 || echo 0")
 	viper.SetDefault("nginx.commands.test", "nginx -t -q")
 	viper.SetDefault("nginx.configPath", "/etc/nginx/")
+	viper.SetDefault("nginx.statusPort", "2266")
+	viper.SetDefault("nginx.proxyTrustedCertificate", "/etc/ssl/certs/ca-certificates.crt")
 	viper.SetDefault("nginx.user", "www-data")
 	viper.SetDefault("repo.s3.endpoint", "s3.amazonaws.com")
 	viper.SetDefault("state.etcd.keyPrefix", "/statiko")
 	viper.SetDefault("state.file.path", "/etc/statiko/state.json")
 	viper.SetDefault("state.etcd.timeout", 10000)
 	viper.SetDefault("state.store", "file")
+	viper.SetDefault("temporarySites.notifyBefore", "1h")
+	viper.SetDefault("temporarySites.ttl", "24h")
+	viper.SetDefault("tls.clientVerifyDepth", 3)
 	viper.SetDefault("tls.dhparams.maxAge", 120)
 	viper.SetDefault("tls.dhparams.bits", 4096)
 	viper.SetDefault("tls.node.acme", false)
 	viper.SetDefault("tls.node.certificate", "/etc/statiko/node-public.crt")
 	viper.SetDefault("tls.node.enabled", true)
 	viper.SetDefault("tls.node.key", "/etc/statiko/node-private.key")
+	viper.SetDefault("uploads.maxSize", 2048)
+	viper.SetDefault("uploads.sessionTTL", "24h")
 	viper.SetDefault("notifications.webhook.payloadKey", "value1")
 }
 
@@ -141,16 +156,26 @@ func (c *appConfig) bindEnvVars() {
 	viper.BindEnv("azure.clientId", "AZURE_CLIENT_ID")
 	viper.BindEnv("azure.clientSecret", "AZURE_CLIENT_SECRET")
 	viper.BindEnv("azure.tenantId", "AZURE_TENANT_ID")
+	viper.BindEnv("cache.keepPerSite", "CACHE_KEEP_PER_SITE")
+	viper.BindEnv("cache.maxSize", "CACHE_MAX_SIZE")
 	viper.BindEnv("certs.azureKeyVault.name", "CERTS_AZURE_KEYVAULT_NAME")
 	viper.BindEnv("codesign.publicKey", "CODESIGN_PUBLIC_KEY")
 	viper.BindEnv("codesign.required", "CODESIGN_REQUIRED")
 	viper.BindEnv("disallowLeadership", "DISALLOW_LEADERSHIP")
+	viper.BindEnv("extract.maxDepth", "EXTRACT_MAX_DEPTH")
+	viper.BindEnv("extract.maxFiles", "EXTRACT_MAX_FILES")
+	viper.BindEnv("extract.maxSize", "EXTRACT_MAX_SIZE")
+	viper.BindEnv("import.allowPrivateAddresses", "IMPORT_ALLOW_PRIVATE_ADDRESSES")
+	viper.BindEnv("import.maxSize", "IMPORT_MAX_SIZE")
 	viper.BindEnv("manifestFile", "MANIFEST_FILE")
 	viper.BindEnv("nginx.commands.restart", "NGINX_RESTART")
 	viper.BindEnv("nginx.commands.start", "NGINX_START")
 	viper.BindEnv("nginx.commands.status", "NGINX_STATUS")
 	viper.BindEnv("nginx.commands.test", "NGINX_TEST")
 	viper.BindEnv("nginx.configPath", "NGINX_CONFIG_PATH")
+	viper.BindEnv("nginx.proxyTrustedCertificate", "NGINX_PROXY_TRUSTED_CERTIFICATE")
+	viper.BindEnv("nginx.statusPort", "NGINX_STATUS_PORT")
+	viper.BindEnv("nginx.templatesPath", "NGINX_TEMPLATES_PATH")
 	viper.BindEnv("nginx.user", "NGINX_USER")
 	viper.BindEnv("nodeName", "NODE_NAME")
 	viper.BindEnv("notifications.method", "NOTIFICATIONS_METHOD")
@@ -178,6 +203,9 @@ func (c *appConfig) bindEnvVars() {
 	viper.BindEnv("state.file.path", "STATE_FILE_PATH")
 	viper.BindEnv("state.store", "STATE_STORE")
 	viper.BindEnv("temporarySites.domain", "TEMPORARY_SITES_DOMAIN")
+	viper.BindEnv("temporarySites.notifyBefore", "TEMPORARY_SITES_NOTIFY_BEFORE")
+	viper.BindEnv("temporarySites.ttl", "TEMPORARY_SITES_TTL")
+	viper.BindEnv("tls.clientVerifyDepth", "TLS_CLIENT_VERIFY_DEPTH")
 	viper.BindEnv("tls.dhparams.bits", "TLS_DHPARAMS_BITS")
 	viper.BindEnv("tls.dhparams.maxAge", "TLS_DHPARAMS_MAX_AGE")
 	viper.BindEnv("tls.node.acme", "TLS_NODE_ACME")
@@ -185,6 +213,8 @@ func (c *appConfig) bindEnvVars() {
 	viper.BindEnv("tls.node.certificate", "TLS_NODE_CERTIFICATE")
 	viper.BindEnv("tls.node.enabled", "TLS_NODE_ENABLED")
 	viper.BindEnv("tls.node.key", "TLS_NODE_KEY")
+	viper.BindEnv("uploads.maxSize", "UPLOADS_MAX_SIZE")
+	viper.BindEnv("uploads.sessionTTL", "UPLOADS_SESSION_TTL")
 }
 
 // Get returns the value as interface{}
@@ -212,6 +242,16 @@ func (c *appConfig) GetInt(key string) int {
 	return viper.GetInt(key)
 }
 
+// GetStringMapString returns the value as map of strings
+func (c *appConfig) GetStringMapString(key string) map[string]string {
+	return viper.GetStringMapString(key)
+}
+
+// GetDuration returns the value as time.Duration
+func (c *appConfig) GetDuration(key string) time.Duration {
+	return viper.GetDuration(key)
+}
+
 // Set a new value in the configuration
 // Note that the value is only stored in memory and not written to disk
 func (c *appConfig) Set(key string, value interface{}) {
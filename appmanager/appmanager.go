@@ -17,13 +17,12 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package appmanager
 
 import (
+	"archive/tar"
 	"bytes"
-	"crypto"
-	"crypto/rsa"
+	"compress/gzip"
 	"crypto/sha256"
-	"crypto/x509"
 	"encoding/base64"
-	"encoding/pem"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
@@ -51,7 +50,7 @@ type Manager struct {
 	appRoot string
 
 	// Internals
-	codeSignKey *rsa.PublicKey
+	codeSignKey *utils.CodeSignKey
 	log         *log.Logger
 	box         *packr.Box
 }
@@ -79,7 +78,7 @@ func (m *Manager) Init() error {
 }
 
 // SyncState ensures that the state of the filesystem matches the desired one
-func (m *Manager) SyncState(sites []state.SiteState) (updated bool, restartServer bool, err error) {
+func (m *Manager) SyncState(sites []state.SiteState, defaultSite *state.NodeDefaultSite) (updated bool, restartServer bool, err error) {
 	updated = false
 
 	// To start, ensure the basic folders exist
@@ -103,18 +102,24 @@ func (m *Manager) SyncState(sites []state.SiteState) (updated bool, restartServe
 	updated = updated || u
 
 	// Apps: ensure we have the right ones
-	err = m.SyncApps(sites)
+	err = m.SyncApps(sites, defaultSite)
 	if err != nil {
 		return
 	}
 
 	// Sync site folders too
-	u, err = m.SyncSiteFolders(sites)
+	u, err = m.SyncSiteFolders(sites, defaultSite)
 	if err != nil {
 		return
 	}
 	updated = updated || u
 
+	// Remove the least recently used bundles from the cache if it's over the budget
+	// Errors are not fatal here
+	if cacheErr := m.CleanCache(sites, defaultSite); cacheErr != nil {
+		m.log.Println("Error ignored while cleaning the cache:", cacheErr)
+	}
+
 	return
 }
 
@@ -137,7 +142,7 @@ func ensureFolderWithUpdated(path string) (updated bool, err error) {
 }
 
 // SyncSiteFolders ensures that we have the correct folders in the site directory, and TLS certificates are present
-func (m *Manager) SyncSiteFolders(sites []state.SiteState) (bool, error) {
+func (m *Manager) SyncSiteFolders(sites []state.SiteState, defaultSite *state.NodeDefaultSite) (bool, error) {
 	updated := false
 
 	var u bool
@@ -151,9 +156,23 @@ func (m *Manager) SyncSiteFolders(sites []state.SiteState) (bool, error) {
 	}
 	updated = updated || u
 
+	// TLS certificate for the default site, if it has its own
+	// /approot/sites/_default/tls
+	u, err = m.syncDefaultSiteCertificate(defaultSite)
+	if err != nil {
+		m.log.Println("Error while getting TLS certificate for the default site:", err)
+		state.Instance.SetSiteHealth("_default", err)
+	}
+	updated = updated || u
+
 	// Activate the default site
 	// /approot/sites/_default/www
-	if err := m.ActivateApp("_default", "_default"); err != nil {
+	// If the default site has an error, fall back to the built-in app
+	bundle := "_default"
+	if defaultSite != nil && defaultSite.App != nil && state.Instance.GetSiteHealth("_default") == nil {
+		bundle = defaultSite.App.Name
+	}
+	if err := m.ActivateApp(bundle, "_default"); err != nil {
 		return false, err
 	}
 
@@ -200,10 +219,31 @@ func (m *Manager) SyncSiteFolders(sites []state.SiteState) (bool, error) {
 		u, err = m.writeFileIfChanged(pathCert, certPEM)
 		updated = updated || u
 
+		// CA certificates used to authenticate clients, if any
+		pathClientCA := pathTLS + "/client-ca.pem"
+		if s.TLS != nil && s.TLS.ClientCA != nil && *s.TLS.ClientCA != "" {
+			caPEM, err := state.Instance.GetClientCA(*s.TLS.ClientCA)
+			if err == nil && len(caPEM) == 0 {
+				err = errors.New("client CA not found: " + *s.TLS.ClientCA)
+			}
+			if err != nil {
+				m.log.Println("Error while getting client CA for site:", s.Domain, err)
+				state.Instance.SetSiteHealth(s.Domain, err)
+				continue
+			}
+			u, err = m.writeFileIfChanged(pathClientCA, caPEM)
+			updated = updated || u
+		} else if _, err := os.Stat(pathClientCA); err == nil {
+			if err := os.Remove(pathClientCA); err != nil {
+				m.log.Println("Error ignored while removing client CA for site:", s.Domain, err)
+			}
+			updated = true
+		}
+
 		// Deploy the app; do this every time, regardless, since it doesn't disrupt the running server
 		// /approot/sites/{site}/www
 		// www is always a symbolic link, and if there's no app deployed, it goes to the default one
-		bundle := "_default"
+		bundle = "_default"
 		if s.App != nil {
 			bundle = s.App.Name
 		}
@@ -213,6 +253,18 @@ func (m *Manager) SyncSiteFolders(sites []state.SiteState) (bool, error) {
 			continue
 		}
 
+		// If there's a canary app, it's deployed in a separate webroot
+		// /approot/sites/{site}/www-canary
+		canary := ""
+		if s.Canary != nil && s.Canary.App != nil {
+			canary = s.Canary.App.Name
+		}
+		if err := m.ActivateCanaryApp(canary, s.Domain); err != nil {
+			m.log.Println("Error while activating canary app for site:", s.Domain, err)
+			state.Instance.SetSiteHealth(s.Domain, err)
+			continue
+		}
+
 		expectFolders = append(expectFolders, s.Domain)
 	}
 
@@ -249,11 +301,48 @@ func (m *Manager) SyncSiteFolders(sites []state.SiteState) (bool, error) {
 	return updated, nil
 }
 
+// Writes the TLS certificate for the default site, or removes it if the default site uses the node's certificate
+func (m *Manager) syncDefaultSiteCertificate(defaultSite *state.NodeDefaultSite) (bool, error) {
+	pathTLS := m.appRoot + "sites/_default/tls"
+	if defaultSite == nil || defaultSite.TLS == nil {
+		exists, err := utils.FolderExists(pathTLS)
+		if err != nil || !exists {
+			return false, err
+		}
+		return true, os.RemoveAll(pathTLS)
+	}
+
+	updated, err := ensureFolderWithUpdated(pathTLS)
+	if err != nil {
+		return false, err
+	}
+	keyPEM, certPEM, err := certificates.GetCertificate(&state.SiteState{
+		Domain: "_default",
+		TLS:    defaultSite.TLS,
+	})
+	if err != nil {
+		return false, err
+	}
+	u, err := m.writeFileIfChanged(pathTLS+"/key.pem", keyPEM)
+	if err != nil {
+		return false, err
+	}
+	updated = updated || u
+	u, err = m.writeFileIfChanged(pathTLS+"/certificate.pem", certPEM)
+	if err != nil {
+		return false, err
+	}
+	updated = updated || u
+	return updated, nil
+}
+
 // SyncApps ensures that we have the correct apps
-func (m *Manager) SyncApps(sites []state.SiteState) error {
+func (m *Manager) SyncApps(sites []state.SiteState, defaultSite *state.NodeDefaultSite) error {
 	// Channels used by the worker pool to fetch apps in parallel
-	jobs := make(chan state.SiteState, 4)
-	res := make(chan int, len(sites))
+	// The results channel must be able to hold a result for every job, or workers block while the jobs channel is full
+	// Each site can request up to two apps: the main one and the canary; the default site can request one more
+	jobs := make(chan stageAppJob, 4)
+	res := make(chan stageAppResult, 2*len(sites)+1)
 
 	// Spin up 3 backround workers
 	for w := 1; w <= 3; w++ {
@@ -262,14 +351,12 @@ func (m *Manager) SyncApps(sites []state.SiteState) error {
 
 	// Iterate through the sites looking for apps
 	requested := 0
-	appIndexes := make(map[string]int)
+	// Objects of all the sites where each app is deployed, to set the manifest
+	appObjects := make(map[string][]*state.SiteApp)
 	expectApps := make([]string, 1)
 	expectApps[0] = "_default"
 	fetchAppsList := make(map[string]int)
-	for i, s := range sites {
-		// Reset the error
-		state.Instance.SetSiteHealth(s.Domain, nil)
-
+	requestApp := func(domain string, app *state.SiteApp) error {
 		// Check if the jobs channel is full
 		for len(jobs) == cap(jobs) {
 			// Pause this thread until the channel is not at capacity anymore
@@ -277,47 +364,121 @@ func (m *Manager) SyncApps(sites []state.SiteState) error {
 			time.Sleep(time.Second)
 		}
 
-		// If there's no app, skip this
-		if s.App == nil {
-			continue
-		}
-
 		// Check if we have the app deployed
-		exists, err := utils.PathExists(m.appRoot + "apps/" + s.App.Name)
+		exists, err := utils.PathExists(m.appRoot + "apps/" + app.Name)
 		if err != nil {
 			return err
 		}
 		if !exists {
-			m.log.Println("Need to fetch", s.App.Name)
+			m.log.Println("Need to fetch", app.Name)
 
 			// Do not fetch this app if it's already being fetched
-			if _, ok := fetchAppsList[s.App.Name]; ok {
-				m.log.Println("App", s.App.Name, "is already being fetched")
+			if _, ok := fetchAppsList[app.Name]; ok {
+				m.log.Println("App", app.Name, "is already being fetched")
 			} else {
 				// We need to deploy the app
 				// Use the worker pool to handle concurrency
-				fetchAppsList[s.App.Name] = 1
-				jobs <- s
+				fetchAppsList[app.Name] = 1
+				jobs <- stageAppJob{
+					domain: domain,
+					app:    app.Name,
+				}
 				requested++
 			}
 		}
 
-		// Add app to expected list and the index to the dictionary
-		expectApps = append(expectApps, s.App.Name)
-		appIndexes[s.App.Name] = i
+		// Add app to expected list and the object to the dictionary
+		expectApps = append(expectApps, app.Name)
+		appObjects[app.Name] = append(appObjects[app.Name], app)
+		return nil
+	}
+	for i := range sites {
+		s := &sites[i]
+
+		// Reset the error
+		state.Instance.SetSiteHealth(s.Domain, nil)
+
+		// Resolve the tags of apps in the registry to the bundles they point to
+		if err := resolveSiteApps(s); err != nil {
+			m.log.Println("Error while resolving apps for site:", s.Domain, err)
+			state.Instance.SetSiteHealth(s.Domain, err)
+			continue
+		}
+
+		for _, app := range siteApps(s) {
+			if err := requestApp(s.Domain, app); err != nil {
+				return err
+			}
+		}
+	}
+
+	// App for the default site, if any
+	state.Instance.SetSiteHealth("_default", nil)
+	if defaultSite != nil && defaultSite.App != nil {
+		resolved, err := resolveApp(defaultSite.App)
+		if err != nil {
+			m.log.Println("Error while resolving app for the default site:", err)
+			state.Instance.SetSiteHealth("_default", err)
+		} else {
+			defaultSite.App = resolved
+			if err := requestApp("_default", defaultSite.App); err != nil {
+				return err
+			}
+		}
 	}
 
 	// No more jobs; close the channel
 	close(jobs)
 
 	// Iterate through all the responses
+	stageErrors := make(map[string]error)
 	for i := 0; i < requested; i++ {
-		<-res
+		r := <-res
+		if r.err != nil {
+			stageErrors[r.app] = r.err
+		}
 	}
 	close(res)
 
+	// Store errors for the sites whose apps failed to stage
+	// Also check that the apps are signed with keys that are trusted and allowed by the sites
+	// If the app of a canary release has an error, only the canary is disabled, and the site keeps serving its main app
+	for i := range sites {
+		s := &sites[i]
+		if state.Instance.GetSiteHealth(s.Domain) != nil {
+			continue
+		}
+		for _, app := range siteApps(s) {
+			err, ok := stageErrors[app.Name]
+			if !ok {
+				err = m.checkSigningPolicy(app.Name, s.AllowedKeys)
+				if err != nil {
+					m.log.Println("Signing policy check failed for site:", s.Domain, err)
+				}
+			}
+			if err == nil {
+				continue
+			}
+			if s.Canary != nil && app == s.Canary.App {
+				m.log.Println("Disabling canary release for site because of an error with its app:", s.Domain, err)
+				s.Canary = nil
+				continue
+			}
+			state.Instance.SetSiteHealth(s.Domain, err)
+			break
+		}
+	}
+	if defaultSite != nil && defaultSite.App != nil && state.Instance.GetSiteHealth("_default") == nil {
+		if err, ok := stageErrors[defaultSite.App.Name]; ok {
+			state.Instance.SetSiteHealth("_default", err)
+		} else if err := m.checkSigningPolicy(defaultSite.App.Name, nil); err != nil {
+			m.log.Println("Signing policy check failed for the default site:", err)
+			state.Instance.SetSiteHealth("_default", err)
+		}
+	}
+
 	// Look for extraneous folders in the /approot/apps directory
-	// Note that we are not deleting the apps' bundles from the cache, however - just the staged folder
+	// Note that we are not deleting the apps' bundles from the cache here - just the staged folder; bundles are removed by CleanCache
 	// We are also scanning for manifest files here
 	files, err := ioutil.ReadDir(m.appRoot + "apps/")
 	if err != nil {
@@ -338,26 +499,20 @@ func (m *Manager) SyncApps(sites []state.SiteState) error {
 			}
 
 			// Check if there's a manifest file
-			manifestFile := m.appRoot + "apps/" + name + "/" + appconfig.Config.GetString("manifestFile")
-			exists, err := utils.FileExists(manifestFile)
+			manifest, err := m.StagedManifest(name)
 			if err != nil {
 				return err
 			}
-			if exists {
-				readBytes, err := ioutil.ReadFile(manifestFile)
-				if err != nil {
-					return err
-				}
-				// Get the index of the item in the slice to update
-				i, ok := appIndexes[name]
+			if manifest != nil {
+				// Get the objects of the sites to update
+				objs, ok := appObjects[name]
 				if !ok {
-					return errors.New("Cannot find index for app " + name)
+					return errors.New("Cannot find sites for app " + name)
 				}
-				manifest := &utils.AppManifest{}
-				err = yaml.Unmarshal(readBytes, manifest)
-				sites[i].App.Manifest = manifest
-				if err != nil {
-					return err
+				// Each site gets its own copy, as the manifest is modified when generating the configuration
+				for _, obj := range objs {
+					siteManifest := *manifest
+					obj.Manifest = &siteManifest
 				}
 			}
 		} else {
@@ -370,9 +525,93 @@ func (m *Manager) SyncApps(sites []state.SiteState) error {
 		}
 	}
 
+	// Apps with rules that require client certificates can only be served by sites that have a client CA
+	// Otherwise, every request matching those rules would be rejected
+	for i := range sites {
+		s := &sites[i]
+		if state.Instance.GetSiteHealth(s.Domain) != nil {
+			continue
+		}
+		if s.TLS != nil && s.TLS.ClientCA != nil && *s.TLS.ClientCA != "" {
+			continue
+		}
+		for _, app := range siteApps(s) {
+			if app.Manifest == nil || !app.Manifest.RequiresClientCert() {
+				continue
+			}
+			err := errors.New("app " + app.Name + " requires client certificates, but the site doesn't have a client CA")
+			if s.Canary != nil && app == s.Canary.App {
+				m.log.Println("Disabling canary release for site because of an error with its app:", s.Domain, err)
+				s.Canary = nil
+				continue
+			}
+			m.log.Println("Client certificate check failed for site:", s.Domain, err)
+			state.Instance.SetSiteHealth(s.Domain, err)
+			break
+		}
+	}
+
+	// Remove objects that aren't used by any app anymore
+	if err := m.pruneObjects(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Returns the apps for a site: the main one and the canary, if any
+func siteApps(s *state.SiteState) []*state.SiteApp {
+	apps := make([]*state.SiteApp, 0, 2)
+	if s.App != nil {
+		apps = append(apps, s.App)
+	}
+	if s.Canary != nil && s.Canary.App != nil {
+		apps = append(apps, s.Canary.App)
+	}
+	return apps
+}
+
+// Replaces the apps of a site that reference a tag in the registry with the bundle the tag points to
+// Objects are replaced with copies, as they are shared with the state
+func resolveSiteApps(s *state.SiteState) (err error) {
+	if s.App, err = resolveApp(s.App); err != nil {
+		return err
+	}
+	if s.PendingApp, err = resolveApp(s.PendingApp); err != nil {
+		return err
+	}
+	// The previous app is only used for rollbacks, so it's fine if its tag doesn't exist anymore
+	if previous, err := resolveApp(s.PreviousApp); err == nil {
+		s.PreviousApp = previous
+	}
+	if s.Canary != nil && s.Canary.App != nil {
+		canary := *s.Canary
+		if canary.App, err = resolveApp(canary.App); err != nil {
+			return err
+		}
+		s.Canary = &canary
+	}
 	return nil
 }
 
+// Returns a copy of the app object with the bundle a tag points to, if the app references a tag in the registry
+func resolveApp(app *state.SiteApp) (*state.SiteApp, error) {
+	if app == nil {
+		return nil, nil
+	}
+	name, tag, ok := app.Tag()
+	if !ok {
+		return app, nil
+	}
+	bundle, err := state.Instance.ResolveAppTag(name, tag)
+	if err != nil {
+		return nil, err
+	}
+	return &state.SiteApp{
+		Name: bundle,
+	}, nil
+}
+
 // InitAppRoot creates a new, empty app root folder
 func (m *Manager) InitAppRoot() error {
 	// Ensure the app root folder exists
@@ -390,6 +629,11 @@ func (m *Manager) InitAppRoot() error {
 		return err
 	}
 
+	// Create /approot/objects
+	if err := utils.EnsureFolder(m.appRoot + "objects"); err != nil {
+		return err
+	}
+
 	// Create /approot/sites
 	if err := utils.EnsureFolder(m.appRoot + "sites"); err != nil {
 		return err
@@ -558,6 +802,24 @@ func (m *Manager) writeFileIfChanged(filename string, val []byte) (bool, error)
 	return true, nil
 }
 
+// StagedManifest returns the manifest of a staged app, or nil if the app isn't staged or doesn't have a manifest
+func (m *Manager) StagedManifest(bundle string) (*utils.AppManifest, error) {
+	manifestFile := m.appRoot + "apps/" + bundle + "/" + appconfig.Config.GetString("manifestFile")
+	exists, err := utils.FileExists(manifestFile)
+	if err != nil || !exists {
+		return nil, err
+	}
+	readBytes, err := ioutil.ReadFile(manifestFile)
+	if err != nil {
+		return nil, err
+	}
+	manifest := &utils.AppManifest{}
+	if err := yaml.Unmarshal(readBytes, manifest); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
 // ActivateApp points a site to an app, by creating the symbolic link
 func (m *Manager) ActivateApp(app string, domain string) error {
 	// Switch the www folder to an app staged
@@ -567,18 +829,29 @@ func (m *Manager) ActivateApp(app string, domain string) error {
 	return nil
 }
 
+// ActivateCanaryApp points the canary webroot of a site to an app, by creating the symbolic link
+// If app is empty, the link is removed
+func (m *Manager) ActivateCanaryApp(app string, domain string) error {
+	path := m.appRoot + "sites/" + domain + "/www-canary"
+	if app == "" {
+		// Use Lstat as the link could be pointing to an app that doesn't exist anymore
+		if _, err := os.Lstat(path); err == nil {
+			return os.Remove(path)
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	return renameio.Symlink(m.appRoot+"apps/"+app, path)
+}
+
 // LoadSigningKey loads the code signing public key
 func (m *Manager) LoadSigningKey() error {
 	pemKey := appconfig.Config.GetString("codesign.publicKey")
 	requireSign := appconfig.Config.GetBool("codesign.required")
 
 	// Variables
-	var (
-		block *pem.Block
-		pub   interface{}
-		err   error
-		ok    bool
-	)
+	var err error
 
 	// Check if we have a key, then parse it
 	if pemKey == "" {
@@ -589,53 +862,42 @@ func (m *Manager) LoadSigningKey() error {
 	if !strings.HasPrefix(pemKey, "-----BEGIN") {
 		exists, err := utils.FileExists(pemKey)
 		if err != nil || !exists {
-			goto nokey
+			goto invalidkey
 		}
 
 		// Read the file
 		read, err := ioutil.ReadFile(pemKey)
 		if err != nil || read == nil || len(read) < 1 {
-			goto nokey
+			goto invalidkey
 		}
 		pemKey = string(read)
 	}
 
-	// Load the PEM key
-	block, _ = pem.Decode([]byte(pemKey))
-	if block == nil || len(block.Bytes) == 0 {
-		goto nokey
+	// Load the PEM key; the algorithm is detected from the key
+	m.codeSignKey, err = utils.ParseCodeSignKey([]byte(pemKey))
+	if err != nil {
+		m.log.Println("[Warn] Invalid code signing key:", err)
+		m.codeSignKey = nil
+		goto invalidkey
 	}
 
-	switch block.Type {
-	case "RSA PUBLIC KEY":
-		// PKCS#1
-		m.codeSignKey, err = x509.ParsePKCS1PublicKey(block.Bytes)
-		if err != nil || m.codeSignKey == nil {
-			m.codeSignKey = nil
-			goto nokey
-		}
-	case "PUBLIC KEY":
-		// PKIX
-		pub, err = x509.ParsePKIXPublicKey(block.Bytes)
-		if err != nil || pub == nil {
-			goto nokey
-		}
-		m.codeSignKey, ok = pub.(*rsa.PublicKey)
-		if !ok {
-			m.codeSignKey = nil
-			goto nokey
-		}
-	default:
-		goto nokey
-	}
+	m.log.Println("Loaded code signing key with algorithm", m.codeSignKey.Algorithm())
+
+	return nil
 
-	m.log.Println("Loaded code signing key")
+invalidkey:
+	// A key that is set but can't be loaded is an error if signatures are required, so signature enforcement isn't silently broken
+	if requireSign {
+		return errors.New("codesign.required is true, but the key in codesign.publicKey is not valid")
+	}
+	m.log.Println("[Warn] No code signing key loaded")
 
 	return nil
 
 nokey:
+	// Keys can also be added to the keyring in the state, so a key in the configuration isn't required
 	if requireSign {
-		return errors.New("codesign.required is true, but no valid key found in codesign.publicKey")
+		m.log.Println("No code signing key loaded from the configuration; only bundles signed with keys in the keyring will be accepted")
 	} else {
 		m.log.Println("[Warn] No code signing key loaded")
 	}
@@ -707,6 +969,8 @@ func (m *Manager) StageApp(bundle string) error {
 	}
 	err = utils.ExtractArchive(stagingPath, f, stat.Size(), fileType)
 	if err != nil {
+		// Remove what was extracted, so the app isn't considered staged
+		os.RemoveAll(stagingPath)
 		return err
 	}
 
@@ -736,27 +1000,52 @@ func (m *Manager) StageApp(bundle string) error {
 		}
 	}
 
+	// Remove the files manifest of bundles from delta deploys, which was verified when fetching the bundle
+	if err := os.Remove(stagingPath + "/" + utils.FilesManifestName); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	// Replace the files with links to the objects store, so files shared with other apps are stored only once
+	if err := m.dedupStagedApp(stagingPath); err != nil {
+		// Remove the staged app so it's extracted again at the next sync
+		os.RemoveAll(stagingPath)
+		return err
+	}
+
 	return nil
 }
 
 // Background worker for the StageApp function
-func (m *Manager) workerStageApp(id int, jobs <-chan state.SiteState, res chan<- int) {
+func (m *Manager) workerStageApp(id int, jobs <-chan stageAppJob, res chan<- stageAppResult) {
 	for j := range jobs {
-		m.log.Println("Worker", id, "started staging app "+j.App.Name)
-		err := m.StageApp(j.App.Name)
-		m.log.Println("Worker", id, "finished staging app "+j.App.Name)
+		m.log.Println("Worker", id, "started staging app "+j.app)
+		err := m.StageApp(j.app)
+		m.log.Println("Worker", id, "finished staging app "+j.app)
 
 		// Handle errors
+		// They're stored as health of all sites using the app, as the app is staged once even if multiple sites use it
 		if err != nil {
-			m.log.Println("Error staging app "+j.App.Name+":", err)
-
-			// Store the error
-			state.Instance.SetSiteHealth(j.Domain, err)
+			m.log.Println("Error staging app "+j.app+" for site "+j.domain+":", err)
+		}
+		res <- stageAppResult{
+			app: j.app,
+			err: err,
 		}
-		res <- 1
 	}
 }
 
+// Job for the workerStageApp function
+type stageAppJob struct {
+	domain string
+	app    string
+}
+
+// Result of the workerStageApp function
+type stageAppResult struct {
+	app string
+	err error
+}
+
 // FetchBundle downloads the application's bundle
 func (m *Manager) FetchBundle(bundle string) error {
 	// Get the archive
@@ -771,7 +1060,10 @@ func (m *Manager) FetchBundle(bundle string) error {
 
 	var hash []byte
 	var signature []byte
+	var signKey *utils.CodeSignKey
+	keyID := ""
 	fileType := ""
+	signedManifest := false
 	if metadata != nil && len(metadata) > 0 {
 		// Get the hash from the blob's metadata, if any
 		hashB64, ok := metadata["hash"]
@@ -786,15 +1078,31 @@ func (m *Manager) FetchBundle(bundle string) error {
 		}
 
 		// Get the signature from the blob's metadata, if any
+		// Bundles signed with a key in the keyring have the key's ID in the metadata; otherwise, the key from the node's configuration is used
+		keyID = metadata["keyId"]
+		if keyID != "" {
+			// The validity window of the key is checked against the time the bundle was stored, if known, so bundles can still be fetched after the key expires
+			signed := time.Now()
+			if t, err := time.Parse(time.RFC3339, metadata["signedTime"]); err == nil {
+				signed = t
+			}
+			signKey, err = m.keyringKey(keyID, signed)
+			if err != nil {
+				return err
+			}
+		} else {
+			signKey = m.codeSignKey
+		}
+
 		// Skip if we don't have a codesign key
-		if m.codeSignKey != nil {
+		if signKey != nil {
 			signatureB64, ok := metadata["signature"]
 			if ok && signatureB64 != "" {
 				signature, err = base64.StdEncoding.DecodeString(signatureB64)
 				if err != nil {
 					return err
 				}
-				if len(signature) != 512 {
+				if len(signature) == 0 {
 					signature = nil
 				}
 			}
@@ -805,6 +1113,9 @@ func (m *Manager) FetchBundle(bundle string) error {
 		if ok && typ != "" {
 			fileType = typ
 		}
+
+		// Bundles from delta deploys are signed with their files manifest
+		signedManifest = metadata["signed"] == utils.SignedFilesManifest
 	}
 	if signature == nil && appconfig.Config.GetBool("codesign.required") {
 		return errors.New("Bundle does not have a signature, but unsigned apps are not allowed by this node's configuration")
@@ -854,7 +1165,11 @@ func (m *Manager) FetchBundle(bundle string) error {
 		}
 	}
 	if signature != nil {
-		err = rsa.VerifyPKCS1v15(m.codeSignKey, crypto.SHA256, hashed, signature)
+		if signedManifest {
+			err = verifyFilesManifest(m.appRoot+"cache/"+bundle, signKey, signature)
+		} else {
+			err = signKey.Verify(hashed, signature)
+		}
 		if err != nil {
 			// File needs to be deleted if signature is invalid
 			deleteFile = true
@@ -863,6 +1178,22 @@ func (m *Manager) FetchBundle(bundle string) error {
 		}
 	}
 
+	// Write the ID of the key that signed the bundle, if it's in the keyring, so the sites' policies can be checked
+	keyIDPath := m.appRoot + "cache/.keyid." + bundle
+	if signature != nil && keyID != "" {
+		err = ioutil.WriteFile(keyIDPath, []byte(keyID), 0644)
+	} else {
+		err = os.Remove(keyIDPath)
+		if os.IsNotExist(err) {
+			err = nil
+		}
+	}
+	if err != nil {
+		// File needs to be deleted if we had an error
+		deleteFile = true
+		return err
+	}
+
 	// Write the file type to disk
 	if fileType != "" {
 		err = ioutil.WriteFile(m.appRoot+"cache/.type."+bundle, []byte(fileType), 0644)
@@ -876,6 +1207,123 @@ func (m *Manager) FetchBundle(bundle string) error {
 	return nil
 }
 
+// Verifies the signature of the files manifest in a bundle from a delta deploy, and that the bundle contains exactly the files in the manifest
+func verifyFilesManifest(path string, key *utils.CodeSignKey, signature []byte) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	// Read the manifest and hash all files in the archive
+	var manifestData []byte
+	files := make(map[string]string)
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		switch header.Typeflag {
+		case tar.TypeDir:
+			continue
+		case tar.TypeReg, tar.TypeRegA:
+			// Continue below
+		default:
+			return fmt.Errorf("unexpected element in bundle: %s", header.Name)
+		}
+
+		if header.Name == utils.FilesManifestName {
+			manifestData, err = ioutil.ReadAll(tr)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		h := sha256.New()
+		if _, err := io.Copy(h, tr); err != nil {
+			return err
+		}
+		files[header.Name] = hex.EncodeToString(h.Sum(nil))
+	}
+	if manifestData == nil {
+		return errors.New("bundle does not contain a files manifest")
+	}
+
+	// Verify the signature of the manifest
+	manifestHash := sha256.Sum256(manifestData)
+	if err := key.Verify(manifestHash[:], signature); err != nil {
+		return err
+	}
+
+	// Check that the files match the manifest
+	manifest, err := utils.ParseFilesManifest(manifestData)
+	if err != nil {
+		return err
+	}
+	if len(manifest) != len(files) {
+		return errors.New("files in the bundle do not match the manifest")
+	}
+	for _, e := range manifest {
+		if files[e.Path] != e.Hash {
+			return fmt.Errorf("file does not match the manifest: %s", e.Path)
+		}
+	}
+
+	return nil
+}
+
+// Returns a key from the keyring, if it's not revoked and it was valid at the time the bundle was signed
+func (m *Manager) keyringKey(id string, signed time.Time) (*utils.CodeSignKey, error) {
+	key := state.Instance.GetCodeSignKey(id)
+	if key == nil {
+		return nil, errors.New("signing key not found in the keyring: " + id)
+	}
+	if err := key.Usable(signed); err != nil {
+		return nil, fmt.Errorf("signing key %s cannot be used: %v", id, err)
+	}
+	return utils.ParseCodeSignKey([]byte(key.PublicKey))
+}
+
+// Checks that the bundle was signed with a key that is still trusted and, if the site has a list of allowed keys, that the key is one of them
+// The ID of the key that signed the bundle is stored in the cache when the bundle is fetched
+func (m *Manager) checkSigningPolicy(bundle string, allowedKeys []string) error {
+	read, err := ioutil.ReadFile(m.appRoot + "cache/.keyid." + bundle)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	keyID := string(read)
+
+	// Bundles not signed with a key in the keyring are allowed only if the site has no policy
+	if keyID == "" {
+		if len(allowedKeys) > 0 {
+			return errors.New("bundle " + bundle + " is not signed with a key allowed for the site")
+		}
+		return nil
+	}
+
+	// Revocations apply to bundles in the cache too, while the validity window is checked only when bundles are fetched
+	key := state.Instance.GetCodeSignKey(keyID)
+	if key == nil {
+		return errors.New("signing key not found in the keyring: " + keyID)
+	}
+	if key.Revoked != nil {
+		return errors.New("bundle " + bundle + " is signed with key " + keyID + ", which was revoked")
+	}
+	if len(allowedKeys) > 0 && !utils.StringInSlice(allowedKeys, keyID) {
+		return errors.New("bundle " + bundle + " is signed with key " + keyID + ", which is not allowed for the site")
+	}
+	return nil
+}
+
 // Creates a symbolic link dst pointing to src, if it doesn't exist or if it's pointing to the wrong destination
 func createLinkIfNeeded(src string, dst string) (updated bool, err error) {
 	err = nil
@@ -0,0 +1,377 @@
+/*
+Copyright © 2020 Alessandro Segala (@ItalyPaleAle)
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published
+by the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package appmanager
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"testing"
+
+	"github.com/statiko-dev/statiko/appconfig"
+	"github.com/statiko-dev/statiko/state"
+	"github.com/statiko-dev/statiko/utils"
+)
+
+func TestResolveSiteApps(t *testing.T) {
+	// Registry with an app
+	store := state.Instance.GetStore()
+	prev := store.GetState()
+	defer store.SetState(prev)
+	store.SetState(&state.NodeState{
+		Apps: map[string]*state.NodeApp{
+			"myapp": {
+				Versions: []state.NodeAppVersion{
+					{Bundle: "myapp-2"},
+					{Bundle: "myapp-1"},
+				},
+				Tags: map[string]string{
+					"latest": "myapp-2",
+					"stable": "myapp-1",
+				},
+			},
+		},
+	})
+
+	app := func(name string) *state.SiteApp {
+		return &state.SiteApp{Name: name}
+	}
+	appName := func(app *state.SiteApp) string {
+		if app == nil {
+			return ""
+		}
+		return app.Name
+	}
+
+	tests := []struct {
+		name string
+		site state.SiteState
+		// Expected bundles, or an error
+		app      string
+		pending  string
+		previous string
+		canary   string
+		err      bool
+	}{
+		{
+			name: "bundles",
+			site: state.SiteState{App: app("bundle-1"), PendingApp: app("bundle-2")},
+			app:  "bundle-1", pending: "bundle-2",
+		},
+		{
+			name: "tags",
+			site: state.SiteState{
+				App:        app("myapp:stable"),
+				PendingApp: app("myapp:latest"),
+				Canary:     &state.SiteCanary{App: app("myapp:latest"), Percentage: 10},
+			},
+			app: "myapp-1", pending: "myapp-2", canary: "myapp-2",
+		},
+		{
+			name: "previous app with a missing tag",
+			site: state.SiteState{App: app("myapp:latest"), PreviousApp: app("myapp:removed")},
+			app:  "myapp-2", previous: "myapp:removed",
+		},
+		{
+			name: "previous app with a tag",
+			site: state.SiteState{App: app("myapp:latest"), PreviousApp: app("myapp:stable")},
+			app:  "myapp-2", previous: "myapp-1",
+		},
+		{
+			name: "missing tag",
+			site: state.SiteState{App: app("myapp:removed")},
+			err:  true,
+		},
+		{
+			name: "missing app",
+			site: state.SiteState{App: app("otherapp:latest")},
+			err:  true,
+		},
+		{
+			name: "canary with a missing tag",
+			site: state.SiteState{App: app("myapp:latest"), Canary: &state.SiteCanary{App: app("myapp:removed"), Percentage: 10}},
+			err:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			site := tt.site
+			var canary *state.SiteApp
+			if site.Canary != nil {
+				canary = site.Canary.App
+			}
+			original := appName(site.App)
+
+			err := resolveSiteApps(&site)
+			if tt.err {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if appName(site.App) != tt.app || appName(site.PendingApp) != tt.pending || appName(site.PreviousApp) != tt.previous {
+				t.Errorf("resolved to (%q, %q, %q), expected (%q, %q, %q)", appName(site.App), appName(site.PendingApp), appName(site.PreviousApp), tt.app, tt.pending, tt.previous)
+			}
+			if site.Canary != nil && appName(site.Canary.App) != tt.canary {
+				t.Errorf("canary resolved to %q, expected %q", appName(site.Canary.App), tt.canary)
+			}
+
+			// The objects shared with the state must not be modified
+			if appName(tt.site.App) != original {
+				t.Errorf("app object was modified: %q", appName(tt.site.App))
+			}
+			if canary != nil && tt.site.Canary.App != canary {
+				t.Error("canary object was modified")
+			}
+		})
+	}
+}
+
+func TestVerifyFilesManifest(t *testing.T) {
+	// Signing keys
+	newKey := func() (*utils.CodeSignKey, ed25519.PrivateKey) {
+		pub, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		der, err := x509.MarshalPKIXPublicKey(pub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, err := utils.ParseCodeSignKey(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return key, priv
+	}
+	key, priv := newKey()
+	_, otherPriv := newKey()
+
+	dir, err := ioutil.TempDir("", "statiko-manifest-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Files in the manifest
+	files := map[string]string{
+		"index.html":    "hello world",
+		"css/style.css": "body {}",
+	}
+	manifestFor := func(files map[string]string) []byte {
+		fm := utils.FilesManifest{}
+		for name, content := range files {
+			h := sha256.Sum256([]byte(content))
+			fm = append(fm, utils.FilesManifestEntry{Path: name, Hash: hex.EncodeToString(h[:])})
+		}
+		return fm.Canonical()
+	}
+	manifest := manifestFor(files)
+
+	tests := []struct {
+		name string
+		// Files in the bundle and manifest, if not the default ones
+		files    map[string]string
+		manifest []byte
+		// Key that signs the manifest, if not the default one
+		signer ed25519.PrivateKey
+		ok     bool
+	}{
+		{
+			name: "valid bundle",
+			ok:   true,
+		},
+		{
+			name:  "extra file",
+			files: map[string]string{"index.html": "hello world", "css/style.css": "body {}", "evil.html": "evil"},
+		},
+		{
+			name:  "missing file",
+			files: map[string]string{"index.html": "hello world"},
+		},
+		{
+			name:  "modified file",
+			files: map[string]string{"index.html": "hello world!", "css/style.css": "body {}"},
+		},
+		{
+			name:   "bad signature",
+			signer: otherPriv,
+		},
+		{
+			name:     "manifest modified after signing",
+			manifest: manifestFor(map[string]string{"index.html": "evil", "css/style.css": "body {}"}),
+		},
+		{
+			name:     "no manifest",
+			manifest: []byte{},
+		},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bundleFiles := tt.files
+			if bundleFiles == nil {
+				bundleFiles = files
+			}
+			bundleManifest := tt.manifest
+			if bundleManifest == nil {
+				bundleManifest = manifest
+			}
+			signer := tt.signer
+			if signer == nil {
+				signer = priv
+			}
+
+			// The signature is always for the original manifest
+			digest := sha256.Sum256(manifest)
+			signature := ed25519.Sign(signer, digest[:])
+
+			path := dir + "/bundle-" + strconv.Itoa(i) + ".tar.gz"
+			writeTestBundle(t, path, bundleFiles, bundleManifest)
+
+			err := verifyFilesManifest(path, key, signature)
+			if tt.ok && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			} else if !tt.ok && err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+// Writes a tar.gz bundle with the files and the files manifest, if not empty
+func writeTestBundle(t *testing.T, path string, files map[string]string, manifest []byte) {
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+
+	write := func(name string, content []byte) {
+		err := tw.WriteHeader(&tar.Header{
+			Name:     name,
+			Typeflag: tar.TypeReg,
+			Mode:     0644,
+			Size:     int64(len(content)),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(manifest) > 0 {
+		write(utils.FilesManifestName, manifest)
+	}
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		write(name, []byte(files[name]))
+	}
+
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadSigningKey(t *testing.T) {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	validKey := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	invalidKey := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: []byte("invalid")}))
+
+	dir, err := ioutil.TempDir("", "statiko-key-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(dir+"/valid.pem", []byte(validKey), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(dir+"/invalid.pem", []byte(invalidKey), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		key      string
+		required bool
+		loaded   bool
+		err      bool
+	}{
+		{name: "valid key", key: validKey, required: true, loaded: true},
+		{name: "valid key in a file", key: dir + "/valid.pem", required: true, loaded: true},
+		{name: "no key and signatures required", required: true},
+		{name: "no key", required: false},
+		{name: "invalid key and signatures required", key: invalidKey, required: true, err: true},
+		{name: "invalid key", key: invalidKey, required: false},
+		{name: "invalid key in a file and signatures required", key: dir + "/invalid.pem", required: true, err: true},
+		{name: "missing file and signatures required", key: dir + "/missing.pem", required: true, err: true},
+		{name: "missing file", key: dir + "/missing.pem", required: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for key, val := range map[string]interface{}{
+				"codesign.publicKey": tt.key,
+				"codesign.required":  tt.required,
+			} {
+				prev := appconfig.Config.Get(key)
+				appconfig.Config.Set(key, val)
+				defer appconfig.Config.Set(key, prev)
+			}
+
+			m := newTestObjectsManager(t)
+			err := m.LoadSigningKey()
+			if (err != nil) != tt.err {
+				t.Fatalf("expected error %v, got %v", tt.err, err)
+			}
+			if (m.codeSignKey != nil) != tt.loaded {
+				t.Errorf("expected key loaded %v, got %v", tt.loaded, m.codeSignKey != nil)
+			}
+		})
+	}
+}
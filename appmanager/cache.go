@@ -0,0 +1,241 @@
+/*
+Copyright © 2020 Alessandro Segala (@ItalyPaleAle)
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published
+by the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package appmanager
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/statiko-dev/statiko/appconfig"
+	"github.com/statiko-dev/statiko/state"
+	"github.com/statiko-dev/statiko/utils"
+)
+
+// Name of the file in the cache folder with the list of the most recent apps deployed on each site
+const cacheHistoryFile = ".history.json"
+
+// Prefixes of the files in the cache folder that store details of each bundle: the file type and the ID of the key that signed it
+var cacheBundleFilePrefixes = []string{".type.", ".keyid."}
+
+// Bundle in the cache folder
+type cachedBundle struct {
+	name    string
+	size    int64
+	lastUse time.Time
+}
+
+// CacheUsage returns the number of bundles in the cache and their total size
+func (m *Manager) CacheUsage() (*utils.NodeCache, error) {
+	bundles, _, size, err := m.listCachedBundles()
+	if err != nil {
+		return nil, err
+	}
+	return &utils.NodeCache{
+		Bundles: len(bundles),
+		Size:    size,
+		MaxSize: int64(appconfig.Config.GetInt("cache.maxSize")) * 1024 * 1024,
+	}, nil
+}
+
+// CleanCache removes bundles from the cache, least recently used first, until the cache's size is within the budget set in the configuration
+// Bundles used by sites, and the most recent ones deployed on each site (for fast rollbacks), are never removed
+func (m *Manager) CleanCache(sites []state.SiteState, defaultSite *state.NodeDefaultSite) error {
+	// Bundles used by sites are protected
+	// The time they were last used is updated, so the least recently used bundles can be found by their modification time
+	protected := make(map[string]bool)
+	now := time.Now()
+	use := func(app *state.SiteApp) {
+		if app == nil || protected[app.Name] {
+			return
+		}
+		protected[app.Name] = true
+		if err := os.Chtimes(m.appRoot+"cache/"+app.Name, now, now); err != nil && !os.IsNotExist(err) {
+			m.log.Println("Error ignored while updating the last use of bundle", app.Name, err)
+		}
+	}
+	for _, s := range sites {
+		use(s.App)
+		use(s.PendingApp)
+		use(s.PreviousApp)
+		if s.Canary != nil {
+			use(s.Canary.App)
+		}
+	}
+	if defaultSite != nil {
+		use(defaultSite.App)
+	}
+
+	// Update the history of the apps deployed on each site, and protect the most recent ones
+	history, err := m.updateCacheHistory(sites)
+	if err != nil {
+		return err
+	}
+	for _, apps := range history {
+		for _, app := range apps {
+			protected[app] = true
+		}
+	}
+
+	// List all bundles in the cache
+	bundles, orphans, size, err := m.listCachedBundles()
+	if err != nil {
+		return err
+	}
+
+	// Remove the files with the details of bundles that don't exist anymore
+	for _, name := range orphans {
+		if err := os.Remove(m.appRoot + "cache/" + name); err != nil && !os.IsNotExist(err) {
+			m.log.Println("Error ignored while removing extraneous file", m.appRoot+"cache/"+name, err)
+		}
+	}
+
+	// Evict the least recently used bundles until we're within the budget
+	maxSize := int64(appconfig.Config.GetInt("cache.maxSize")) * 1024 * 1024
+	if maxSize <= 0 || size <= maxSize {
+		return nil
+	}
+	sort.Slice(bundles, func(i, j int) bool {
+		return bundles[i].lastUse.Before(bundles[j].lastUse)
+	})
+	for _, b := range bundles {
+		if size <= maxSize {
+			break
+		}
+		if protected[b.name] {
+			continue
+		}
+		m.log.Println("Removing bundle from the cache:", b.name)
+		if err := os.Remove(m.appRoot + "cache/" + b.name); err != nil {
+			m.log.Println("Error ignored while removing bundle from the cache", b.name, err)
+			continue
+		}
+		for _, prefix := range cacheBundleFilePrefixes {
+			if err := os.Remove(m.appRoot + "cache/" + prefix + b.name); err != nil && !os.IsNotExist(err) {
+				m.log.Println("Error ignored while removing details for bundle", b.name, err)
+			}
+		}
+		size -= b.size
+	}
+	if size > maxSize {
+		m.log.Printf("[Warn] Cache size (%d bytes) exceeds the budget, but all remaining bundles are in use\n", size)
+	}
+
+	return nil
+}
+
+// Returns the list of bundles in the cache and their total size
+// Also returns the names of the files with the details of bundles that don't exist anymore, which aren't included in the size
+func (m *Manager) listCachedBundles() (bundles []cachedBundle, orphans []string, size int64, err error) {
+	files, err := ioutil.ReadDir(m.appRoot + "cache/")
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	bundles = make([]cachedBundle, 0, len(files))
+	orphans = make([]string, 0)
+	names := make(map[string]bool, len(files))
+	for _, f := range files {
+		if f.IsDir() || strings.HasPrefix(f.Name(), ".") {
+			continue
+		}
+		bundles = append(bundles, cachedBundle{
+			name:    f.Name(),
+			size:    f.Size(),
+			lastUse: f.ModTime(),
+		})
+		names[f.Name()] = true
+		size += f.Size()
+	}
+	for _, f := range files {
+		for _, prefix := range cacheBundleFilePrefixes {
+			if !strings.HasPrefix(f.Name(), prefix) {
+				continue
+			}
+			if !names[strings.TrimPrefix(f.Name(), prefix)] {
+				orphans = append(orphans, f.Name())
+				break
+			}
+			size += f.Size()
+		}
+	}
+
+	return bundles, orphans, size, nil
+}
+
+// Adds the current app of each site to the history, and returns the history
+// The history keeps the last "cache.keepPerSite" apps for each site, including the current one
+func (m *Manager) updateCacheHistory(sites []state.SiteState) (map[string][]string, error) {
+	// The current app of each site is always kept
+	keep := appconfig.Config.GetInt("cache.keepPerSite")
+	if keep < 1 {
+		keep = 1
+	}
+	path := m.appRoot + "cache/" + cacheHistoryFile
+
+	// Read the existing history
+	history := make(map[string][]string)
+	exists, err := utils.FileExists(path)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		read, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(read, &history); err != nil {
+			m.log.Println("Error ignored while reading the cache history; resetting it", err)
+			history = make(map[string][]string)
+		}
+	}
+
+	// Update the history, removing sites that don't exist anymore
+	updated := make(map[string][]string, len(sites))
+	for _, s := range sites {
+		apps := history[s.Domain]
+		if s.App != nil && (len(apps) == 0 || apps[0] != s.App.Name) {
+			list := []string{s.App.Name}
+			for _, app := range apps {
+				if app != s.App.Name {
+					list = append(list, app)
+				}
+			}
+			apps = list
+		}
+		if len(apps) > keep {
+			apps = apps[:keep]
+		}
+		if len(apps) > 0 {
+			updated[s.Domain] = apps
+		}
+	}
+
+	// Write the history to disk
+	data, err := json.Marshal(updated)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := m.writeFileIfChanged(path, data); err != nil {
+		return nil, err
+	}
+
+	return updated, nil
+}
@@ -0,0 +1,80 @@
+/*
+Copyright © 2020 Alessandro Segala (@ItalyPaleAle)
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published
+by the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package appmanager
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/statiko-dev/statiko/state"
+	"github.com/statiko-dev/statiko/utils"
+)
+
+func TestCacheOrphanedFiles(t *testing.T) {
+	m := newTestObjectsManager(t)
+	if err := os.Mkdir(m.appRoot+"cache", 0755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"app-1.tar.gz":             "bundle",
+		".type.app-1.tar.gz":       "tar.gz",
+		".keyid.app-1.tar.gz":      "key1",
+		".type.removed.tar.gz":     "tar.gz",
+		".keyid.removed.tar.gz":    "key1",
+		".type.only-type.tar.gz":   "zip",
+		".keyid.only-keyid.tar.gz": "key2",
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(m.appRoot+"cache/"+name, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	orphans := []string{".type.removed.tar.gz", ".keyid.removed.tar.gz", ".type.only-type.tar.gz", ".keyid.only-keyid.tar.gz"}
+	exists := func(name string) bool {
+		_, err := os.Stat(m.appRoot + "cache/" + name)
+		if err != nil && !os.IsNotExist(err) {
+			t.Fatal(err)
+		}
+		return err == nil
+	}
+
+	// Reading the usage of the cache doesn't remove anything, and orphaned files aren't counted
+	usage, err := m.CacheUsage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.Bundles != 1 || usage.Size != int64(len("bundle")+len("tar.gz")+len("key1")) {
+		t.Errorf("unexpected usage: %+v", usage)
+	}
+	for name := range files {
+		if !exists(name) {
+			t.Errorf("file %s was removed while reading the usage", name)
+		}
+	}
+
+	// Cleaning the cache removes the orphaned files only
+	if err := m.CleanCache([]state.SiteState{}, nil); err != nil {
+		t.Fatal(err)
+	}
+	for name := range files {
+		orphan := utils.StringInSlice(orphans, name)
+		if exists(name) == orphan {
+			t.Errorf("file %s: expected exists=%v", name, !orphan)
+		}
+	}
+}
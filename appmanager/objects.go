@@ -0,0 +1,145 @@
+/*
+Copyright © 2020 Alessandro Segala (@ItalyPaleAle)
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published
+by the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package appmanager
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// Staged apps don't contain copies of their files, but rather hardlinks to objects in the /approot/objects folder, which are named after the SHA-256 hash of their content
+// This way, files that are identical across multiple versions of an app (or across apps) are stored on disk only once
+// The number of links to each object is used as reference count: objects with only one link are not used by any app and can be removed
+
+// Mode of all objects, which are shared by all apps
+const objectMode = 0644
+
+// Returns the path of the object with the given hash
+func (m *Manager) objectPath(hash string) string {
+	return m.appRoot + "objects/" + hash[0:2] + "/" + hash[2:]
+}
+
+// Replaces all regular files in the staged app's folder with hardlinks to objects in the store
+func (m *Manager) dedupStagedApp(path string) error {
+	return filepath.Walk(path, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		return m.dedupFile(file)
+	})
+}
+
+// Replaces a file with a hardlink to the object with the same content, adding it to the store if there's none
+func (m *Manager) dedupFile(file string) error {
+	hash, err := hashFile(file)
+	if err != nil {
+		return err
+	}
+	obj := m.objectPath(hash)
+	if err := os.MkdirAll(filepath.Dir(obj), 0755); err != nil {
+		return err
+	}
+
+	// Try adding the file to the store first
+	// This fails if there's already an object with the same content, including when it's added by another worker at the same time
+	err = os.Link(file, obj)
+	if err == nil {
+		return os.Chmod(obj, objectMode)
+	}
+	if !os.IsExist(err) {
+		// Filesystem doesn't support hardlinks, so just keep the file as-is
+		m.log.Println("Could not add file to the objects store, keeping a copy:", file, err)
+		return nil
+	}
+
+	// Replace the file with a link to the existing object
+	// Create the link with a temporary name first, then rename it so the replacement is atomic
+	tmp := file + ".__statiko"
+	if err := os.Link(obj, tmp); err != nil {
+		if os.IsExist(err) {
+			return err
+		}
+		// The object can't have more links (e.g. EMLINK), so keep the file as-is
+		m.log.Println("Could not link file to the object in the store, keeping a copy:", file, err)
+		return nil
+	}
+	if err := os.Rename(tmp, file); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// Removes all objects that aren't linked by any staged app
+func (m *Manager) pruneObjects() error {
+	dirs, err := ioutil.ReadDir(m.appRoot + "objects/")
+	if err != nil {
+		return err
+	}
+	for _, d := range dirs {
+		if !d.IsDir() {
+			continue
+		}
+		dir := m.appRoot + "objects/" + d.Name()
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		removed := 0
+		for _, f := range files {
+			st, ok := f.Sys().(*syscall.Stat_t)
+			if !ok || st.Nlink > 1 {
+				continue
+			}
+			if err := os.Remove(dir + "/" + f.Name()); err != nil {
+				// Do not return on error
+				m.log.Println("Error ignored while removing object", dir+"/"+f.Name(), err)
+				continue
+			}
+			removed++
+		}
+		// Remove the folder if it's now empty
+		if removed == len(files) {
+			if err := os.Remove(dir); err != nil {
+				m.log.Println("Error ignored while removing folder", dir, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Returns the hex-encoded SHA-256 hash of a file's content
+func hashFile(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,155 @@
+/*
+Copyright © 2020 Alessandro Segala (@ItalyPaleAle)
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published
+by the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package appmanager
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Returns a manager that uses a temporary folder as app root
+func newTestObjectsManager(t *testing.T) *Manager {
+	dir, err := ioutil.TempDir("", "statiko-objects-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.RemoveAll(dir)
+	})
+	m := &Manager{
+		appRoot: dir + "/",
+		log:     log.New(ioutil.Discard, "", 0),
+	}
+	for _, f := range []string{"apps", "objects"} {
+		if err := os.Mkdir(m.appRoot+f, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return m
+}
+
+func TestPruneObjectsSharedFiles(t *testing.T) {
+	m := newTestObjectsManager(t)
+
+	apps := map[string]map[string]string{
+		"app-1": {
+			"index.html":     "shared",
+			"css/style.css":  "body {}",
+			"only-app-1.txt": "app 1",
+		},
+		"app-2": {
+			"index.html":      "shared",
+			"copy/index.html": "shared",
+			"css/style.css":   "body {}",
+			"only-app-2.txt":  "app 2",
+		},
+	}
+	objectExists := func(content string) bool {
+		h := sha256.Sum256([]byte(content))
+		_, err := os.Stat(m.objectPath(hex.EncodeToString(h[:])))
+		if err != nil && !os.IsNotExist(err) {
+			t.Fatal(err)
+		}
+		return err == nil
+	}
+
+	// Stage both apps
+	for app, files := range apps {
+		for name, content := range files {
+			path := m.appRoot + "apps/" + app + "/" + name
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := m.dedupStagedApp(m.appRoot + "apps/" + app); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Identical files are links to the same object
+	a, err := os.Stat(m.appRoot + "apps/app-1/index.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{"app-2/index.html", "app-2/copy/index.html"} {
+		b, err := os.Stat(m.appRoot + "apps/" + file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !os.SameFile(a, b) {
+			t.Errorf("file %s is not a link to the shared object", file)
+		}
+	}
+
+	// Pruning doesn't remove objects while both apps are staged
+	if err := m.pruneObjects(); err != nil {
+		t.Fatal(err)
+	}
+	for _, content := range []string{"shared", "body {}", "app 1", "app 2"} {
+		if !objectExists(content) {
+			t.Errorf("object with content %q was removed", content)
+		}
+	}
+
+	// Remove the first app: only the objects used by that app alone are pruned
+	if err := os.RemoveAll(m.appRoot + "apps/app-1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.pruneObjects(); err != nil {
+		t.Fatal(err)
+	}
+	for _, content := range []string{"shared", "body {}", "app 2"} {
+		if !objectExists(content) {
+			t.Errorf("object with content %q was removed while still in use", content)
+		}
+	}
+	if objectExists("app 1") {
+		t.Error("object used only by the removed app was not pruned")
+	}
+	for name, content := range apps["app-2"] {
+		read, err := ioutil.ReadFile(m.appRoot + "apps/app-2/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(read) != content {
+			t.Errorf("file %s has content %q, expected %q", name, string(read), content)
+		}
+	}
+
+	// Remove the second app too: the store is empty
+	if err := os.RemoveAll(m.appRoot + "apps/app-2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.pruneObjects(); err != nil {
+		t.Fatal(err)
+	}
+	dirs, err := ioutil.ReadDir(m.appRoot + "objects")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dirs) != 0 {
+		t.Errorf("expected the objects store to be empty, found %d folders", len(dirs))
+	}
+}
@@ -275,6 +275,11 @@ func (m *Manager) DeleteSite(domain string) error {
 	state := m.store.GetState()
 	for i, s := range state.Sites {
 		if s.Domain == domain || (len(s.Aliases) > 0 && utils.StringInSlice(s.Aliases, domain)) {
+			// Remove the self-signed certificate of the preview site, if any
+			if s.PreviewDomain != "" && state.Secrets != nil {
+				delete(state.Secrets, m.certificateSecretKey(TLSCertificateSelfSigned, []string{s.PreviewDomain}))
+			}
+
 			// Remove the element
 			state.Sites[i] = state.Sites[len(state.Sites)-1]
 			state.Sites = state.Sites[:len(state.Sites)-1]
@@ -379,6 +384,306 @@ func (m *Manager) SetDHParams(val string) error {
 	return nil
 }
 
+// GetDefaultSite returns a copy of the configuration for the default site, or nil if it's not set
+func (m *Manager) GetDefaultSite() *NodeDefaultSite {
+	state := m.store.GetState()
+	if state == nil || state.DefaultSite == nil {
+		return nil
+	}
+
+	// Return a copy so callers can set the manifest without modifying the state
+	res := *state.DefaultSite
+	if res.App != nil {
+		res.App = &SiteApp{
+			Name: res.App.Name,
+		}
+	}
+	if res.TLS != nil {
+		tls := *res.TLS
+		res.TLS = &tls
+	}
+	return &res
+}
+
+// SetDefaultSite stores the configuration for the default site
+// Pass nil to restore the built-in default site
+func (m *Manager) SetDefaultSite(val *NodeDefaultSite) error {
+	// Check if the store is healthy
+	// Note: this won't guarantee that the store will be healthy when we try to write in it
+	healthy, err := m.StoreHealth()
+	if !healthy {
+		return err
+	}
+
+	// Lock
+	leaseID, err := m.store.AcquireLock("state", true)
+	if err != nil {
+		return err
+	}
+	defer m.store.ReleaseLock(leaseID)
+
+	// Store the value
+	state := m.store.GetState()
+	if state == nil {
+		return errors.New("state not loaded")
+	}
+	state.DefaultSite = val
+
+	m.setUpdated()
+
+	// Commit the state to the store
+	if err := m.store.WriteState(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// GetApps returns the list of apps in the registry
+func (m *Manager) GetApps() map[string]*NodeApp {
+	state := m.store.GetState()
+	if state == nil {
+		return nil
+	}
+	return state.Apps
+}
+
+// GetApp returns a copy of an app in the registry, or nil if it doesn't exist
+func (m *Manager) GetApp(name string) *NodeApp {
+	state := m.store.GetState()
+	if state == nil || state.Apps == nil {
+		return nil
+	}
+	app, ok := state.Apps[name]
+	if !ok || app == nil {
+		return nil
+	}
+	return copyNodeApp(app)
+}
+
+// SetApp stores an app in the registry
+// Pass nil to remove the app
+func (m *Manager) SetApp(name string, app *NodeApp) error {
+	// Check if the store is healthy
+	// Note: this won't guarantee that the store will be healthy when we try to write in it
+	healthy, err := m.StoreHealth()
+	if !healthy {
+		return err
+	}
+
+	// Lock
+	leaseID, err := m.store.AcquireLock("state", true)
+	if err != nil {
+		return err
+	}
+	defer m.store.ReleaseLock(leaseID)
+
+	// Store the value
+	state := m.store.GetState()
+	if state == nil {
+		return errors.New("state not loaded")
+	}
+	if app == nil {
+		delete(state.Apps, name)
+	} else {
+		if state.Apps == nil {
+			state.Apps = make(map[string]*NodeApp)
+		}
+		state.Apps[name] = app
+	}
+
+	m.setUpdated()
+
+	// Commit the state to the store
+	if err := m.store.WriteState(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Errors returned by the methods that update apps in the registry
+var (
+	ErrAppNotFound     = errors.New("app not found in the registry")
+	ErrVersionExists   = errors.New("bundle is already a version of this app")
+	ErrVersionNotFound = errors.New("bundle is not a version of this app")
+)
+
+// AddAppVersion adds a bundle as the most recent version of an app in the registry, creating the app if needed, and points the tags to it
+// The app is updated while holding the lock, so concurrent requests don't overwrite each other's changes
+// Returns a copy of the updated app
+func (m *Manager) AddAppVersion(name string, bundle string, tags []string) (*NodeApp, error) {
+	return m.updateApp(name, true, func(app *NodeApp) error {
+		if app.HasVersion(bundle) {
+			return ErrVersionExists
+		}
+		now := time.Now()
+		app.Versions = append([]NodeAppVersion{{
+			Bundle:  bundle,
+			Created: &now,
+		}}, app.Versions...)
+		for _, tag := range tags {
+			app.Tags[tag] = bundle
+		}
+		return nil
+	})
+}
+
+// SetAppTag points a tag of an app in the registry to one of its versions
+// Returns a copy of the updated app
+func (m *Manager) SetAppTag(name string, tag string, bundle string) (*NodeApp, error) {
+	return m.updateApp(name, false, func(app *NodeApp) error {
+		if !app.HasVersion(bundle) {
+			return ErrVersionNotFound
+		}
+		app.Tags[tag] = bundle
+		return nil
+	})
+}
+
+// Updates an app in the registry while holding the lock
+// The update function receives a copy of the app, which is stored only if the function doesn't return an error
+func (m *Manager) updateApp(name string, create bool, update func(app *NodeApp) error) (*NodeApp, error) {
+	// Check if the store is healthy
+	// Note: this won't guarantee that the store will be healthy when we try to write in it
+	healthy, err := m.StoreHealth()
+	if !healthy {
+		return nil, err
+	}
+
+	// Lock
+	leaseID, err := m.store.AcquireLock("state", true)
+	if err != nil {
+		return nil, err
+	}
+	defer m.store.ReleaseLock(leaseID)
+
+	// Get the app
+	state := m.store.GetState()
+	if state == nil {
+		return nil, errors.New("state not loaded")
+	}
+	var app *NodeApp
+	if existing := state.Apps[name]; existing != nil {
+		app = copyNodeApp(existing)
+	} else if create {
+		app = &NodeApp{
+			Tags: make(map[string]string),
+		}
+	} else {
+		return nil, ErrAppNotFound
+	}
+
+	// Update and store the app
+	if err := update(app); err != nil {
+		return nil, err
+	}
+	if state.Apps == nil {
+		state.Apps = make(map[string]*NodeApp)
+	}
+	state.Apps[name] = app
+
+	m.setUpdated()
+
+	// Commit the state to the store
+	if err := m.store.WriteState(); err != nil {
+		return nil, err
+	}
+
+	return copyNodeApp(app), nil
+}
+
+// Returns a deep copy of an app in the registry
+func copyNodeApp(app *NodeApp) *NodeApp {
+	res := &NodeApp{
+		Versions: make([]NodeAppVersion, len(app.Versions)),
+		Tags:     make(map[string]string, len(app.Tags)),
+	}
+	copy(res.Versions, app.Versions)
+	for k, v := range app.Tags {
+		res.Tags[k] = v
+	}
+	return res
+}
+
+// GetCodeSignKeys returns the keyring of trusted keys for code signing
+func (m *Manager) GetCodeSignKeys() map[string]*CodeSignKey {
+	state := m.store.GetState()
+	if state == nil {
+		return nil
+	}
+	return state.CodeSignKeys
+}
+
+// GetCodeSignKey returns a copy of a key in the keyring, or nil if it doesn't exist
+func (m *Manager) GetCodeSignKey(id string) *CodeSignKey {
+	state := m.store.GetState()
+	if state == nil || state.CodeSignKeys == nil {
+		return nil
+	}
+	key, ok := state.CodeSignKeys[id]
+	if !ok || key == nil {
+		return nil
+	}
+
+	res := *key
+	return &res
+}
+
+// SetCodeSignKey stores a key in the keyring
+// Pass nil to remove the key
+func (m *Manager) SetCodeSignKey(id string, key *CodeSignKey) error {
+	// Check if the store is healthy
+	// Note: this won't guarantee that the store will be healthy when we try to write in it
+	healthy, err := m.StoreHealth()
+	if !healthy {
+		return err
+	}
+
+	// Lock
+	leaseID, err := m.store.AcquireLock("state", true)
+	if err != nil {
+		return err
+	}
+	defer m.store.ReleaseLock(leaseID)
+
+	// Store the value
+	state := m.store.GetState()
+	if state == nil {
+		return errors.New("state not loaded")
+	}
+	if key == nil {
+		delete(state.CodeSignKeys, id)
+	} else {
+		if state.CodeSignKeys == nil {
+			state.CodeSignKeys = make(map[string]*CodeSignKey)
+		}
+		state.CodeSignKeys[id] = key
+	}
+
+	m.setUpdated()
+
+	// Commit the state to the store
+	if err := m.store.WriteState(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// ResolveAppTag returns the bundle a tag of an app in the registry points to
+func (m *Manager) ResolveAppTag(name string, tag string) (string, error) {
+	app := m.GetApp(name)
+	if app == nil {
+		return "", errors.New("app not found in the registry: " + name)
+	}
+	bundle, ok := app.Tags[tag]
+	if !ok || bundle == "" {
+		return "", errors.New("tag not found for app " + name + ": " + tag)
+	}
+	return bundle, nil
+}
+
 // GetSecret returns the value for a secret (encrypted in the state)
 func (m *Manager) GetSecret(key string) ([]byte, error) {
 	// Check if we have a secret for this key
@@ -565,6 +870,46 @@ func (m *Manager) ListImportedCertificates() (res []string) {
 	return
 }
 
+// GetClientCA returns a PEM-encoded bundle of CA certificates used to authenticate clients, stored as secret
+func (m *Manager) GetClientCA(name string) ([]byte, error) {
+	if name == "" {
+		return nil, errors.New("invalid name")
+	}
+	return m.GetSecret("clientca/" + name)
+}
+
+// SetClientCA stores a PEM-encoded bundle of CA certificates used to authenticate clients as secret
+func (m *Manager) SetClientCA(name string, ca []byte) error {
+	if name == "" {
+		return errors.New("invalid name")
+	}
+	if len(ca) > 204800 {
+		return errors.New("CA bundle is too long")
+	}
+	return m.SetSecret("clientca/"+name, ca)
+}
+
+// RemoveClientCA deletes a bundle of CA certificates used to authenticate clients
+func (m *Manager) RemoveClientCA(name string) error {
+	if name == "" {
+		return errors.New("invalid name")
+	}
+	return m.DeleteSecret("clientca/" + name)
+}
+
+// ListClientCAs returns a list of the names of all bundles of CA certificates used to authenticate clients
+func (m *Manager) ListClientCAs() (res []string) {
+	res = make([]string, 0)
+	// Iterate through all secrets looking for those starting with "clientca/"
+	state := m.store.GetState()
+	for k := range state.Secrets {
+		if strings.HasPrefix(k, "clientca/") {
+			res = append(res, strings.TrimPrefix(k, "clientca/"))
+		}
+	}
+	return
+}
+
 // certificateSecretKey returns the key of secret for the certificate
 func (m *Manager) certificateSecretKey(typ string, nameOrDomains []string) string {
 	switch typ {
@@ -17,6 +17,9 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package state
 
 import (
+	"errors"
+	"net"
+	"strings"
 	"time"
 
 	"github.com/statiko-dev/statiko/utils"
@@ -27,6 +30,9 @@ const (
 	TLSCertificateAzureKeyVault = "akv"
 	TLSCertificateSelfSigned    = "selfsigned"
 	TLSCertificateACME          = "acme"
+
+	TLSClientAuthRequired = "required"
+	TLSClientAuthOptional = "optional"
 )
 
 // NodeState represents the global state of the node
@@ -34,6 +40,104 @@ type NodeState struct {
 	Sites    []SiteState       `json:"sites"`
 	Secrets  map[string][]byte `json:"secrets,omitempty"`
 	DHParams *NodeDHParams     `json:"dhparams,omitempty"`
+
+	// Site served for requests to unknown hosts
+	DefaultSite *NodeDefaultSite `json:"defaultSite,omitempty"`
+
+	// Registry of apps, with the versions of each app and tags pointing to them
+	Apps map[string]*NodeApp `json:"apps,omitempty"`
+
+	// Keyring of trusted keys for code signing, by key ID
+	CodeSignKeys map[string]*CodeSignKey `json:"codeSignKeys,omitempty"`
+}
+
+// CodeSignKey is a trusted public key for verifying the signatures of app bundles
+// Revoked keys are kept in the keyring so their IDs can't be reused
+type CodeSignKey struct {
+	// PEM-encoded public key
+	PublicKey string `json:"publicKey"`
+	// Validity window of the key; bundles are accepted only if they were signed and stored while the key was valid
+	NotBefore *time.Time `json:"notBefore,omitempty"`
+	NotAfter  *time.Time `json:"notAfter,omitempty"`
+	// Time the key was revoked, if it was
+	Revoked *time.Time `json:"revoked,omitempty"`
+}
+
+// Usable returns an error if the key is revoked or outside of its validity window
+func (k *CodeSignKey) Usable(now time.Time) error {
+	if k.Revoked != nil {
+		return errors.New("key was revoked")
+	}
+	return k.ValidAt(now)
+}
+
+// ValidAt returns an error if the time is outside of the key's validity window
+func (k *CodeSignKey) ValidAt(t time.Time) error {
+	if k.NotBefore != nil && t.Before(*k.NotBefore) {
+		return errors.New("key is not valid yet")
+	}
+	if k.NotAfter != nil && t.After(*k.NotAfter) {
+		return errors.New("key has expired")
+	}
+	return nil
+}
+
+// NodeApp represents an app in the registry, which groups multiple versions (bundles) under the same name
+// Tags are movable pointers to a version, which sites can reference as "name:tag"
+type NodeApp struct {
+	// Versions of the app, most recent first
+	Versions []NodeAppVersion `json:"versions"`
+	// Tags, with the bundle each one points to
+	Tags map[string]string `json:"tags,omitempty"`
+}
+
+// NodeAppVersion is a version of an app in the registry
+type NodeAppVersion struct {
+	Bundle  string     `json:"bundle"`
+	Created *time.Time `json:"created,omitempty"`
+}
+
+// HasVersion returns true if the bundle is one of the app's versions
+func (a *NodeApp) HasVersion(bundle string) bool {
+	for _, v := range a.Versions {
+		if v.Bundle == bundle {
+			return true
+		}
+	}
+	return false
+}
+
+// NodeDefaultSite represents the configuration of the default site, which responds to requests for unknown hosts
+type NodeDefaultSite struct {
+	// App served by the default site; if empty, the built-in default app is used
+	App *SiteApp `json:"app,omitempty"`
+
+	// If true, connections for unknown hosts are closed without a response
+	Drop bool `json:"drop,omitempty"`
+
+	// TLS certificate for the default server; if empty, the node's certificate is used (if any)
+	// Only imported certificates and certificates stored in Azure Key Vault are supported
+	TLS *SiteTLS `json:"tls,omitempty"`
+}
+
+// Validate returns true if the default site object is valid
+func (d *NodeDefaultSite) Validate() bool {
+	// Can't serve an app and drop connections at the same time
+	if d.App != nil && (d.Drop || !d.App.Validate()) {
+		return false
+	}
+	if d.TLS != nil {
+		if d.TLS.Type != TLSCertificateImported && d.TLS.Type != TLSCertificateAzureKeyVault {
+			return false
+		}
+		if d.TLS.Certificate == nil || *d.TLS.Certificate == "" {
+			return false
+		}
+		// Client certificates are not supported for the default site
+		d.TLS.ClientCA = nil
+		d.TLS.ClientAuth = ""
+	}
+	return true
 }
 
 // SiteState represents the state of a single site
@@ -45,11 +149,57 @@ type SiteState struct {
 	// Temporary site (e.g. for testing)
 	Temporary bool `json:"temporary,omitempty"`
 
+	// Time after which the site is deleted automatically
+	Expires *time.Time `json:"expires,omitempty"`
+
 	// TLS configuration
 	TLS *SiteTLS `json:"tls"`
 
 	// App
 	App *SiteApp `json:"app"`
+
+	// App deployed for preview, which is served on PreviewDomain until it's promoted or aborted
+	PendingApp    *SiteApp `json:"pendingApp,omitempty"`
+	PreviewDomain string   `json:"previewDomain,omitempty"`
+
+	// App that was active before the current one, used for rollbacks
+	PreviousApp *SiteApp `json:"previousApp,omitempty"`
+
+	// Maintenance mode
+	Maintenance *SiteMaintenance `json:"maintenance,omitempty"`
+
+	// Limit the rate of requests from each client
+	RateLimit *utils.RateLimit `json:"rateLimit,omitempty"`
+
+	// Canary release: secondary app receiving a percentage of the traffic
+	Canary *SiteCanary `json:"canary,omitempty"`
+
+	// IDs of the keys in the keyring that can sign apps deployed on this site; if empty, any trusted key is accepted
+	AllowedKeys []string `json:"allowedKeys,omitempty"`
+}
+
+// PreviewSite returns the object for the temporary site that serves the pending app, or nil if there's none
+func (s *SiteState) PreviewSite() *SiteState {
+	if s.PendingApp == nil || s.PreviewDomain == "" {
+		return nil
+	}
+	// The preview site authenticates clients like the site, so apps that require client certificates can be previewed
+	tls := &SiteTLS{
+		Type: TLSCertificateSelfSigned,
+	}
+	if s.TLS != nil {
+		tls.ClientCA = s.TLS.ClientCA
+		tls.ClientAuth = s.TLS.ClientAuth
+	}
+	return &SiteState{
+		Domain:    s.PreviewDomain,
+		Temporary: true,
+		TLS:       tls,
+		App: &SiteApp{
+			Name: s.PendingApp.Name,
+		},
+		AllowedKeys: s.AllowedKeys,
+	}
 }
 
 // SiteTLS represents the TLS configuration for the site
@@ -57,11 +207,16 @@ type SiteTLS struct {
 	Type        string  `json:"type"`
 	Certificate *string `json:"cert,omitempty"`
 	Version     *string `json:"ver,omitempty"`
+
+	// Name of the bundle of CA certificates used to authenticate clients, and whether client certificates are "required" (default) or "optional"
+	ClientCA   *string `json:"clientCA,omitempty"`
+	ClientAuth string  `json:"clientAuth,omitempty"`
 }
 
 // SiteApp represents the state of an app deployed or being deployed
 type SiteApp struct {
 	// App details
+	// The name is the name of a bundle, or a reference to a tag of an app in the registry, as "name:tag"
 	Name string `json:"name" binding:"required"`
 
 	// App manifest (for internal use)
@@ -71,10 +226,73 @@ type SiteApp struct {
 // Validate returns true if the app object is valid
 func (a *SiteApp) Validate() bool {
 	// Sanitize and validate
-	a.Name = utils.SanitizeAppName(a.Name)
+	if name, tag, ok := a.Tag(); ok {
+		name = utils.SanitizeAppName(name)
+		tag = utils.SanitizeAppTag(tag)
+		if name == "" || tag == "" {
+			a.Name = ""
+		} else {
+			a.Name = name + ":" + tag
+		}
+	} else {
+		a.Name = utils.SanitizeAppName(a.Name)
+	}
 	return a.Name != ""
 }
 
+// Tag returns the name of the app in the registry and the tag, if the app references a tag
+func (a *SiteApp) Tag() (name string, tag string, ok bool) {
+	pos := strings.IndexByte(a.Name, ':')
+	if pos < 0 {
+		return "", "", false
+	}
+	return a.Name[:pos], a.Name[(pos + 1):], true
+}
+
+// SiteCanary represents a secondary app that receives a percentage of the site's traffic
+// The configuration from the manifest of the main app is used for both apps
+type SiteCanary struct {
+	// App deployed as canary
+	App *SiteApp `json:"app" binding:"required"`
+	// Percentage of visitors that are routed to the canary app
+	Percentage int `json:"percentage" binding:"required,min=1,max=99"`
+}
+
+// SiteMaintenance represents the configuration for the maintenance mode of a site
+type SiteMaintenance struct {
+	// If true, the site responds with a 503 status code
+	Enabled bool `json:"enabled"`
+	// Path of the page to show, inside the app's bundle; if empty, uses a built-in page
+	Page string `json:"page,omitempty"`
+	// Value for the Retry-After header, in seconds
+	RetryAfter int `json:"retryAfter,omitempty"`
+	// List of IPs or CIDR ranges that can still see the site
+	AllowIPs []string `json:"allowIPs,omitempty"`
+}
+
+// Validate returns true if the maintenance object is valid
+func (m *SiteMaintenance) Validate() bool {
+	// Page must be an absolute path inside the bundle
+	if m.Page != "" && (!strings.HasPrefix(m.Page, "/") || strings.Contains(m.Page, "..")) {
+		return false
+	}
+	if m.RetryAfter < 0 {
+		return false
+	}
+
+	// Normalize IPs and ranges
+	for i, ip := range m.AllowIPs {
+		if _, ipNet, err := net.ParseCIDR(ip); err == nil {
+			m.AllowIPs[i] = ipNet.String()
+		} else if parsed := net.ParseIP(ip); parsed != nil {
+			m.AllowIPs[i] = parsed.String()
+		} else {
+			return false
+		}
+	}
+	return true
+}
+
 // NodeDHParams represents the DH Parameters file (PEM-encoded) and their age
 type NodeDHParams struct {
 	Date *time.Time `json:"time"`
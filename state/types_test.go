@@ -0,0 +1,62 @@
+/*
+Copyright © 2020 Alessandro Segala (@ItalyPaleAle)
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published
+by the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package state
+
+import (
+	"testing"
+)
+
+func TestSiteAppTag(t *testing.T) {
+	tests := []struct {
+		app     string
+		name    string
+		tag     string
+		ok      bool
+		valid   bool
+		cleaned string
+	}{
+		{app: "myapp-1.2", ok: false, valid: true, cleaned: "myapp-1.2"},
+		{app: "MyApp-1.2", ok: false, valid: true, cleaned: "myapp-1.2"},
+		{app: "myapp:latest", name: "myapp", tag: "latest", ok: true, valid: true, cleaned: "myapp:latest"},
+		{app: "MyApp:V1.0_rc", name: "MyApp", tag: "V1.0_rc", ok: true, valid: true, cleaned: "myapp:v1.0_rc"},
+		{app: "myapp:", name: "myapp", tag: "", ok: true, valid: false},
+		{app: ":latest", name: "", tag: "latest", ok: true, valid: false},
+		{app: "myapp:a:b", name: "myapp", tag: "a:b", ok: true, valid: false},
+		{app: "myapp:_latest", name: "myapp", tag: "_latest", ok: true, valid: false},
+		{app: "my/app:latest", name: "my/app", tag: "latest", ok: true, valid: false},
+		{app: "../app", ok: false, valid: false},
+		{app: "", ok: false, valid: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.app, func(t *testing.T) {
+			app := &SiteApp{Name: tt.app}
+			name, tag, ok := app.Tag()
+			if name != tt.name || tag != tt.tag || ok != tt.ok {
+				t.Errorf("Tag returned (%q, %q, %v), expected (%q, %q, %v)", name, tag, ok, tt.name, tt.tag, tt.ok)
+			}
+
+			valid := app.Validate()
+			if valid != tt.valid {
+				t.Fatalf("Validate returned %v, expected %v", valid, tt.valid)
+			}
+			if valid && app.Name != tt.cleaned {
+				t.Errorf("expected sanitized name %q, got %q", tt.cleaned, app.Name)
+			}
+		})
+	}
+}
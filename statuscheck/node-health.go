@@ -18,6 +18,7 @@ package statuscheck
 
 import (
 	"github.com/statiko-dev/statiko/appconfig"
+	"github.com/statiko-dev/statiko/appmanager"
 	"github.com/statiko-dev/statiko/state"
 	"github.com/statiko-dev/statiko/sync"
 	"github.com/statiko-dev/statiko/utils"
@@ -39,6 +40,16 @@ func GetNodeHealth() *utils.NodeStatus {
 		Running: nginxStatus,
 	}
 
+	// Metrics from the Nginx server, if it's running
+	if nginxStatus {
+		metrics, err := webserver.Instance.Metrics()
+		if err != nil {
+			logger.Println("Error while collecting Nginx metrics:", err)
+		} else {
+			health.Nginx = *metrics
+		}
+	}
+
 	// Sync status
 	syncError := sync.SyncError()
 	syncErrorStr := ""
@@ -57,6 +68,14 @@ func GetNodeHealth() *utils.NodeStatus {
 		Healthy: storeHealth,
 	}
 
+	// Usage of the cache of app bundles
+	cache, err := appmanager.Instance.CacheUsage()
+	if err != nil {
+		logger.Println("Error while reading the cache usage:", err)
+	} else {
+		health.Cache = cache
+	}
+
 	// Test if the actual apps are responding (just to be sure), but only every 5 minutes
 	health.Health = GetHealthCache()
 
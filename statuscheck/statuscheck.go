@@ -182,23 +182,42 @@ func updateHealthCache() (hasError bool) {
 	requested := 0
 	healthCache = make([]utils.SiteHealth, 0)
 	for _, s := range sites {
+		maintenance := s.Maintenance != nil && s.Maintenance.Enabled
+
 		// Skip sites that have deployment errors
+		// This is checked before maintenance mode, so sites that failed to deploy are reported as unhealthy even while in maintenance
 		if siteErr := state.Instance.GetSiteHealth(s.Domain); siteErr != nil {
 			var appStr *string
 			if s.App != nil {
 				appStr = &s.App.Name
 			}
 			healthCache = append(healthCache, utils.SiteHealth{
-				Domain: s.Domain,
-				App:    appStr,
-				Error:  siteErr.Error(),
+				Domain:      s.Domain,
+				App:         appStr,
+				Maintenance: maintenance,
+				Error:       siteErr.Error(),
+			})
+			continue
+		}
+
+		// Sites in maintenance mode are not requested
+		if maintenance {
+			var appStr *string
+			if s.App != nil {
+				appStr = &s.App.Name
+			}
+			healthCache = append(healthCache, utils.SiteHealth{
+				Domain:      s.Domain,
+				App:         appStr,
+				Maintenance: true,
 			})
 			continue
 		}
 
 		// Request health only if there's an app deployed
-		// Also, skip this if there's a deployment running
-		if s.App != nil && !sync.IsRunning() {
+		// Also, skip this if there's a deployment running, or if the site requires client certificates, as requests would be rejected
+		requiresClientCert := s.TLS != nil && s.TLS.ClientCA != nil && s.TLS.ClientAuth != state.TLSClientAuthOptional
+		if s.App != nil && !sync.IsRunning() && !requiresClientCert {
 			// Check if the jobs channel is full
 			for len(jobs) == cap(jobs) {
 				// Pause this until the channel is not at capacity anymore
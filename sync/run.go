@@ -114,11 +114,12 @@ func runner() error {
 	// Boolean flag for the need to restart the webserver
 	restartRequired := false
 
-	// Get the list of sites
-	sites := state.Instance.GetSites()
+	// Get the list of sites, including the temporary ones for previewing pending apps
+	sites := withPreviewSites(state.Instance.GetSites())
+	defaultSite := state.Instance.GetDefaultSite()
 
 	// First, sync apps
-	res, restartServer, err := appmanager.Instance.SyncState(sites)
+	res, restartServer, err := appmanager.Instance.SyncState(sites, defaultSite)
 	if err != nil {
 		logger.Println("Unrecoverable error while syncing apps:", err)
 
@@ -127,7 +128,7 @@ func runner() error {
 	restartRequired = restartRequired || res
 
 	// Second, sync the web server configuration
-	res, err = webserver.Instance.SyncConfiguration(sites)
+	res, err = webserver.Instance.SyncConfiguration(sites, defaultSite)
 	if err != nil {
 		logger.Println("Error while syncing Nginx configuration:", err)
 
@@ -141,6 +142,9 @@ func runner() error {
 			sendErrorNotification("Site " + s.Domain + " has an error: " + siteErr.Error())
 		}
 	}
+	if siteErr := state.Instance.GetSiteHealth("_default"); siteErr != nil {
+		sendErrorNotification("The default site has an error: " + siteErr.Error())
+	}
 
 	// If we've updated anything that requires restarting nginx, do it
 	if restartRequired {
@@ -169,6 +173,18 @@ func runner() error {
 	return nil
 }
 
+// Returns a new slice with the sites and the temporary sites serving their pending apps
+func withPreviewSites(sites []state.SiteState) []state.SiteState {
+	res := make([]state.SiteState, len(sites), len(sites)+1)
+	copy(res, sites)
+	for _, s := range sites {
+		if preview := s.PreviewSite(); preview != nil {
+			res = append(res, *preview)
+		}
+	}
+	return res
+}
+
 // Send a notification to admins if there's an error
 func sendErrorNotification(message string) {
 	// Launch asynchronously and do not wait for completion
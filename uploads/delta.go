@@ -0,0 +1,507 @@
+/*
+Copyright © 2020 Alessandro Segala (@ItalyPaleAle)
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published
+by the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package uploads
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/statiko-dev/statiko/fs"
+	"github.com/statiko-dev/statiko/utils"
+)
+
+// Errors for delta deploys
+var (
+	ErrBaseNotExist     = errors.New("base bundle does not exist")
+	ErrBlobNotRequested = errors.New("blob is not part of the delta")
+)
+
+// DeltaSession is a deploy that uploads only the files that aren't in a previous bundle
+// The client sends the list of files in the new bundle with their hashes, and uploads the blobs that are missing; the new bundle is then assembled from the previous one plus the delta
+// When code signing is used, the signature is for the files manifest (in the canonical format) rather than for the bundle
+type DeltaSession struct {
+	ID string `json:"id"`
+
+	// Name of the new bundle, and of the bundle it's based on
+	Name string `json:"name"`
+	Base string `json:"base,omitempty"`
+
+	// Files in the new bundle, and the signature of the manifest
+	Files     utils.FilesManifest `json:"files"`
+	Signature string              `json:"signature,omitempty"`
+	KeyID     string              `json:"keyId,omitempty"`
+
+	// Hashes of the blobs that still need to be uploaded
+	Missing []string `json:"missing"`
+
+	Created time.Time `json:"created"`
+	Updated time.Time `json:"updated"`
+}
+
+// CreateDelta starts a delta deploy
+// Files from the base bundle that are in the manifest are kept, so only the missing ones need to be uploaded
+func (m *Manager) CreateDelta(ctx context.Context, name string, base string, files utils.FilesManifest, signature string, keyID string) (*DeltaSession, error) {
+	if err := utils.EnsureFolder(m.path); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	session := &DeltaSession{
+		ID:        uuid.New().String(),
+		Name:      name,
+		Base:      base,
+		Files:     files,
+		Signature: signature,
+		KeyID:     keyID,
+		Created:   now,
+		Updated:   now,
+	}
+	if err := utils.EnsureFolder(m.blobsPath(session.ID)); err != nil {
+		return nil, err
+	}
+
+	// Hashes of the blobs we need
+	needed := make(map[string]bool, len(files))
+	for _, e := range files {
+		needed[e.Hash] = true
+	}
+
+	// Take the blobs we need from the base bundle
+	if base != "" {
+		if err := m.takeBaseBlobs(ctx, session.ID, base, needed); err != nil {
+			m.removeDelta(session.ID)
+			return nil, err
+		}
+	}
+
+	// List the blobs that are still missing
+	session.Missing = make([]string, 0)
+	for hash := range needed {
+		exists, err := utils.FileExists(m.blobsPath(session.ID) + hash)
+		if err != nil {
+			m.removeDelta(session.ID)
+			return nil, err
+		}
+		if !exists {
+			session.Missing = append(session.Missing, hash)
+		}
+	}
+	sort.Strings(session.Missing)
+
+	if err := m.writeDelta(session); err != nil {
+		m.removeDelta(session.ID)
+		return nil, err
+	}
+
+	return session, nil
+}
+
+// GetDelta returns a delta deploy session
+func (m *Manager) GetDelta(id string) (*DeltaSession, error) {
+	// IDs are UUIDs, so they can't contain path separators
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, ErrNotExist
+	}
+
+	read, err := ioutil.ReadFile(m.deltaPath(id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNotExist
+		}
+		return nil, err
+	}
+	session := &DeltaSession{}
+	if err := json.Unmarshal(read, session); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// WriteBlob stores one of the missing blobs of a delta deploy, after verifying its hash
+func (m *Manager) WriteBlob(ctx context.Context, id string, hash string, in io.Reader) (*DeltaSession, error) {
+	if !m.acquire(id) {
+		return nil, ErrBusy
+	}
+	defer m.release(id)
+
+	session, err := m.GetDelta(id)
+	if err != nil {
+		return nil, err
+	}
+	hash = strings.ToLower(hash)
+	pos := sort.SearchStrings(session.Missing, hash)
+	if pos == len(session.Missing) || session.Missing[pos] != hash {
+		return session, ErrBlobNotRequested
+	}
+
+	// The blobs of a session can't exceed "uploads.maxSize" in total, as they're stored on the node until the bundle is assembled
+	limit := int64(-1)
+	if maxSize := m.maxSize(); maxSize > 0 {
+		stored, err := m.blobsSize(id)
+		if err != nil {
+			return nil, err
+		}
+		limit = maxSize - stored
+		if limit < 0 {
+			limit = 0
+		}
+		in = io.LimitReader(in, limit+1)
+	}
+
+	// Write to a temporary file, then rename it once the hash is verified
+	tmp := m.blobsPath(id) + hash + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, h), utils.ReaderFuncWithContext(ctx, in))
+	f.Close()
+	if err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+	if limit >= 0 && n > limit {
+		os.Remove(tmp)
+		return session, ErrTooLarge
+	}
+	if hex.EncodeToString(h.Sum(nil)) != hash {
+		os.Remove(tmp)
+		return session, ErrHashMismatch
+	}
+	if err := os.Rename(tmp, m.blobsPath(id)+hash); err != nil {
+		return nil, err
+	}
+
+	session.Missing = append(session.Missing[:pos], session.Missing[pos+1:]...)
+	session.Updated = time.Now()
+	if err := m.writeDelta(session); err != nil {
+		return nil, err
+	}
+
+	return session, nil
+}
+
+// FinalizeDelta assembles the new bundle once all blobs have been received, then stores it in the repo and removes the session
+// Bundles are tar.gz archives that contain the files manifest too, so nodes can verify the signature and the content of each file
+func (m *Manager) FinalizeDelta(ctx context.Context, id string) error {
+	if !m.acquire(id) {
+		return ErrBusy
+	}
+	defer m.release(id)
+
+	session, err := m.GetDelta(id)
+	if err != nil {
+		return err
+	}
+	if len(session.Missing) > 0 {
+		return ErrIncomplete
+	}
+
+	// The files in the bundle can't exceed "uploads.maxSize" in total, including those that appear more than once
+	if maxSize := m.maxSize(); maxSize > 0 {
+		var total int64
+		for _, e := range session.Files {
+			stat, err := os.Stat(m.blobsPath(id) + e.Hash)
+			if err != nil {
+				return err
+			}
+			total += stat.Size()
+			if total > maxSize {
+				return ErrTooLarge
+			}
+		}
+	}
+
+	// Assemble the bundle
+	f, err := os.Create(m.dataPath(id))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if err := m.writeDeltaBundle(ctx, session, io.MultiWriter(f, h)); err != nil {
+		return err
+	}
+	hashed := h.Sum(nil)
+
+	// Inspect the bundle like uploaded ones, which also checks that it's within the limits for extracting archives
+	size, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	info, err := utils.InspectArchive(f, size, utils.ArchiveTarGz)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidArchive, err)
+	}
+
+	// Store the bundle
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	metadata := map[string]string{
+		"type": "tar.gz",
+		"hash": base64.StdEncoding.EncodeToString(hashed),
+	}
+	info.SetMetadata(metadata)
+	if session.Signature != "" {
+		metadata["signature"] = session.Signature
+		if session.KeyID != "" {
+			// The key was validated when the session was created
+			metadata["keyId"] = session.KeyID
+			metadata["signedTime"] = session.Created.UTC().Format(time.RFC3339)
+		}
+		metadata["signed"] = utils.SignedFilesManifest
+	}
+	if err := fs.Instance.SetWithContext(ctx, session.Name, f, metadata); err != nil {
+		return err
+	}
+
+	return m.removeDelta(id)
+}
+
+// DeleteDelta aborts a delta deploy
+func (m *Manager) DeleteDelta(id string) error {
+	if !m.acquire(id) {
+		return ErrBusy
+	}
+	defer m.release(id)
+
+	if _, err := m.GetDelta(id); err != nil {
+		return err
+	}
+	return m.removeDelta(id)
+}
+
+// Writes the tar.gz archive for a delta deploy, containing all files in the manifest and the manifest itself
+func (m *Manager) writeDeltaBundle(ctx context.Context, session *DeltaSession, out io.Writer) error {
+	gz := gzip.NewWriter(out)
+	tw := tar.NewWriter(gz)
+	now := time.Now()
+
+	writeFile := func(name string, size int64, in io.Reader) error {
+		err := tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     name,
+			Size:     size,
+			Mode:     0644,
+			ModTime:  now,
+		})
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(tw, utils.ReaderFuncWithContext(ctx, in))
+		return err
+	}
+
+	for _, e := range session.Files {
+		blob, err := os.Open(m.blobsPath(session.ID) + e.Hash)
+		if err != nil {
+			return err
+		}
+		stat, err := blob.Stat()
+		if err != nil {
+			blob.Close()
+			return err
+		}
+		err = writeFile(e.Path, stat.Size(), blob)
+		blob.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	manifest := session.Files.Canonical()
+	if err := writeFile(utils.FilesManifestName, int64(len(manifest)), strings.NewReader(string(manifest))); err != nil {
+		return err
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// Extracts the base bundle and moves the files whose hashes are needed to the session's blobs
+func (m *Manager) takeBaseBlobs(ctx context.Context, id string, base string, needed map[string]bool) error {
+	found, data, metadata, err := fs.Instance.Get(base)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return ErrBaseNotExist
+	}
+	defer data.Close()
+
+	// Get the type of the archive
+	var fileType int
+	if typ, ok := metadata["type"]; ok && typ != "" {
+		fileType = utils.ArchiveTypeByExtension("." + typ)
+	} else if utils.StringInSlice(utils.ArchiveExtensions, filepath.Ext(base)) {
+		fileType = utils.ArchiveTypeByExtension(base)
+	} else {
+		return errors.New("cannot determine the type of the base bundle")
+	}
+
+	// Download the archive, then extract it
+	basePath := m.path + id + ".base"
+	defer os.RemoveAll(basePath)
+	defer os.Remove(basePath + ".data")
+	f, err := os.Create(basePath + ".data")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	size, err := io.Copy(f, utils.ReaderFuncWithContext(ctx, data))
+	if err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := utils.EnsureFolder(basePath); err != nil {
+		return err
+	}
+	if err := utils.ExtractArchive(basePath, f, size, fileType); err != nil {
+		return err
+	}
+
+	// Move the files we need
+	return filepath.Walk(basePath, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		hash, err := hashFile(file)
+		if err != nil {
+			return err
+		}
+		if !needed[hash] {
+			return nil
+		}
+		return os.Rename(file, m.blobsPath(id)+hash)
+	})
+}
+
+// Removes expired delta deploy sessions
+func (m *Manager) removeExpiredDeltas(ttl time.Duration) error {
+	files, err := ioutil.ReadDir(m.path)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), ".delta") {
+			continue
+		}
+		id := strings.TrimSuffix(f.Name(), ".delta")
+		session, err := m.GetDelta(id)
+		if err != nil {
+			m.log.Println("Error ignored while reading delta deploy session", id, err)
+			continue
+		}
+		if time.Since(session.Updated) < ttl {
+			continue
+		}
+		if !m.acquire(id) {
+			continue
+		}
+		m.log.Println("Removing abandoned delta deploy session", id)
+		if err := m.removeDelta(id); err != nil {
+			m.log.Println("Error ignored while removing delta deploy session", id, err)
+		}
+		m.release(id)
+	}
+	return nil
+}
+
+// Removes the files of a delta deploy session
+func (m *Manager) removeDelta(id string) error {
+	if err := os.Remove(m.deltaPath(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Remove(m.dataPath(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.RemoveAll(m.blobsPath(id))
+}
+
+// Stores the delta deploy session object on disk
+func (m *Manager) writeDelta(session *DeltaSession) error {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(m.deltaPath(session.ID), data, 0644)
+}
+
+func (m *Manager) deltaPath(id string) string {
+	return m.path + id + ".delta"
+}
+
+func (m *Manager) blobsPath(id string) string {
+	return m.path + id + ".blobs/"
+}
+
+// Returns the total size of the blobs stored for a delta deploy, excluding the ones still being written
+func (m *Manager) blobsSize(id string) (int64, error) {
+	files, err := ioutil.ReadDir(m.blobsPath(id))
+	if err != nil {
+		return 0, err
+	}
+	var size int64
+	for _, f := range files {
+		if !f.IsDir() && !strings.HasSuffix(f.Name(), ".tmp") {
+			size += f.Size()
+		}
+	}
+	return size, nil
+}
+
+// Returns the hex-encoded SHA-256 hash of a file's content
+func hashFile(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,284 @@
+/*
+Copyright © 2020 Alessandro Segala (@ItalyPaleAle)
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published
+by the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package uploads
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/statiko-dev/statiko/appconfig"
+	"github.com/statiko-dev/statiko/fs"
+	"github.com/statiko-dev/statiko/utils"
+)
+
+// Uses a local repo in a temporary folder
+func useTestRepo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "statiko-repo-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	prevPath := appconfig.Config.GetString("repo.local.path")
+	prevInstance := fs.Instance
+	t.Cleanup(func() {
+		appconfig.Config.Set("repo.local.path", prevPath)
+		fs.Instance = prevInstance
+		os.RemoveAll(dir)
+	})
+	appconfig.Config.Set("repo.local.path", dir)
+	fs.Instance, err = fs.Get("local")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testHash(content string) string {
+	h := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(h[:])
+}
+
+func TestDelta(t *testing.T) {
+	m := newTestManager(t)
+	useTestRepo(t)
+	ctx := context.Background()
+
+	// Deltas are run in order, so the bundles created can be used as base for the next ones
+	tests := []struct {
+		name   string
+		bundle string
+		base   string
+		files  map[string]string
+		// Contents of the blobs that must be uploaded
+		missing []string
+		err     error
+	}{
+		{
+			name:    "without a base",
+			bundle:  "app-1.tar.gz",
+			files:   map[string]string{"index.html": "hello", "copy.html": "hello", "css/style.css": "body {}", "_statiko.yaml": "rules: []"},
+			missing: []string{"hello", "body {}", "rules: []"},
+		},
+		{
+			name:    "with a base",
+			bundle:  "app-2.tar.gz",
+			base:    "app-1.tar.gz",
+			files:   map[string]string{"index.html": "hello", "css/style.css": "body { color: red }", "new.txt": "new"},
+			missing: []string{"body { color: red }", "new"},
+		},
+		{
+			name:   "with a base that has all files",
+			bundle: "app-3.tar.gz",
+			base:   "app-2.tar.gz",
+			files:  map[string]string{"home.html": "hello", "new.txt": "new"},
+		},
+		{
+			name:   "base does not exist",
+			bundle: "app-4.tar.gz",
+			base:   "missing.tar.gz",
+			files:  map[string]string{"index.html": "hello"},
+			err:    ErrBaseNotExist,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manifest := utils.FilesManifest{}
+			for name, content := range tt.files {
+				manifest = append(manifest, utils.FilesManifestEntry{Path: name, Hash: testHash(content)})
+			}
+			if err := manifest.Validate(); err != nil {
+				t.Fatal(err)
+			}
+
+			session, err := m.CreateDelta(ctx, tt.bundle, tt.base, manifest, "", "")
+			if err != tt.err {
+				t.Fatalf("expected error %v, got %v", tt.err, err)
+			}
+			if err != nil {
+				return
+			}
+
+			// Check the missing blobs
+			blobs := make(map[string]string, len(tt.missing))
+			missing := make([]string, len(tt.missing))
+			for i, content := range tt.missing {
+				missing[i] = testHash(content)
+				blobs[missing[i]] = content
+			}
+			sort.Strings(missing)
+			if !reflect.DeepEqual(session.Missing, missing) {
+				t.Fatalf("expected missing blobs %v, got %v", missing, session.Missing)
+			}
+
+			// Upload the missing blobs; the bundle can't be finalized until all of them are received
+			for i, hash := range missing {
+				if err := m.FinalizeDelta(ctx, session.ID); err != ErrIncomplete {
+					t.Fatalf("expected ErrIncomplete before uploading blob %d, got %v", i, err)
+				}
+				if _, err := m.WriteBlob(ctx, session.ID, hash, strings.NewReader(blobs[hash]+"!")); err != ErrHashMismatch {
+					t.Fatalf("expected ErrHashMismatch for a modified blob, got %v", err)
+				}
+				if _, err := m.WriteBlob(ctx, session.ID, strings.ToUpper(hash), strings.NewReader(blobs[hash])); err != nil {
+					t.Fatal(err)
+				}
+				if _, err := m.WriteBlob(ctx, session.ID, hash, strings.NewReader(blobs[hash])); err != ErrBlobNotRequested {
+					t.Fatalf("expected ErrBlobNotRequested for a blob already received, got %v", err)
+				}
+			}
+			if err := m.FinalizeDelta(ctx, session.ID); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := m.GetDelta(session.ID); err != ErrNotExist {
+				t.Errorf("expected the session to be removed, got %v", err)
+			}
+
+			// Check the bundle in the repo
+			found, data, metadata, err := fs.Instance.Get(tt.bundle)
+			if err != nil || !found {
+				t.Fatal("bundle not found in the repo", err)
+			}
+			read, err := ioutil.ReadAll(data)
+			data.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			hashed := sha256.Sum256(read)
+			if metadata["type"] != "tar.gz" || metadata["hash"] != base64.StdEncoding.EncodeToString(hashed[:]) {
+				t.Errorf("unexpected metadata %v", metadata)
+			}
+			uncompressedSize := len(manifest.Canonical())
+			for _, content := range tt.files {
+				uncompressedSize += len(content)
+			}
+			_, hasManifest := tt.files[appconfig.Config.GetString("manifestFile")]
+			if metadata["files"] != strconv.Itoa(len(tt.files)+1) || metadata["uncompressedSize"] != strconv.Itoa(uncompressedSize) || metadata["hasManifest"] != strconv.FormatBool(hasManifest) {
+				t.Errorf("unexpected metadata for the content of the bundle %v", metadata)
+			}
+			dst, err := ioutil.TempDir("", "statiko-delta-")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dst)
+			if err := utils.ExtractArchive(dst, bytes.NewReader(read), int64(len(read)), utils.ArchiveTarGz); err != nil {
+				t.Fatal(err)
+			}
+			for name, content := range tt.files {
+				read, err := ioutil.ReadFile(dst + "/" + name)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(read) != content {
+					t.Errorf("file %s has content %q, expected %q", name, string(read), content)
+				}
+			}
+			read, err = ioutil.ReadFile(dst + "/" + utils.FilesManifestName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(read) != string(manifest.Canonical()) {
+				t.Errorf("unexpected files manifest %q", string(read))
+			}
+		})
+	}
+}
+
+func TestDeltaTooLarge(t *testing.T) {
+	m := newTestManager(t)
+	useTestRepo(t)
+	ctx := context.Background()
+
+	prev := appconfig.Config.GetInt("uploads.maxSize")
+	appconfig.Config.Set("uploads.maxSize", 1)
+	defer appconfig.Config.Set("uploads.maxSize", prev)
+
+	large := strings.Repeat("a", 1024*1024+1)
+	half := strings.Repeat("b", 600*1024)
+	otherHalf := strings.Repeat("c", 600*1024)
+	createDelta := func(files map[string]string) *DeltaSession {
+		manifest := utils.FilesManifest{}
+		for name, content := range files {
+			manifest = append(manifest, utils.FilesManifestEntry{Path: name, Hash: testHash(content)})
+		}
+		session, err := m.CreateDelta(ctx, "app.tar.gz", "", manifest, "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return session
+	}
+	noTempFiles := func(id string) {
+		files, err := ioutil.ReadDir(m.blobsPath(id))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range files {
+			if strings.HasSuffix(f.Name(), ".tmp") {
+				t.Errorf("temporary file %s was not removed", f.Name())
+			}
+		}
+	}
+
+	t.Run("blob exceeds the maximum size", func(t *testing.T) {
+		session := createDelta(map[string]string{"large.bin": large})
+		if _, err := m.WriteBlob(ctx, session.ID, testHash(large), strings.NewReader(large)); err != ErrTooLarge {
+			t.Fatalf("expected ErrTooLarge, got %v", err)
+		}
+		noTempFiles(session.ID)
+	})
+
+	t.Run("blobs exceed the maximum size in total", func(t *testing.T) {
+		session := createDelta(map[string]string{"half.bin": half, "other.bin": otherHalf})
+		if _, err := m.WriteBlob(ctx, session.ID, testHash(half), strings.NewReader(half)); err != nil {
+			t.Fatal(err)
+		}
+		session, err := m.WriteBlob(ctx, session.ID, testHash(otherHalf), strings.NewReader(otherHalf))
+		if err != ErrTooLarge {
+			t.Fatalf("expected ErrTooLarge, got %v", err)
+		}
+		if len(session.Missing) != 1 || session.Missing[0] != testHash(otherHalf) {
+			t.Errorf("expected the blob to be still missing, got %v", session.Missing)
+		}
+		noTempFiles(session.ID)
+	})
+
+	t.Run("bundle exceeds the maximum size", func(t *testing.T) {
+		// The same blob is used by two files, so the bundle is larger than the blobs
+		session := createDelta(map[string]string{"half.bin": half, "copy.bin": half})
+		if _, err := m.WriteBlob(ctx, session.ID, testHash(half), strings.NewReader(half)); err != nil {
+			t.Fatal(err)
+		}
+		if err := m.FinalizeDelta(ctx, session.ID); err != ErrTooLarge {
+			t.Fatalf("expected ErrTooLarge, got %v", err)
+		}
+		found, data, _, err := fs.Instance.Get("app.tar.gz")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found {
+			data.Close()
+			t.Error("bundle was stored in the repo")
+		}
+	})
+}
@@ -0,0 +1,358 @@
+/*
+Copyright © 2020 Alessandro Segala (@ItalyPaleAle)
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published
+by the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package uploads
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/statiko-dev/statiko/appconfig"
+	"github.com/statiko-dev/statiko/fs"
+	"github.com/statiko-dev/statiko/utils"
+)
+
+// Status of import jobs
+const (
+	ImportStatusRunning   = "running"
+	ImportStatusCompleted = "completed"
+	ImportStatusFailed    = "failed"
+)
+
+// Errors
+var (
+	ErrAddressNotAllowed = errors.New("address is private, loopback or link-local, and imports from these addresses are not allowed")
+	ErrImportTooLarge    = errors.New("file exceeds the maximum size for imports")
+)
+
+// Time after which import jobs are canceled
+const importTimeout = 2 * time.Hour
+
+// Time for which completed import jobs are kept, so clients can get their result
+const importRetention = time.Hour
+
+// Ranges of addresses that imports can't connect to, unless allowed in the configuration
+var importBlockedNets []*net.IPNet
+
+func init() {
+	for _, cidr := range []string{
+		"0.0.0.0/8",      // "This" network
+		"10.0.0.0/8",     // Private
+		"100.64.0.0/10",  // Carrier-grade NAT
+		"127.0.0.0/8",    // Loopback
+		"169.254.0.0/16", // Link-local
+		"172.16.0.0/12",  // Private
+		"192.168.0.0/16", // Private
+		"224.0.0.0/4",    // Multicast
+		"240.0.0.0/4",    // Reserved
+		"::/128",         // Unspecified
+		"::1/128",        // Loopback
+		"64:ff9b::/96",   // NAT64, which maps to IPv4 addresses
+		"64:ff9b:1::/48", // Local-use NAT64
+		"fc00::/7",       // Unique local
+		"fe80::/10",      // Link-local
+		"ff00::/8",       // Multicast
+	} {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		importBlockedNets = append(importBlockedNets, ipNet)
+	}
+}
+
+// ImportRequest contains the options for importing an app bundle from a URL
+type ImportRequest struct {
+	URL       string
+	Name      string
+	Type      string
+	Signature string
+	// ID of the key in the keyring that created the signature, if any
+	KeyID string
+	// Headers to send with the request, e.g. for authorization
+	Headers map[string]string
+	// Expected SHA-256 hash of the file, if any
+	Hash []byte
+}
+
+// ImportJob is an app bundle being imported from a URL
+type ImportJob struct {
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	Type   string `json:"type"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+
+	// Number of bytes received, and total size if known
+	Received int64 `json:"received"`
+	Size     int64 `json:"size,omitempty"`
+
+	Started   time.Time  `json:"started"`
+	Completed *time.Time `json:"completed,omitempty"`
+}
+
+// Import starts a job that imports an app bundle from a URL, storing it in the repo
+// Jobs run in background on the node that received the request
+func (m *Manager) Import(req ImportRequest) (*ImportJob, error) {
+	// Validate the URL
+	u, err := url.Parse(req.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, errors.New("URL must be an absolute http or https URL")
+	}
+
+	job := &ImportJob{
+		ID:      uuid.New().String(),
+		Name:    req.Name,
+		Type:    req.Type,
+		Status:  ImportStatusRunning,
+		Started: time.Now(),
+	}
+	m.importsLock.Lock()
+	m.imports[job.ID] = job
+	m.importsLock.Unlock()
+
+	go func() {
+		err := m.runImport(job, req)
+
+		m.importsLock.Lock()
+		now := time.Now()
+		job.Completed = &now
+		if err != nil {
+			m.log.Println("Error while importing app", req.Name, err)
+			job.Status = ImportStatusFailed
+			job.Error = err.Error()
+		} else {
+			m.log.Println("Imported app", req.Name)
+			job.Status = ImportStatusCompleted
+		}
+		m.importsLock.Unlock()
+	}()
+
+	return m.GetImport(job.ID), nil
+}
+
+// GetImport returns a copy of an import job, or nil if it doesn't exist
+func (m *Manager) GetImport(id string) *ImportJob {
+	m.importsLock.Lock()
+	defer m.importsLock.Unlock()
+
+	job, ok := m.imports[id]
+	if !ok {
+		return nil
+	}
+	res := *job
+	return &res
+}
+
+// Removes import jobs that were completed longer than the retention period ago
+func (m *Manager) removeExpiredImports() {
+	m.importsLock.Lock()
+	defer m.importsLock.Unlock()
+
+	for id, job := range m.imports {
+		if job.Completed != nil && time.Since(*job.Completed) > importRetention {
+			delete(m.imports, id)
+		}
+	}
+}
+
+// Downloads the file and stores it in the repo
+func (m *Manager) runImport(job *ImportJob, req ImportRequest) error {
+	ctx, cancel := context.WithTimeout(context.Background(), importTimeout)
+	defer cancel()
+
+	// Request the file
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, req.URL, nil)
+	if err != nil {
+		return err
+	}
+	for k, v := range req.Headers {
+		httpReq.Header.Set(k, v)
+	}
+	resp, err := m.importClient().Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("invalid response status code: %d", resp.StatusCode)
+	}
+
+	// Check the size if it's known in advance
+	maxSize := int64(appconfig.Config.GetInt("import.maxSize")) * 1024 * 1024
+	if maxSize > 0 && resp.ContentLength > maxSize {
+		return ErrImportTooLarge
+	}
+	if resp.ContentLength > 0 {
+		m.importsLock.Lock()
+		job.Size = resp.ContentLength
+		m.importsLock.Unlock()
+	}
+
+	// Download the file to disk, computing the hash and keeping track of the progress
+	// The file is stored locally so the archive can be inspected before it's added to the repo
+	if err := utils.EnsureFolder(m.path); err != nil {
+		return err
+	}
+	path := m.path + job.ID + ".import"
+	defer os.Remove(path)
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	in := &importReader{
+		in:      io.TeeReader(resp.Body, h),
+		maxSize: maxSize,
+		progress: func(n int64) {
+			m.importsLock.Lock()
+			job.Received = n
+			m.importsLock.Unlock()
+		},
+	}
+	size, err := io.Copy(f, in)
+	if err != nil {
+		return err
+	}
+
+	// Verify the hash, if any
+	hashed := h.Sum(nil)
+	if req.Hash != nil && !bytes.Equal(hashed, req.Hash) {
+		return fmt.Errorf("hash does not match: got %x, wanted %x", hashed, req.Hash)
+	}
+
+	// Ensure the archive can be opened for the declared type, and store information on its contents
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	info, err := utils.InspectArchive(f, size, utils.ArchiveTypeByExtension("."+req.Type))
+	if err != nil {
+		return fmt.Errorf("file is not a valid archive of type %s: %v", req.Type, err)
+	}
+	metadata := map[string]string{
+		"type": req.Type,
+		"hash": base64.StdEncoding.EncodeToString(hashed),
+	}
+	info.SetMetadata(metadata)
+	if req.Signature != "" {
+		metadata["signature"] = req.Signature
+		if req.KeyID != "" {
+			// The key was validated when the job was started
+			metadata["keyId"] = req.KeyID
+			metadata["signedTime"] = job.Started.UTC().Format(time.RFC3339)
+		}
+	}
+
+	// Store the file in the repo
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	err = fs.Instance.SetWithContext(ctx, req.Name, f, metadata)
+	if err != nil {
+		// Remove partially-written files, unless the file existed already
+		if err != fs.ErrExist {
+			m.deleteImported(req.Name)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// Removes a file that failed to import from the repo
+func (m *Manager) deleteImported(name string) {
+	if err := fs.Instance.Delete(name); err != nil && err != fs.ErrNotExist {
+		m.log.Println("Error ignored while removing file that failed to import", name, err)
+	}
+}
+
+// Returns the HTTP client used for imports
+// Unless allowed in the configuration, the client refuses to connect to private, loopback and link-local addresses; this is checked on every connection, including redirects, after the host name is resolved
+func (m *Manager) importClient() *http.Client {
+	allowPrivate := appconfig.Config.GetBool("import.allowPrivateAddresses")
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control: func(network, address string, c syscall.RawConn) error {
+			if allowPrivate {
+				return nil
+			}
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if !importAddressAllowed(net.ParseIP(host)) {
+				return ErrAddressNotAllowed
+			}
+			return nil
+		},
+	}
+
+	// Proxies from the environment are not used, as the addresses of the servers can't be checked
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:                 nil,
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ResponseHeaderTimeout: 30 * time.Second,
+		},
+	}
+}
+
+// Returns true if imports can connect to the address
+func importAddressAllowed(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range importBlockedNets {
+		if ipNet.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// Reader that enforces the maximum size of imports and reports the progress
+type importReader struct {
+	in       io.Reader
+	maxSize  int64
+	read     int64
+	progress func(n int64)
+}
+
+func (r *importReader) Read(p []byte) (int, error) {
+	n, err := r.in.Read(p)
+	r.read += int64(n)
+	if r.maxSize > 0 && r.read > r.maxSize {
+		return n, ErrImportTooLarge
+	}
+	r.progress(r.read)
+	return n, err
+}
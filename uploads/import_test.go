@@ -0,0 +1,139 @@
+/*
+Copyright © 2020 Alessandro Segala (@ItalyPaleAle)
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published
+by the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package uploads
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/statiko-dev/statiko/appconfig"
+)
+
+func TestImportAddressAllowed(t *testing.T) {
+	tests := []struct {
+		name    string
+		ip      string
+		allowed bool
+	}{
+		{name: "public IPv4", ip: "93.184.216.34", allowed: true},
+		{name: "public IPv6", ip: "2606:2800:220:1:248:1893:25c8:1946", allowed: true},
+		{name: "unspecified IPv4", ip: "0.0.0.0"},
+		{name: "this network", ip: "0.1.2.3"},
+		{name: "loopback IPv4", ip: "127.0.0.1"},
+		{name: "loopback IPv4 range", ip: "127.255.0.1"},
+		{name: "private 10/8", ip: "10.1.2.3"},
+		{name: "private 172.16/12", ip: "172.31.255.255"},
+		{name: "outside of private 172.16/12", ip: "172.32.0.1", allowed: true},
+		{name: "private 192.168/16", ip: "192.168.1.1"},
+		{name: "carrier-grade NAT", ip: "100.64.0.1"},
+		{name: "link-local IPv4", ip: "169.254.169.254"},
+		{name: "multicast IPv4", ip: "224.0.0.1"},
+		{name: "reserved IPv4", ip: "240.0.0.1"},
+		{name: "broadcast", ip: "255.255.255.255"},
+		{name: "unspecified IPv6", ip: "::"},
+		{name: "loopback IPv6", ip: "::1"},
+		{name: "unique local IPv6", ip: "fd00::1"},
+		{name: "link-local IPv6", ip: "fe80::1"},
+		{name: "multicast IPv6", ip: "ff02::1"},
+		{name: "IPv4-mapped loopback", ip: "::ffff:127.0.0.1"},
+		{name: "IPv4-mapped private", ip: "::ffff:10.0.0.1"},
+		{name: "IPv4-mapped link-local", ip: "::ffff:169.254.169.254"},
+		{name: "IPv4-mapped public", ip: "::ffff:93.184.216.34", allowed: true},
+		{name: "NAT64 loopback", ip: "64:ff9b::7f00:1"},
+		{name: "NAT64 private", ip: "64:ff9b::a00:1"},
+		{name: "NAT64 with a public address", ip: "64:ff9b::5db8:d822"},
+		{name: "local-use NAT64", ip: "64:ff9b:1::a00:1"},
+		{name: "nil", ip: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ip := net.ParseIP(tt.ip)
+			if tt.ip != "" && ip == nil {
+				t.Fatalf("invalid IP in test: %s", tt.ip)
+			}
+			if allowed := importAddressAllowed(ip); allowed != tt.allowed {
+				t.Errorf("expected %v, got %v", tt.allowed, allowed)
+			}
+		})
+	}
+}
+
+func TestImportClientRedirect(t *testing.T) {
+	m := newTestManager(t)
+
+	prev := appconfig.Config.GetBool("import.allowPrivateAddresses")
+	appconfig.Config.Set("import.allowPrivateAddresses", false)
+	defer appconfig.Config.Set("import.allowPrivateAddresses", prev)
+
+	// The servers can only listen on loopback addresses, so only 127.0.0.1 is blocked in this test
+	prevNets := importBlockedNets
+	importBlockedNets = []*net.IPNet{{IP: net.IPv4(127, 0, 0, 1), Mask: net.CIDRMask(32, 32)}}
+	defer func() {
+		importBlockedNets = prevNets
+	}()
+
+	// Server on a blocked address
+	requested := false
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = true
+	}))
+	defer target.Close()
+
+	// Server on an allowed address, which redirects to the blocked one
+	l, err := net.Listen("tcp", "127.0.0.2:0")
+	if err != nil {
+		t.Skip("cannot listen on 127.0.0.2:", err)
+	}
+	redirect := httptest.NewUnstartedServer(http.RedirectHandler(target.URL+"/app.tar.gz", http.StatusFound))
+	redirect.Listener.Close()
+	redirect.Listener = l
+	redirect.Start()
+	defer redirect.Close()
+
+	client := m.importClient()
+
+	// Requests to the blocked address fail, directly or after a redirect
+	for _, url := range []string{target.URL, redirect.URL} {
+		resp, err := client.Get(url)
+		if err == nil {
+			resp.Body.Close()
+			t.Errorf("expected an error for %s", url)
+			continue
+		}
+		if !errors.Is(err, ErrAddressNotAllowed) {
+			t.Errorf("expected ErrAddressNotAllowed for %s, got %v", url, err)
+		}
+	}
+	if requested {
+		t.Error("the blocked server received a request")
+	}
+
+	// The redirecting server itself is allowed
+	importBlockedNets = []*net.IPNet{}
+	resp, err := client.Get(redirect.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if !requested {
+		t.Error("the redirect was not followed")
+	}
+}
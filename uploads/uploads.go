@@ -0,0 +1,384 @@
+/*
+Copyright © 2020 Alessandro Segala (@ItalyPaleAle)
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published
+by the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package uploads
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/statiko-dev/statiko/appconfig"
+	"github.com/statiko-dev/statiko/fs"
+	"github.com/statiko-dev/statiko/utils"
+)
+
+// Errors
+var (
+	ErrNotExist       = errors.New("upload session does not exist")
+	ErrBusy           = errors.New("upload session is busy")
+	ErrOffsetMismatch = errors.New("offset does not match the data received so far")
+	ErrSizeExceeded   = errors.New("data exceeds the declared size of the upload")
+	ErrTooLarge       = errors.New("file exceeds the maximum size for uploads")
+	ErrIncomplete     = errors.New("upload is incomplete")
+	ErrHashMismatch   = errors.New("hash does not match the data received")
+	ErrInvalidArchive = errors.New("file is not a valid archive of the declared type")
+)
+
+// Session is a resumable upload of an app bundle
+// The data is stored on the node that received the session's request, until the upload is finalized and the bundle is stored in the repo
+type Session struct {
+	ID string `json:"id"`
+
+	// Details of the app bundle
+	Name      string `json:"name"`
+	Type      string `json:"type"`
+	Signature string `json:"signature,omitempty"`
+	KeyID     string `json:"keyId,omitempty"`
+
+	// Total size of the bundle, and number of bytes received so far
+	Size   int64 `json:"size"`
+	Offset int64 `json:"offset"`
+
+	Created time.Time `json:"created"`
+	Updated time.Time `json:"updated"`
+}
+
+// Manager handles upload sessions, which are stored in the "uploads" folder in the app root, and jobs importing bundles from URLs
+type Manager struct {
+	path string
+	log  *log.Logger
+
+	// Sessions that are currently receiving data or being finalized
+	busy     map[string]bool
+	busyLock sync.Mutex
+
+	// Jobs importing bundles from URLs
+	imports     map[string]*ImportJob
+	importsLock sync.Mutex
+}
+
+// Init the object
+func (m *Manager) Init() error {
+	// Logger
+	m.log = log.New(os.Stdout, "uploads: ", log.Ldate|log.Ltime|log.LUTC)
+
+	// Folder where sessions are stored
+	appRoot := appconfig.Config.GetString("appRoot")
+	if !strings.HasSuffix(appRoot, "/") {
+		appRoot += "/"
+	}
+	m.path = appRoot + "uploads/"
+
+	m.busy = make(map[string]bool)
+	m.imports = make(map[string]*ImportJob)
+
+	return nil
+}
+
+// Create starts a new upload session
+// The declared size can't exceed "uploads.maxSize" (in MB), as the data is stored on the node until the upload is finalized
+func (m *Manager) Create(name string, typ string, size int64, signature string, keyID string) (*Session, error) {
+	if maxSize := m.maxSize(); maxSize > 0 && size > maxSize {
+		return nil, ErrTooLarge
+	}
+
+	if err := utils.EnsureFolder(m.path); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	session := &Session{
+		ID:        uuid.New().String(),
+		Name:      name,
+		Type:      typ,
+		Signature: signature,
+		KeyID:     keyID,
+		Size:      size,
+		Created:   now,
+		Updated:   now,
+	}
+
+	// Create an empty file for the data, then store the session
+	f, err := os.Create(m.dataPath(session.ID))
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	if err := m.writeSession(session); err != nil {
+		return nil, err
+	}
+
+	return session, nil
+}
+
+// Get returns an upload session
+func (m *Manager) Get(id string) (*Session, error) {
+	// IDs are UUIDs, so they can't contain path separators
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, ErrNotExist
+	}
+
+	read, err := ioutil.ReadFile(m.sessionPath(id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNotExist
+		}
+		return nil, err
+	}
+	session := &Session{}
+	if err := json.Unmarshal(read, session); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// WriteChunk appends data to an upload session
+// The offset must match the number of bytes received so far; after an interrupted request, clients can get the session to know where to resume from
+func (m *Manager) WriteChunk(ctx context.Context, id string, offset int64, in io.Reader) (*Session, error) {
+	if !m.acquire(id) {
+		return nil, ErrBusy
+	}
+	defer m.release(id)
+
+	session, err := m.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if offset != session.Offset {
+		return session, ErrOffsetMismatch
+	}
+
+	// Data from interrupted requests is truncated, so the file is consistent with the session's offset
+	f, err := os.OpenFile(m.dataPath(id), os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if err := f.Truncate(session.Offset); err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(session.Offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	// Read up to one byte more than what's left, to detect when the declared size is exceeded
+	remaining := session.Size - session.Offset
+	n, err := io.Copy(f, utils.ReaderFuncWithContext(ctx, io.LimitReader(in, remaining+1)))
+	if err != nil {
+		return nil, err
+	}
+	if n > remaining {
+		return session, ErrSizeExceeded
+	}
+	if err := f.Sync(); err != nil {
+		return nil, err
+	}
+
+	session.Offset += n
+	session.Updated = time.Now()
+	if err := m.writeSession(session); err != nil {
+		return nil, err
+	}
+
+	return session, nil
+}
+
+// Finalize verifies the hash of an upload session's data and that it's a valid archive, then stores the bundle in the repo and removes the session
+func (m *Manager) Finalize(ctx context.Context, id string, hash []byte) error {
+	if !m.acquire(id) {
+		return ErrBusy
+	}
+	defer m.release(id)
+
+	session, err := m.Get(id)
+	if err != nil {
+		return err
+	}
+	if session.Offset != session.Size {
+		return ErrIncomplete
+	}
+
+	// Verify the hash while inspecting the archive
+	f, err := os.Open(m.dataPath(id))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	hashed, info, err := utils.HashInspectArchive(f, session.Size, utils.ArchiveTypeByExtension("."+session.Type))
+	if hashed == nil {
+		return err
+	}
+	if !bytes.Equal(hashed, hash) {
+		m.log.Printf("Hash mismatch for upload %s: got %x, wanted %x\n", id, hashed, hash)
+		return ErrHashMismatch
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidArchive, err)
+	}
+
+	// Store the bundle
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	metadata := map[string]string{
+		"type": session.Type,
+		"hash": base64.StdEncoding.EncodeToString(hashed),
+	}
+	info.SetMetadata(metadata)
+	if session.Signature != "" {
+		metadata["signature"] = session.Signature
+		if session.KeyID != "" {
+			// The key was validated when the session was created
+			metadata["keyId"] = session.KeyID
+			metadata["signedTime"] = session.Created.UTC().Format(time.RFC3339)
+		}
+	}
+	if err := fs.Instance.SetWithContext(ctx, session.Name, f, metadata); err != nil {
+		return err
+	}
+
+	return m.remove(id)
+}
+
+// Delete aborts an upload session
+func (m *Manager) Delete(id string) error {
+	if !m.acquire(id) {
+		return ErrBusy
+	}
+	defer m.release(id)
+
+	if _, err := m.Get(id); err != nil {
+		return err
+	}
+	return m.remove(id)
+}
+
+// RemoveExpired removes upload and delta deploy sessions that haven't received data for longer than the configured TTL, and import jobs completed long ago
+func (m *Manager) RemoveExpired() error {
+	m.removeExpiredImports()
+
+	ttl := appconfig.Config.GetDuration("uploads.sessionTTL")
+	if ttl <= 0 {
+		return nil
+	}
+
+	exists, err := utils.FolderExists(m.path)
+	if err != nil || !exists {
+		return err
+	}
+	files, err := ioutil.ReadDir(m.path)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		// Files downloaded by import jobs are removed when the jobs end, so they're left behind only if the process was terminated
+		if strings.HasSuffix(f.Name(), ".import") {
+			if time.Since(f.ModTime()) > importTimeout {
+				m.log.Println("Removing abandoned import file", f.Name())
+				if err := os.Remove(m.path + f.Name()); err != nil {
+					m.log.Println("Error ignored while removing import file", f.Name(), err)
+				}
+			}
+			continue
+		}
+		if !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		id := strings.TrimSuffix(f.Name(), ".json")
+		session, err := m.Get(id)
+		if err != nil {
+			m.log.Println("Error ignored while reading upload session", id, err)
+			continue
+		}
+		if time.Since(session.Updated) < ttl {
+			continue
+		}
+		if !m.acquire(id) {
+			continue
+		}
+		m.log.Println("Removing abandoned upload session", id)
+		if err := m.remove(id); err != nil {
+			m.log.Println("Error ignored while removing upload session", id, err)
+		}
+		m.release(id)
+	}
+
+	return m.removeExpiredDeltas(ttl)
+}
+
+// Removes the files of an upload session
+func (m *Manager) remove(id string) error {
+	if err := os.Remove(m.sessionPath(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Remove(m.dataPath(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Stores the session object on disk
+func (m *Manager) writeSession(session *Session) error {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(m.sessionPath(session.ID), data, 0644)
+}
+
+// Marks a session as busy, returning false if it's already busy
+func (m *Manager) acquire(id string) bool {
+	m.busyLock.Lock()
+	defer m.busyLock.Unlock()
+	if m.busy[id] {
+		return false
+	}
+	m.busy[id] = true
+	return true
+}
+
+// Marks a session as not busy anymore
+func (m *Manager) release(id string) {
+	m.busyLock.Lock()
+	delete(m.busy, id)
+	m.busyLock.Unlock()
+}
+
+// Returns the maximum size of uploads in bytes, from "uploads.maxSize" (in MB), or 0 if there's no limit
+func (m *Manager) maxSize() int64 {
+	return int64(appconfig.Config.GetInt("uploads.maxSize")) * 1024 * 1024
+}
+
+func (m *Manager) sessionPath(id string) string {
+	return m.path + id + ".json"
+}
+
+func (m *Manager) dataPath(id string) string {
+	return m.path + id + ".data"
+}
@@ -0,0 +1,240 @@
+/*
+Copyright © 2020 Alessandro Segala (@ItalyPaleAle)
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published
+by the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package uploads
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/statiko-dev/statiko/appconfig"
+	"github.com/statiko-dev/statiko/fs"
+)
+
+// Returns a manager that stores sessions in a temporary folder
+func newTestManager(t *testing.T) *Manager {
+	dir, err := ioutil.TempDir("", "statiko-uploads-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.RemoveAll(dir)
+	})
+	m := &Manager{}
+	if err := m.Init(); err != nil {
+		t.Fatal(err)
+	}
+	m.path = dir + "/"
+	return m
+}
+
+func TestCreate(t *testing.T) {
+	m := newTestManager(t)
+
+	prev := appconfig.Config.GetInt("uploads.maxSize")
+	appconfig.Config.Set("uploads.maxSize", 1)
+	defer appconfig.Config.Set("uploads.maxSize", prev)
+
+	if _, err := m.Create("app.tar.gz", "tar.gz", 1024*1024, "", ""); err != nil {
+		t.Errorf("unexpected error for an upload within the maximum size: %v", err)
+	}
+	if _, err := m.Create("app.tar.gz", "tar.gz", 1024*1024+1, "", ""); err != ErrTooLarge {
+		t.Errorf("expected ErrTooLarge for an upload over the maximum size, got %v", err)
+	}
+}
+
+func TestWriteChunk(t *testing.T) {
+	type chunk struct {
+		offset int64
+		data   string
+		// Data left in the file by an interrupted request, written before the chunk
+		garbage string
+		// Expected error and offset after the chunk
+		err        error
+		wantOffset int64
+	}
+
+	tests := []struct {
+		name   string
+		size   int64
+		chunks []chunk
+		// Expected data in the session's file at the end
+		wantData string
+	}{
+		{
+			name: "chunks in order",
+			size: 10,
+			chunks: []chunk{
+				{offset: 0, data: "hello", wantOffset: 5},
+				{offset: 5, data: "world", wantOffset: 10},
+			},
+			wantData: "helloworld",
+		},
+		{
+			name: "chunk out of order",
+			size: 10,
+			chunks: []chunk{
+				{offset: 5, data: "world", err: ErrOffsetMismatch, wantOffset: 0},
+				{offset: 0, data: "hello", wantOffset: 5},
+				{offset: 5, data: "world", wantOffset: 10},
+			},
+			wantData: "helloworld",
+		},
+		{
+			name: "duplicate chunk",
+			size: 10,
+			chunks: []chunk{
+				{offset: 0, data: "hello", wantOffset: 5},
+				{offset: 0, data: "hello", err: ErrOffsetMismatch, wantOffset: 5},
+				{offset: 5, data: "world", wantOffset: 10},
+				{offset: 5, data: "world", err: ErrOffsetMismatch, wantOffset: 10},
+			},
+			wantData: "helloworld",
+		},
+		{
+			name: "resume after an interrupted request",
+			size: 10,
+			chunks: []chunk{
+				{offset: 0, data: "hello", wantOffset: 5},
+				{offset: 5, data: "world", garbage: "wor", wantOffset: 10},
+			},
+			wantData: "helloworld",
+		},
+		{
+			name: "chunk exceeds the declared size",
+			size: 10,
+			chunks: []chunk{
+				{offset: 0, data: "hello", wantOffset: 5},
+				{offset: 5, data: "world!", err: ErrSizeExceeded, wantOffset: 5},
+				{offset: 5, data: "world", wantOffset: 10},
+			},
+			wantData: "helloworld",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestManager(t)
+			session, err := m.Create("app.tar.gz", "tar.gz", tt.size, "", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for i, c := range tt.chunks {
+				if c.garbage != "" {
+					f, err := os.OpenFile(m.dataPath(session.ID), os.O_WRONLY|os.O_APPEND, 0644)
+					if err != nil {
+						t.Fatal(err)
+					}
+					f.WriteString(c.garbage)
+					f.Close()
+				}
+
+				_, err := m.WriteChunk(context.Background(), session.ID, c.offset, strings.NewReader(c.data))
+				if err != c.err {
+					t.Fatalf("chunk %d: expected error %v, got %v", i, c.err, err)
+				}
+				got, err := m.Get(session.ID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got.Offset != c.wantOffset {
+					t.Fatalf("chunk %d: expected offset %d, got %d", i, c.wantOffset, got.Offset)
+				}
+			}
+
+			read, err := ioutil.ReadFile(m.dataPath(session.ID))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(read) != tt.wantData {
+				t.Errorf("expected data %q, got %q", tt.wantData, string(read))
+			}
+		})
+	}
+}
+
+func TestFinalize(t *testing.T) {
+	m := newTestManager(t)
+	useTestRepo(t)
+	ctx := context.Background()
+
+	// Tar archive with a single file
+	archive := &bytes.Buffer{}
+	tw := tar.NewWriter(archive)
+	if err := tw.WriteHeader(&tar.Header{Name: "index.html", Typeflag: tar.TypeReg, Mode: 0644, Size: 5}); err != nil {
+		t.Fatal(err)
+	}
+	tw.Write([]byte("hello"))
+	tw.Close()
+
+	tests := []struct {
+		name string
+		data []byte
+		// Hash passed to Finalize, if different from the data's
+		hash []byte
+		err  error
+	}{
+		{name: "valid archive", data: archive.Bytes()},
+		{name: "hash mismatch", data: archive.Bytes(), hash: make([]byte, 32), err: ErrHashMismatch},
+		{name: "invalid archive", data: []byte("not an archive"), err: ErrInvalidArchive},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name := "app-" + strconv.Itoa(i) + ".tar"
+			session, err := m.Create(name, "tar", int64(len(tt.data)), "", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := m.WriteChunk(ctx, session.ID, 0, bytes.NewReader(tt.data)); err != nil {
+				t.Fatal(err)
+			}
+			hash := tt.hash
+			if hash == nil {
+				h := sha256.Sum256(tt.data)
+				hash = h[:]
+			}
+
+			err = m.Finalize(ctx, session.ID, hash)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("expected error %v, got %v", tt.err, err)
+			}
+			if err != nil {
+				// Bundles are stored only if they're valid
+				if _, err := fs.Instance.GetMetadata(name); err != fs.ErrNotExist {
+					t.Errorf("expected the bundle not to be stored, got %v", err)
+				}
+				return
+			}
+			metadata, err := fs.Instance.GetMetadata(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if metadata["type"] != "tar" || metadata["files"] != "1" || metadata["uncompressedSize"] != "5" || metadata["hasManifest"] != "false" {
+				t.Errorf("unexpected metadata %v", metadata)
+			}
+		})
+	}
+}
@@ -18,11 +18,69 @@ package utils
 
 // ManifestRuleOptions is used by the AppManifest struct to represent options for a specific location or file type
 type ManifestRuleOptions struct {
-	Deny          bool              `yaml:"deny"`
-	ClientCaching string            `yaml:"clientCaching"`
-	Headers       map[string]string `yaml:"headers"`
-	CleanHeaders  map[string]string `yaml:"-"`
-	Proxy         string            `yaml:"proxy"`
+	Deny          bool                  `yaml:"deny"`
+	ClientCaching string                `yaml:"clientCaching"`
+	Headers       map[string]string     `yaml:"headers"`
+	CleanHeaders  map[string]string     `yaml:"-"`
+	Proxy         string                `yaml:"proxy"`
+	ProxyOptions  *ManifestProxyOptions `yaml:"proxyOptions"`
+	// Name of an upstream group defined in the manifest to proxy requests to; this is an alternative to "proxy"
+	Upstream string `yaml:"upstream"`
+	// Limit the rate of requests from each client; this replaces the site's rate limit for matching requests
+	RateLimit *RateLimit `yaml:"rateLimit"`
+	// CORS policy
+	CORS *ManifestCORS `yaml:"cors"`
+	// If true, requests must present a client certificate verified by the site's client CA
+	RequireClientCert bool `yaml:"requireClientCert"`
+
+	// Internal
+	// Value for the Set-Cookie header that keeps visitors on the same app during canary releases
+	CanaryCookie string `yaml:"-"`
+}
+
+// ManifestProxyOptions contains the options for rules that proxy requests to an upstream server
+type ManifestProxyOptions struct {
+	// Headers to set (or override) in the request sent to the upstream server, such as "Host"
+	Headers      map[string]string `yaml:"headers"`
+	CleanHeaders map[string]string `yaml:"-"`
+	// Timeouts for establishing a connection with the upstream and for reading a response from it, e.g. "30s" or "5m"
+	ConnectTimeout string `yaml:"connectTimeout"`
+	ReadTimeout    string `yaml:"readTimeout"`
+	// If true, allows upgrading connections to WebSockets
+	WebSocket bool `yaml:"websocket"`
+	// Set to false to disable buffering of responses from the upstream server
+	Buffering      *bool  `yaml:"buffering"`
+	CleanBuffering string `yaml:"-"`
+	// If true, the TLS certificate of the upstream server is verified (for "https" upstreams only)
+	TLSVerify bool `yaml:"tlsVerify"`
+	// Name of the upstream server used for SNI and for verifying the certificate, if different from the host in the URL
+	TLSServerName string `yaml:"tlsServerName"`
+}
+
+// ManifestUpstream is a group of backend servers that rules can proxy requests to
+type ManifestUpstream struct {
+	// Load balancing method: "leastConn", "ipHash" or "random"; default is round-robin
+	Method      string `yaml:"method"`
+	CleanMethod string `yaml:"-"`
+	// If true, requests are proxied to the servers using HTTPS
+	// To verify the servers' certificates, set "tlsServerName" in the proxy options of the rules
+	TLS bool `yaml:"tls"`
+	// List of servers
+	Servers []ManifestUpstreamServer `yaml:"servers"`
+}
+
+// ManifestUpstreamServer is a server in an upstream group
+type ManifestUpstreamServer struct {
+	// Address of the server, as "host" or "host:port"
+	Address string `yaml:"address"`
+	// Weight of the server; default is 1
+	Weight int `yaml:"weight"`
+	// Backup servers receive requests only when all the other ones are unavailable
+	Backup bool `yaml:"backup"`
+	// Passive health checks: a server is considered unavailable for "failTimeout" after "maxFails" unsuccessful attempts within "failTimeout"
+	// Defaults are 1 and "10s"
+	MaxFails    int    `yaml:"maxFails"`
+	FailTimeout string `yaml:"failTimeout"`
 }
 
 // ManifestRule is the dictionary with rules
@@ -42,6 +100,122 @@ type ManifestRule struct {
 	Options ManifestRuleOptions `yaml:"options"`
 }
 
+// ManifestRedirect is a rule that redirects clients to another URL
+type ManifestRedirect struct {
+	// Only one of "exact", "prefix" and "match" can be set, and they behave like in ManifestRule
+	Exact         string `yaml:"exact"`
+	Prefix        string `yaml:"prefix"`
+	Match         string `yaml:"match"`
+	CaseSensitive bool   `yaml:"caseSensitive"`
+	// Destination of the redirect: a path or a full URL, which can be external
+	// With "prefix", the rest of the request's path is appended to the destination
+	// With "match", the destination can contain references to capture groups ($1, $2, etc)
+	To string `yaml:"to"`
+	// Status code: 301 (default), 302, 307 or 308
+	Status int `yaml:"status"`
+	// If true, the query string of the request is appended to the destination
+	PreserveQuery bool `yaml:"preserveQuery"`
+}
+
+// ManifestBulkRedirects contains a table of redirects from exact paths
+// The table is compiled into a map, which is efficient even with thousands of redirects
+type ManifestBulkRedirects struct {
+	// Status code: 301 (default), 302, 307 or 308
+	Status int `yaml:"status"`
+	// If true, the query string of the request is appended to the destination
+	PreserveQuery bool `yaml:"preserveQuery"`
+	// Map of paths and their destinations
+	Map      map[string]string `yaml:"map"`
+	CleanMap map[string]string `yaml:"-"`
+	// Name of the variable containing the result of the lookup
+	Variable string `yaml:"-"`
+}
+
+// ManifestRedirects contains the redirects for the app
+type ManifestRedirects struct {
+	Rules []ManifestRedirect     `yaml:"rules"`
+	Bulk  *ManifestBulkRedirects `yaml:"bulk"`
+}
+
+// ManifestRedirectLocation is a location block (in order) that returns a redirect
+type ManifestRedirectLocation struct {
+	Location string
+	Return   string
+	// For "prefix" redirects, regular expression that captures the rest of the path, used as $1 in Return
+	Capture string
+}
+
+// ManifestI18n contains the options for redirecting visitors to the version of the site in their language
+type ManifestI18n struct {
+	// List of available languages, such as "en" or "pt-br"; each one is served from a folder with the same name, e.g. "/en/"
+	Languages []string `yaml:"languages"`
+	// Default language, used when the client doesn't accept any of the available ones
+	Default string `yaml:"default"`
+	// Name of a cookie that, if set, overrides the language requested by the client
+	Cookie string `yaml:"cookie"`
+
+	// Internal
+	// Entries of the map that matches the Accept-Language header to the languages, in order
+	MapEntries []string `yaml:"-"`
+	// Names of the variables containing the language
+	AcceptVariable string `yaml:"-"`
+	Variable       string `yaml:"-"`
+}
+
+// ManifestCORS contains the CORS policy for a rule
+type ManifestCORS struct {
+	// List of allowed origins, such as "https://example.com"; use "https://*.example.com" to allow all subdomains, or "*" to allow any origin
+	Origins []string `yaml:"origins"`
+	// Allowed methods; default is GET and HEAD
+	Methods []string `yaml:"methods"`
+	// Allowed request headers
+	Headers []string `yaml:"headers"`
+	// Response headers that clients can read
+	ExposeHeaders []string `yaml:"exposeHeaders"`
+	// Allow requests with credentials (cookies, authorization headers, or TLS client certificates)
+	Credentials bool `yaml:"credentials"`
+	// Time, in seconds, that clients can cache the results of preflight requests
+	MaxAge int `yaml:"maxAge"`
+
+	// Internal
+	// Value for the Access-Control-Allow-Origin header: "*" or the name of the variable that contains the origin if it's allowed
+	AllowOrigin string `yaml:"-"`
+	// Name of the variable and entries of the map that matches the Origin header to the allowed origins
+	Variable   string   `yaml:"-"`
+	MapEntries []string `yaml:"-"`
+	// Lists of methods and headers, comma-separated
+	CleanMethods       string `yaml:"-"`
+	CleanHeaders       string `yaml:"-"`
+	CleanExposeHeaders string `yaml:"-"`
+}
+
+// RateLimit contains the options for limiting the rate of requests from each client IP
+// It's used by both sites and rules in the app manifest
+type RateLimit struct {
+	// Requests per second allowed
+	Rate int `json:"rate" yaml:"rate"`
+	// Number of requests that can exceed the rate before they're rejected
+	Burst int `json:"burst,omitempty" yaml:"burst"`
+	// If true, requests within the burst are not delayed
+	NoDelay bool `json:"noDelay,omitempty" yaml:"noDelay"`
+	// Status code returned for requests that are rejected; default is 429
+	Status int `json:"status,omitempty" yaml:"status"`
+
+	// Internal
+	// Name of the shared memory zone
+	Zone string `json:"-" yaml:"-"`
+}
+
+// RateLimitMax is the maximum value for the rate and the burst of rate limits
+const RateLimitMax = 100000
+
+// Validate returns true if the rate, burst and status of the rate limit are valid
+func (r *RateLimit) Validate() bool {
+	return r.Rate >= 1 && r.Rate <= RateLimitMax &&
+		r.Burst >= 0 && r.Burst <= RateLimitMax &&
+		(r.Status == 0 || (r.Status >= 400 && r.Status <= 599))
+}
+
 // ManifestRules is a slice of ManifestRule structs
 type ManifestRules []ManifestRule
 
@@ -52,6 +226,37 @@ type AppManifest struct {
 	Page403 string            `yaml:"page403"`
 	Page404 string            `yaml:"page404"`
 
+	// Custom error pages: keys are status codes (e.g. "404"), ranges ("5xx") or comma-separated lists of them ("502,504"), and values are paths of files in the app
+	// Page403 and Page404 are shorthands for the "403" and "404" keys
+	ErrorPages map[string]string `yaml:"errorPages"`
+
+	// Upstream groups, which rules can proxy requests to
+	Upstreams map[string]ManifestUpstream `yaml:"upstreams"`
+
+	// Redirects
+	Redirects ManifestRedirects `yaml:"redirects"`
+
+	// Redirect requests for the root to the folder of the visitor's language
+	I18n *ManifestI18n `yaml:"i18n"`
+
 	// Internal
-	Locations map[string]ManifestRuleOptions `yaml:"-"`
+	Locations          map[string]ManifestRuleOptions `yaml:"-"`
+	CleanUpstreams     map[string]ManifestUpstream    `yaml:"-"`
+	CleanRedirects     []ManifestRedirectLocation     `yaml:"-"`
+	CleanBulkRedirects *ManifestBulkRedirects         `yaml:"-"`
+	// Map of paths of error pages and the list of status codes they're used for
+	CleanErrorPages map[string]string `yaml:"-"`
+	// Status codes that use the built-in error page for proxy rules
+	ProxyErrorCodes string        `yaml:"-"`
+	CleanI18n       *ManifestI18n `yaml:"-"`
+}
+
+// RequiresClientCert returns true if any rule in the manifest requires clients to present a certificate
+func (m *AppManifest) RequiresClientCert() bool {
+	for _, rule := range m.Rules {
+		if rule.Options.RequireClientCert {
+			return true
+		}
+	}
+	return false
 }
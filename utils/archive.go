@@ -18,15 +18,21 @@ package utils
 
 import (
 	"archive/tar"
+	"crypto/sha256"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"path"
 	"path/filepath"
 	"reflect"
+	"strconv"
 	"strings"
 
 	"github.com/mholt/archiver"
+
+	"github.com/statiko-dev/statiko/appconfig"
 )
 
 // Type of archive
@@ -78,13 +84,138 @@ func ArchiveTypeByExtension(name string) int {
 	return -1
 }
 
+// Errors returned by ExtractArchive when an archive is rejected
+var (
+	ErrArchiveTooLarge      = errors.New("archive exceeds the maximum uncompressed size")
+	ErrArchiveTooManyFiles  = errors.New("archive contains too many files")
+	ErrArchivePathTooDeep   = errors.New("archive contains a path that is too deep")
+	ErrArchiveAbsolutePath  = errors.New("archive contains an absolute path")
+	ErrArchivePathTraversal = errors.New("archive contains a path traversing to a parent folder")
+	ErrArchiveSymlinkEscape = errors.New("archive contains a symbolic link that is broken or points outside of the app")
+	ErrArchiveDeviceFile    = errors.New("archive contains a device or special file")
+)
+
+// Maximum length of the target of a symbolic link stored in the content of an element
+const maxSymlinkTargetLength = 4096
+
+// Kinds of elements in archives
+const (
+	elementSkip = iota
+	elementDir
+	elementFile
+	elementSymlink
+	elementDevice
+)
+
+// ArchiveInfo contains information on the contents of an archive, as returned by InspectArchive
+type ArchiveInfo struct {
+	// Number of elements in the archive, including folders and symbolic links
+	Files int
+	// Total uncompressed size of the files, in bytes
+	Size int64
+	// True if the archive contains the app's manifest file in the root folder
+	Manifest bool
+}
+
+// SetMetadata stores the information in the metadata of the app's bundle
+func (i *ArchiveInfo) SetMetadata(metadata map[string]string) {
+	metadata["files"] = strconv.Itoa(i.Files)
+	metadata["uncompressedSize"] = strconv.FormatInt(i.Size, 10)
+	metadata["hasManifest"] = strconv.FormatBool(i.Manifest)
+}
+
+// State of an archive's extraction, to enforce the limits
+type extractor struct {
+	dst    string
+	format int
+
+	// When set, elements are validated and counted, but nothing is written to disk
+	inspect bool
+
+	// Limits from the configuration; zero means no limit
+	maxSize  int64
+	maxFiles int
+	maxDepth int
+
+	// Uncompressed size and number of elements extracted so far
+	size  int64
+	files int
+
+	// Symbolic links are created after all other elements, so no file is written through a link
+	symlinks []pendingSymlink
+
+	// Set if the app's manifest file is found
+	manifest bool
+}
+
+// Symbolic link to create at the end of the extraction
+type pendingSymlink struct {
+	name   string
+	target string
+}
+
 // ExtractArchive extracts a compressed archive
 // Reads input from a stream in, and extracts all files into dst
 // This supports all archive formats supported by archiver, including zip, tar.gz, tar.bz2, rar
+// Archives are rejected if they exceed the limits on total uncompressed size, number of files and depth of paths set in the configuration, or if they contain absolute paths, paths traversing to a parent folder, symbolic links pointing outside of dst, or device files
 func ExtractArchive(dst string, in io.Reader, size int64, format int) error {
+	x := newExtractor(format)
+	x.dst = filepath.Clean(dst)
+	return x.run(in, size)
+}
+
+// InspectArchive reads a compressed archive without extracting it, and returns the number of files, their total uncompressed size, and whether the app's manifest is present
+// Archives are validated with the same limits and rules as ExtractArchive, except that symbolic links are only checked lexically, as they aren't created on disk
+func InspectArchive(in io.Reader, size int64, format int) (*ArchiveInfo, error) {
+	x := newExtractor(format)
+	x.inspect = true
+	if err := x.run(in, size); err != nil {
+		return nil, err
+	}
+	return &ArchiveInfo{
+		Files:    x.files,
+		Size:     x.size,
+		Manifest: x.manifest,
+	}, nil
+}
+
+// HashInspectArchive computes the SHA-256 hash of the data while inspecting the archive with InspectArchive, so the data is read only once
+// Zip archives are read with random access, so their data is hashed separately after the inspection
+// The hash is returned even if the archive is invalid, so callers can check it first; it's nil only if the data couldn't be read
+// The position of in is at the end of the data when the function returns
+func HashInspectArchive(in io.ReadSeeker, size int64, format int) (hash []byte, info *ArchiveInfo, err error) {
+	h := sha256.New()
+	if format == ArchiveZip {
+		info, err = InspectArchive(in, size, format)
+		if _, seekErr := in.Seek(0, io.SeekStart); seekErr != nil {
+			return nil, nil, seekErr
+		}
+	} else {
+		info, err = InspectArchive(io.TeeReader(in, h), size, format)
+	}
+
+	// Hash the rest of the data, which the archive's reader might not have consumed
+	if _, copyErr := io.Copy(h, in); copyErr != nil {
+		return nil, nil, copyErr
+	}
+	return h.Sum(nil), info, err
+}
+
+// Returns an extractor with the limits from the configuration
+func newExtractor(format int) *extractor {
+	return &extractor{
+		format:   format,
+		maxSize:  int64(appconfig.Config.GetInt("extract.maxSize")) * 1024 * 1024,
+		maxFiles: appconfig.Config.GetInt("extract.maxFiles"),
+		maxDepth: appconfig.Config.GetInt("extract.maxDepth"),
+	}
+}
+
+// Reads all elements from the archive
+func (x *extractor) run(in io.Reader, size int64) error {
 	// Open the archive, depending on the format
 	var ar archiver.Reader
-	switch format {
+	switch x.format {
 	case ArchiveTar:
 		ar = archiver.NewTar()
 	case ArchiveTarBz2:
@@ -124,21 +255,25 @@ func ExtractArchive(dst string, in io.Reader, size int64, format int) error {
 		}
 
 		// Extract the element
-		err = extractElement(dst, &f, format)
+		err = x.extractElement(&f)
 		if err != nil {
 			f.Close()
-			return fmt.Errorf("error extracting file: %v", err)
+			return fmt.Errorf("error extracting file: %w", err)
 		}
 
 		// Close the stream
 		f.Close()
 	}
 
-	return nil
+	// Create the symbolic links
+	if x.inspect {
+		return nil
+	}
+	return x.createSymlinks()
 }
 
 // Extracts each element from the archive
-func extractElement(dst string, f *archiver.File, format int) error {
+func (x *extractor) extractElement(f *archiver.File) error {
 	// If the header is nil, skip the element
 	if f.Header == nil {
 		return nil
@@ -168,85 +303,219 @@ func extractElement(dst string, f *archiver.File, format int) error {
 		return nil
 	}
 
-	// Get the path relative to the destination
-	target := filepath.Join(dst, name)
-	if target == "" || target == string(os.PathSeparator) {
-		return errors.New("target is empty")
+	// Validate the path, relative to the destination
+	name, err := x.validatePath(name)
+	if err != nil {
+		return err
+	}
+	if name == "." {
+		// Root folder
+		return nil
 	}
-	if !extractPathValid(target, dst) {
-		logger.Println("[Warn] caught potential zip-slip attack with file", target)
-		return fmt.Errorf("illegal target: %s", target)
+	target := filepath.Join(x.dst, filepath.FromSlash(name))
+
+	// Enforce the limit on the number of files
+	x.files++
+	if x.maxFiles > 0 && x.files > x.maxFiles {
+		return fmt.Errorf("%w (limit is %d)", ErrArchiveTooManyFiles, x.maxFiles)
 	}
 
-	// Folders
-	f.FileInfo.Name()
-	if f.IsDir() {
-		err := EnsureFolder(target)
-		if err != nil {
+	switch kind, linkname := x.elementKind(f); kind {
+	case elementDir:
+		if x.inspect {
+			return nil
+		}
+		return os.MkdirAll(target, os.ModePerm)
+	case elementFile:
+		if name == appconfig.Config.GetString("manifestFile") {
+			x.manifest = true
+		}
+		return x.writeFile(target, f)
+	case elementSymlink:
+		// Read the target from the content if it's not in the header
+		if linkname == "" {
+			read, err := ioutil.ReadAll(io.LimitReader(f, maxSymlinkTargetLength+1))
+			if err != nil {
+				return err
+			}
+			if len(read) > maxSymlinkTargetLength {
+				return fmt.Errorf("%w: %s", ErrArchiveSymlinkEscape, name)
+			}
+			linkname = string(read)
+		}
+		if err := validateSymlink(name, linkname); err != nil {
 			return err
 		}
-	} else if isRegularFile(f, format) {
-		// Ensure the parent directory exists
-		dir := filepath.Dir(target)
-		err := EnsureFolder(dir)
+		x.symlinks = append(x.symlinks, pendingSymlink{
+			name:   name,
+			target: linkname,
+		})
+	case elementDevice:
+		return fmt.Errorf("%w: %s", ErrArchiveDeviceFile, name)
+	default:
+		// Skip the file
+		logger.Println("[Warn] extractElement: unsupported element type", name)
+	}
+
+	return nil
+}
+
+// Writes a regular file, enforcing the limit on the total uncompressed size
+// When inspecting the archive, the contents are read and discarded
+func (x *extractor) writeFile(target string, f *archiver.File) error {
+	// Fail early if the size in the header exceeds the limit
+	// The size is enforced on the data read too, as headers can't be trusted
+	remaining := x.maxSize - x.size
+	if x.maxSize > 0 && f.Size() > remaining {
+		return fmt.Errorf("%w (limit is %d bytes)", ErrArchiveTooLarge, x.maxSize)
+	}
+
+	var out io.Writer = ioutil.Discard
+	if !x.inspect {
+		// Ensure the parent directory exists, as archives don't always contain entries for folders
+		// Paths have been validated already, and symlinks are created only at the end, so this can't escape dst
+		err := os.MkdirAll(filepath.Dir(target), os.ModePerm)
 		if err != nil {
 			return err
 		}
 
 		// Write the file
-		mode := f.Mode()
+		mode := f.Mode().Perm()
 		if mode == 0 {
 			mode = 0644
 		}
-		// Do not call defer on Close(), or that will make all files to stay open until the loop is over
-		out, err := os.OpenFile(target, os.O_CREATE|os.O_RDWR, os.FileMode(mode))
+		file, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
 		if err != nil {
 			return err
 		}
+		defer file.Close()
+		out = file
+	}
 
-		// Copy the file's contents
-		_, err = io.Copy(out, f)
-		if err != nil {
-			out.Close()
+	// Copy the file's contents
+	var in io.Reader = f
+	if x.maxSize > 0 {
+		// Read up to one byte more than what's allowed, to detect when the limit is exceeded
+		in = io.LimitReader(f, remaining+1)
+	}
+	n, err := io.Copy(out, in)
+	if err != nil {
+		return err
+	}
+	x.size += n
+	if x.maxSize > 0 && x.size > x.maxSize {
+		return fmt.Errorf("%w (limit is %d bytes)", ErrArchiveTooLarge, x.maxSize)
+	}
+
+	return nil
+}
+
+// Creates the symbolic links, then checks that each one resolves to a path inside the destination
+// This catches links whose target traverses other links
+func (x *extractor) createSymlinks() error {
+	if len(x.symlinks) == 0 {
+		return nil
+	}
+
+	for _, l := range x.symlinks {
+		target := filepath.Join(x.dst, filepath.FromSlash(l.name))
+		if err := os.MkdirAll(filepath.Dir(target), os.ModePerm); err != nil {
+			return err
+		}
+		if err := os.Symlink(filepath.FromSlash(l.target), target); err != nil {
 			return err
 		}
+	}
 
-		out.Close()
-	} else {
-		// Skip the file
-		logger.Println("[Warn] extractElement: unsupported element type")
+	// The destination might be inside a symbolic link itself
+	root, err := filepath.EvalSymlinks(x.dst)
+	if err != nil {
+		return err
+	}
+	for _, l := range x.symlinks {
+		resolved, err := filepath.EvalSymlinks(filepath.Join(x.dst, filepath.FromSlash(l.name)))
+		if err != nil || (resolved != root && !strings.HasPrefix(resolved, root+string(os.PathSeparator))) {
+			return fmt.Errorf("%w: %s", ErrArchiveSymlinkEscape, l.name)
+		}
 	}
 
 	return nil
 }
 
-// Checks if a file is a regular file
-// This should be executed after checking for IsDir()
-func isRegularFile(f *archiver.File, format int) bool {
-	switch format {
+// Validates the path of an element and returns it cleaned, using forward slashes
+// Prevents zip-slip vulnerabilities
+func (x *extractor) validatePath(name string) (string, error) {
+	// Some zip files use backslashes as separator
+	name = strings.ReplaceAll(name, "\\", "/")
+	if name == "" {
+		return "", errors.New("name is empty")
+	}
+
+	// Absolute paths, including Windows paths with a drive letter
+	if strings.HasPrefix(name, "/") || (len(name) >= 2 && name[1] == ':') {
+		return "", fmt.Errorf("%w: %s", ErrArchiveAbsolutePath, name)
+	}
+
+	// Any ".." element is rejected, even if the path wouldn't end outside of the destination
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." {
+			return "", fmt.Errorf("%w: %s", ErrArchivePathTraversal, name)
+		}
+	}
+
+	name = path.Clean(name)
+	if x.maxDepth > 0 && name != "." && strings.Count(name, "/")+1 > x.maxDepth {
+		return "", fmt.Errorf("%w (limit is %d): %s", ErrArchivePathTooDeep, x.maxDepth, name)
+	}
+
+	return name, nil
+}
+
+// Returns the kind of an element, and the target of symbolic links if it's in the header
+func (x *extractor) elementKind(f *archiver.File) (kind int, linkname string) {
+	switch x.format {
 	case ArchiveTar, ArchiveTarBz2, ArchiveTarGz, ArchiveTarLz4, ArchiveTarSz, ArchiveTarXz:
 		h, ok := f.Header.(*tar.Header)
 		if !ok {
-			logger.Println("[Warn] isRegularFile: expected header to be tar.Header, but casting failed")
-			return false
-		}
-		return h.Typeflag == tar.TypeReg ||
-			h.Typeflag == tar.TypeRegA ||
-			h.Typeflag == tar.TypeChar ||
-			h.Typeflag == tar.TypeBlock ||
-			h.Typeflag == tar.TypeFifo ||
-			h.Typeflag == tar.TypeGNUSparse
+			logger.Println("[Warn] elementKind: expected header to be tar.Header, but casting failed")
+			return elementSkip, ""
+		}
+		switch h.Typeflag {
+		case tar.TypeDir:
+			return elementDir, ""
+		case tar.TypeReg, tar.TypeRegA, tar.TypeGNUSparse:
+			return elementFile, ""
+		case tar.TypeSymlink:
+			return elementSymlink, h.Linkname
+		case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+			return elementDevice, ""
+		}
+		return elementSkip, ""
 	case ArchiveZip, ArchiveRar:
-		return !f.IsDir()
+		mode := f.Mode()
+		switch {
+		case mode&(os.ModeDevice|os.ModeCharDevice|os.ModeNamedPipe|os.ModeSocket) != 0:
+			return elementDevice, ""
+		case mode&os.ModeSymlink != 0:
+			// Target is the content of the element
+			return elementSymlink, ""
+		case f.IsDir():
+			return elementDir, ""
+		}
+		return elementFile, ""
 	}
 
-	return false
+	return elementSkip, ""
 }
 
-// Sanitize the path where to extract files
-// Prevents zip-slip vulnerabilities
-// Adapted from: https://snyk.io/research/zip-slip-vulnerability
-func extractPathValid(filePath string, destination string) bool {
-	destpath := filepath.Join(destination, filePath)
-	return strings.HasPrefix(destpath, filepath.Clean(destination)+string(os.PathSeparator))
+// Validates the target of a symbolic link, which must be relative and point to a path inside the destination
+func validateSymlink(name string, target string) error {
+	if target == "" || strings.HasPrefix(target, "/") || strings.Contains(target, "\\") || (len(target) >= 2 && target[1] == ':') {
+		return fmt.Errorf("%w: %s", ErrArchiveSymlinkEscape, name)
+	}
+	resolved := path.Join(path.Dir(name), target)
+	if resolved == ".." || strings.HasPrefix(resolved, "../") {
+		return fmt.Errorf("%w: %s", ErrArchiveSymlinkEscape, name)
+	}
+	return nil
 }
@@ -0,0 +1,413 @@
+/*
+Copyright © 2020 Alessandro Segala (@ItalyPaleAle)
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published
+by the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package utils
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/statiko-dev/statiko/appconfig"
+)
+
+// Element of a crafted archive
+type testArchiveElement struct {
+	name     string
+	typeflag byte
+	content  string
+	linkname string
+	mode     os.FileMode
+}
+
+func TestExtractArchive(t *testing.T) {
+	file := func(name, content string) testArchiveElement {
+		return testArchiveElement{name: name, typeflag: tar.TypeReg, content: content}
+	}
+	dir := func(name string) testArchiveElement {
+		return testArchiveElement{name: name, typeflag: tar.TypeDir}
+	}
+	symlink := func(name, target string) testArchiveElement {
+		return testArchiveElement{name: name, typeflag: tar.TypeSymlink, linkname: target}
+	}
+
+	tests := []struct {
+		name     string
+		elements []testArchiveElement
+		// Limits
+		maxSize  int
+		maxFiles int
+		maxDepth int
+		// Expected error, or nil if the archive must be extracted
+		err error
+	}{
+		{
+			name: "valid archive",
+			elements: []testArchiveElement{
+				dir("site/"),
+				file("site/index.html", "hello world"),
+				file("site/css/style.css", "body {}"),
+				symlink("site/home.html", "index.html"),
+				symlink("site/assets", "css"),
+				symlink("site/css/index.html", "../index.html"),
+			},
+		},
+		{
+			name:     "absolute path",
+			elements: []testArchiveElement{file("/etc/cron.d/evil", "x")},
+			err:      ErrArchiveAbsolutePath,
+		},
+		{
+			name:     "windows absolute path",
+			elements: []testArchiveElement{file("C:\\Windows\\evil", "x")},
+			err:      ErrArchiveAbsolutePath,
+		},
+		{
+			name:     "parent folder",
+			elements: []testArchiveElement{file("../evil", "x")},
+			err:      ErrArchivePathTraversal,
+		},
+		{
+			name:     "traversal in the middle of the path",
+			elements: []testArchiveElement{file("site/../../evil", "x")},
+			err:      ErrArchivePathTraversal,
+		},
+		{
+			name:     "traversal that stays inside",
+			elements: []testArchiveElement{file("site/../index.html", "x")},
+			err:      ErrArchivePathTraversal,
+		},
+		{
+			name:     "traversal with backslashes",
+			elements: []testArchiveElement{file("site\\..\\..\\evil", "x")},
+			err:      ErrArchivePathTraversal,
+		},
+		{
+			name:     "symlink with absolute target",
+			elements: []testArchiveElement{symlink("passwd", "/etc/passwd")},
+			err:      ErrArchiveSymlinkEscape,
+		},
+		{
+			name:     "symlink to parent folder",
+			elements: []testArchiveElement{symlink("site/up", "../..")},
+			err:      ErrArchiveSymlinkEscape,
+		},
+		{
+			name: "symlink escaping through another symlink",
+			elements: []testArchiveElement{
+				symlink("here", "."),
+				symlink("escape", "here/.."),
+			},
+			err: ErrArchiveSymlinkEscape,
+		},
+		{
+			name:     "broken symlink",
+			elements: []testArchiveElement{symlink("missing", "does-not-exist")},
+			err:      ErrArchiveSymlinkEscape,
+		},
+		{
+			name:     "character device",
+			elements: []testArchiveElement{{name: "dev/null", typeflag: tar.TypeChar}},
+			err:      ErrArchiveDeviceFile,
+		},
+		{
+			name:     "block device",
+			elements: []testArchiveElement{{name: "dev/sda", typeflag: tar.TypeBlock}},
+			err:      ErrArchiveDeviceFile,
+		},
+		{
+			name:     "fifo",
+			elements: []testArchiveElement{{name: "pipe", typeflag: tar.TypeFifo}},
+			err:      ErrArchiveDeviceFile,
+		},
+		{
+			name: "too large",
+			elements: []testArchiveElement{
+				file("a.bin", string(make([]byte, 600*1024))),
+				file("b.bin", string(make([]byte, 600*1024))),
+			},
+			maxSize: 1,
+			err:     ErrArchiveTooLarge,
+		},
+		{
+			name: "too many files",
+			elements: []testArchiveElement{
+				file("a.txt", "a"),
+				file("b.txt", "b"),
+				dir("c/"),
+				file("c/d.txt", "d"),
+			},
+			maxFiles: 3,
+			err:      ErrArchiveTooManyFiles,
+		},
+		{
+			name:     "too deep",
+			elements: []testArchiveElement{file("a/b/c/d.txt", "x")},
+			maxDepth: 3,
+			err:      ErrArchivePathTooDeep,
+		},
+		{
+			name:     "within limits",
+			elements: []testArchiveElement{file("a/b/c.txt", "x"), file("d.txt", "x")},
+			maxSize:  1,
+			maxFiles: 2,
+			maxDepth: 3,
+		},
+	}
+
+	for _, tt := range tests {
+		for _, format := range []int{ArchiveTar, ArchiveZip} {
+			formatName := "tar"
+			if format == ArchiveZip {
+				formatName = "zip"
+			}
+			t.Run(tt.name+"/"+formatName, func(t *testing.T) {
+				appconfig.Config.Set("extract.maxSize", tt.maxSize)
+				appconfig.Config.Set("extract.maxFiles", tt.maxFiles)
+				appconfig.Config.Set("extract.maxDepth", tt.maxDepth)
+
+				var data []byte
+				if format == ArchiveZip {
+					data = createTestZip(t, tt.elements)
+				} else {
+					data = createTestTar(t, tt.elements)
+				}
+				dst := extractTestArchive(t, data, format, tt.err)
+				defer os.RemoveAll(filepath.Dir(dst))
+
+				if tt.err == nil && tt.name == "valid archive" {
+					checkTestFile(t, dst, "site/index.html", "hello world")
+					checkTestFile(t, dst, "site/home.html", "hello world")
+					checkTestFile(t, dst, "site/assets/style.css", "body {}")
+					checkTestFile(t, dst, "site/css/index.html", "hello world")
+				}
+			})
+		}
+	}
+}
+
+func TestExtractArchiveOverwrite(t *testing.T) {
+	appconfig.Config.Set("extract.maxSize", 0)
+	appconfig.Config.Set("extract.maxFiles", 0)
+	appconfig.Config.Set("extract.maxDepth", 0)
+
+	// Duplicate entries replace the previous content entirely
+	data := createTestTar(t, []testArchiveElement{
+		{name: "index.html", typeflag: tar.TypeReg, content: "a long content"},
+		{name: "index.html", typeflag: tar.TypeReg, content: "short"},
+	})
+	dst := extractTestArchive(t, data, ArchiveTar, nil)
+	defer os.RemoveAll(filepath.Dir(dst))
+	checkTestFile(t, dst, "index.html", "short")
+}
+
+func TestInspectArchive(t *testing.T) {
+	appconfig.Config.Set("extract.maxSize", 0)
+	appconfig.Config.Set("extract.maxFiles", 0)
+	appconfig.Config.Set("extract.maxDepth", 0)
+
+	elements := []testArchiveElement{
+		{name: "site/", typeflag: tar.TypeDir},
+		{name: "site/index.html", typeflag: tar.TypeReg, content: "hello world"},
+		{name: "site/home.html", typeflag: tar.TypeSymlink, linkname: "index.html"},
+		{name: appconfig.Config.GetString("manifestFile"), typeflag: tar.TypeReg, content: "rewrite: {}"},
+	}
+	for _, format := range []int{ArchiveTar, ArchiveZip} {
+		var data []byte
+		if format == ArchiveZip {
+			data = createTestZip(t, elements)
+		} else {
+			data = createTestTar(t, elements)
+		}
+		info, err := InspectArchive(bytes.NewReader(data), int64(len(data)), format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Files != 4 || info.Size != 22 || !info.Manifest {
+			t.Errorf("unexpected archive info: %+v", info)
+		}
+	}
+
+	// Archives are validated
+	data := createTestTar(t, []testArchiveElement{{name: "../evil", typeflag: tar.TypeReg}})
+	_, err := InspectArchive(bytes.NewReader(data), int64(len(data)), ArchiveTar)
+	if !errors.Is(err, ErrArchivePathTraversal) {
+		t.Error("expected path traversal error, got", err)
+	}
+
+	// Archives must match the format
+	_, err = InspectArchive(bytes.NewReader(data), int64(len(data)), ArchiveZip)
+	if err == nil {
+		t.Error("expected error opening a tar file as zip")
+	}
+}
+
+// Extracts an archive into a new temporary folder, checking the error
+func TestHashInspectArchive(t *testing.T) {
+	appconfig.Config.Set("extract.maxSize", 0)
+	appconfig.Config.Set("extract.maxFiles", 0)
+	appconfig.Config.Set("extract.maxDepth", 0)
+
+	elements := []testArchiveElement{
+		{name: "site/index.html", typeflag: tar.TypeReg, content: "hello world"},
+		{name: "site/style.css", typeflag: tar.TypeReg, content: "body {}"},
+	}
+	tarData := createTestTar(t, elements)
+	tests := []struct {
+		name   string
+		data   []byte
+		format int
+		valid  bool
+	}{
+		{name: "tar", data: tarData, format: ArchiveTar, valid: true},
+		// Data after the end of the archive isn't read by the archive's reader, but it's hashed
+		{name: "tar with padding", data: append(append([]byte{}, tarData...), make([]byte, 4096)...), format: ArchiveTar, valid: true},
+		{name: "zip", data: createTestZip(t, elements), format: ArchiveZip, valid: true},
+		{name: "invalid tar", data: createTestTar(t, []testArchiveElement{{name: "../evil", typeflag: tar.TypeReg}}), format: ArchiveTar},
+		{name: "tar as zip", data: tarData, format: ArchiveZip},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hash, info, err := HashInspectArchive(bytes.NewReader(tt.data), int64(len(tt.data)), tt.format)
+			expect := sha256.Sum256(tt.data)
+			if !bytes.Equal(hash, expect[:]) {
+				t.Errorf("expected hash %x, got %x", expect, hash)
+			}
+			if !tt.valid {
+				if err == nil {
+					t.Error("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Files != 2 || info.Size != 18 || info.Manifest {
+				t.Errorf("unexpected archive info: %+v", info)
+			}
+		})
+	}
+}
+
+func extractTestArchive(t *testing.T, data []byte, format int, expectErr error) string {
+	tmp, err := ioutil.TempDir("", "statikotest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst := filepath.Join(tmp, "app")
+	if err := EnsureFolder(dst); err != nil {
+		t.Fatal(err)
+	}
+
+	err = ExtractArchive(dst, bytes.NewReader(data), int64(len(data)), format)
+	if expectErr == nil && err != nil {
+		t.Fatal("expected no error, got", err)
+	} else if expectErr != nil && !errors.Is(err, expectErr) {
+		t.Fatalf("expected error %v, got %v", expectErr, err)
+	}
+
+	// Nothing must have been written outside of the destination
+	list, err := ioutil.ReadDir(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 {
+		t.Error("found files outside of the destination folder")
+	}
+
+	return dst
+}
+
+func checkTestFile(t *testing.T, dst string, name string, content string) {
+	read, err := ioutil.ReadFile(filepath.Join(dst, name))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if string(read) != content {
+		t.Errorf("content of %s does not match: %s", name, string(read))
+	}
+}
+
+func createTestTar(t *testing.T, elements []testArchiveElement) []byte {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for _, e := range elements {
+		err := tw.WriteHeader(&tar.Header{
+			Name:     e.name,
+			Typeflag: e.typeflag,
+			Linkname: e.linkname,
+			Size:     int64(len(e.content)),
+			Mode:     0644,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func createTestZip(t *testing.T, elements []testArchiveElement) []byte {
+	buf := &bytes.Buffer{}
+	zw := zip.NewWriter(buf)
+	for _, e := range elements {
+		h := &zip.FileHeader{
+			Name:   e.name,
+			Method: zip.Deflate,
+		}
+		content := e.content
+		switch e.typeflag {
+		case tar.TypeDir:
+			h.SetMode(os.ModeDir | 0755)
+		case tar.TypeSymlink:
+			// Zip files store the target of symbolic links as content
+			h.SetMode(os.ModeSymlink | 0777)
+			content = e.linkname
+		case tar.TypeChar:
+			h.SetMode(os.ModeDevice | os.ModeCharDevice | 0644)
+		case tar.TypeBlock:
+			h.SetMode(os.ModeDevice | 0644)
+		case tar.TypeFifo:
+			h.SetMode(os.ModeNamedPipe | 0644)
+		default:
+			h.SetMode(0644)
+		}
+		w, err := zw.CreateHeader(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
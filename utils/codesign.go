@@ -0,0 +1,203 @@
+/*
+Copyright © 2020 Alessandro Segala (@ItalyPaleAle)
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published
+by the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package utils
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"math/big"
+)
+
+// Algorithms for code signing, which are detected from the public key
+const (
+	// RSA keys with the rsaEncryption algorithm can be used with both PKCS#1 v1.5 and PSS signatures
+	CodeSignRSA = "rsa"
+	// RSA keys with the RSASSA-PSS algorithm can only be used with PSS signatures
+	CodeSignRSAPSS    = "rsa-pss"
+	CodeSignECDSAP256 = "ecdsa-p256"
+	CodeSignECDSAP384 = "ecdsa-p384"
+	CodeSignEd25519   = "ed25519"
+)
+
+// Minimum size for RSA keys, in bits
+const codeSignMinRSABits = 2048
+
+// OID of the RSASSA-PSS algorithm in public keys, which isn't supported by x509.ParsePKIXPublicKey
+var oidRSAPSS = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 10}
+
+// CodeSignKey is a public key used to verify the signatures of app bundles
+// Signatures are computed over the SHA-256 digest of the bundle; for Ed25519, the digest is the message that is signed
+type CodeSignKey struct {
+	alg string
+	key crypto.PublicKey
+}
+
+// ParseCodeSignKey parses a PEM-encoded public key, either PKCS#1 ("RSA PUBLIC KEY") or PKIX ("PUBLIC KEY"), and detects the signing algorithm
+func ParseCodeSignKey(pemKey []byte) (*CodeSignKey, error) {
+	block, _ := pem.Decode(pemKey)
+	if block == nil || len(block.Bytes) == 0 {
+		return nil, errors.New("invalid PEM block")
+	}
+
+	var pub crypto.PublicKey
+	alg := ""
+	switch block.Type {
+	case "RSA PUBLIC KEY":
+		// PKCS#1
+		key, err := x509.ParsePKCS1PublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		pub = key
+	case "PUBLIC KEY":
+		// PKIX
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			// Check if it's a RSASSA-PSS key
+			key, pssErr := parsePSSPublicKey(block.Bytes)
+			if pssErr != nil {
+				return nil, err
+			}
+			pub = key
+			alg = CodeSignRSAPSS
+		} else {
+			pub = key
+		}
+	default:
+		return nil, errors.New("unsupported PEM block type: " + block.Type)
+	}
+
+	switch key := pub.(type) {
+	case *rsa.PublicKey:
+		if key.N.BitLen() < codeSignMinRSABits {
+			return nil, errors.New("RSA keys must be at least 2048-bit long")
+		}
+		if alg == "" {
+			alg = CodeSignRSA
+		}
+	case *ecdsa.PublicKey:
+		switch key.Curve {
+		case elliptic.P256():
+			alg = CodeSignECDSAP256
+		case elliptic.P384():
+			alg = CodeSignECDSAP384
+		default:
+			return nil, errors.New("unsupported ECDSA curve: " + key.Curve.Params().Name)
+		}
+	case ed25519.PublicKey:
+		alg = CodeSignEd25519
+	default:
+		return nil, errors.New("unsupported public key type")
+	}
+
+	return &CodeSignKey{
+		alg: alg,
+		key: pub,
+	}, nil
+}
+
+// Algorithm returns the signing algorithm for the key
+func (k *CodeSignKey) Algorithm() string {
+	return k.alg
+}
+
+// Verify checks the signature of a SHA-256 digest
+// ECDSA signatures can be either ASN.1 DER-encoded or the raw concatenation of r and s
+func (k *CodeSignKey) Verify(digest []byte, signature []byte) error {
+	if len(digest) != 32 {
+		return errors.New("digest must be a SHA-256 hash")
+	}
+
+	switch k.alg {
+	case CodeSignRSA:
+		// Try PKCS#1 v1.5 first, then PSS
+		key := k.key.(*rsa.PublicKey)
+		if rsa.VerifyPKCS1v15(key, crypto.SHA256, digest, signature) == nil {
+			return nil
+		}
+		return rsa.VerifyPSS(key, crypto.SHA256, digest, signature, nil)
+	case CodeSignRSAPSS:
+		return rsa.VerifyPSS(k.key.(*rsa.PublicKey), crypto.SHA256, digest, signature, nil)
+	case CodeSignECDSAP256, CodeSignECDSAP384:
+		key := k.key.(*ecdsa.PublicKey)
+		r, s, err := parseECDSASignature(key, signature)
+		if err != nil {
+			return err
+		}
+		if !ecdsa.Verify(key, digest, r, s) {
+			return errors.New("ecdsa: verification error")
+		}
+		return nil
+	case CodeSignEd25519:
+		if !ed25519.Verify(k.key.(ed25519.PublicKey), digest, signature) {
+			return errors.New("ed25519: verification error")
+		}
+		return nil
+	}
+
+	return errors.New("unsupported algorithm")
+}
+
+// Parses a PKIX public key with the RSASSA-PSS algorithm
+// The algorithm's parameters are ignored: signatures must use SHA-256 as hash and MGF1 function
+func parsePSSPublicKey(der []byte) (*rsa.PublicKey, error) {
+	spki := struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}{}
+	rest, err := asn1.Unmarshal(der, &spki)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) > 0 {
+		return nil, errors.New("trailing data after public key")
+	}
+	if !spki.Algorithm.Algorithm.Equal(oidRSAPSS) {
+		return nil, errors.New("public key is not RSASSA-PSS")
+	}
+	return x509.ParsePKCS1PublicKey(spki.PublicKey.RightAlign())
+}
+
+// Parses an ECDSA signature, either ASN.1 DER-encoded or the raw concatenation of r and s
+func parseECDSASignature(key *ecdsa.PublicKey, signature []byte) (r, s *big.Int, err error) {
+	size := (key.Curve.Params().BitSize + 7) / 8
+	if len(signature) == 2*size {
+		r = new(big.Int).SetBytes(signature[:size])
+		s = new(big.Int).SetBytes(signature[size:])
+		return r, s, nil
+	}
+
+	sig := struct {
+		R, S *big.Int
+	}{}
+	rest, err := asn1.Unmarshal(signature, &sig)
+	if err != nil {
+		return nil, nil, errors.New("invalid ECDSA signature: " + err.Error())
+	}
+	if len(rest) > 0 || sig.R == nil || sig.S == nil {
+		return nil, nil, errors.New("invalid ECDSA signature")
+	}
+	return sig.R, sig.S, nil
+}
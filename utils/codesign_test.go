@@ -0,0 +1,284 @@
+/*
+Copyright © 2020 Alessandro Segala (@ItalyPaleAle)
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published
+by the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package utils
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"strconv"
+	"testing"
+)
+
+// Key used in the tests, with all the ways it can create signatures
+type codeSignTestKey struct {
+	name    string
+	alg     string
+	pem     []byte
+	signers map[string]func(digest []byte) ([]byte, error)
+}
+
+func TestCodeSign(t *testing.T) {
+	digest := sha256.Sum256([]byte("hello world"))
+	otherDigest := sha256.Sum256([]byte("hello world!"))
+
+	keys := make([]codeSignTestKey, 0)
+	for _, bits := range []int{2048, 3072, 4096} {
+		k, err := rsa.GenerateKey(rand.Reader, bits)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signers := rsaSigners(k, true)
+		keys = append(keys,
+			codeSignTestKey{
+				name:    "rsa-" + strconv.Itoa(bits) + "-pkcs1",
+				alg:     CodeSignRSA,
+				pem:     pemEncode("RSA PUBLIC KEY", x509.MarshalPKCS1PublicKey(&k.PublicKey)),
+				signers: signers,
+			},
+			codeSignTestKey{
+				name:    "rsa-" + strconv.Itoa(bits) + "-pkix",
+				alg:     CodeSignRSA,
+				pem:     pemEncode("PUBLIC KEY", mustMarshalPKIX(t, &k.PublicKey)),
+				signers: signers,
+			},
+			codeSignTestKey{
+				name:    "rsa-pss-" + strconv.Itoa(bits),
+				alg:     CodeSignRSAPSS,
+				pem:     pemEncode("PUBLIC KEY", marshalPSSPublicKey(t, &k.PublicKey)),
+				signers: rsaSigners(k, false),
+			},
+		)
+	}
+	for _, c := range []struct {
+		curve elliptic.Curve
+		alg   string
+	}{{elliptic.P256(), CodeSignECDSAP256}, {elliptic.P384(), CodeSignECDSAP384}} {
+		k, err := ecdsa.GenerateKey(c.curve, rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		size := (c.curve.Params().BitSize + 7) / 8
+		keys = append(keys, codeSignTestKey{
+			name: c.alg,
+			alg:  c.alg,
+			pem:  pemEncode("PUBLIC KEY", mustMarshalPKIX(t, &k.PublicKey)),
+			signers: map[string]func([]byte) ([]byte, error){
+				"asn1": func(digest []byte) ([]byte, error) {
+					r, s, err := ecdsa.Sign(rand.Reader, k, digest)
+					if err != nil {
+						return nil, err
+					}
+					return asn1.Marshal(struct{ R, S interface{} }{r, s})
+				},
+				"raw": func(digest []byte) ([]byte, error) {
+					r, s, err := ecdsa.Sign(rand.Reader, k, digest)
+					if err != nil {
+						return nil, err
+					}
+					sig := make([]byte, 2*size)
+					rb, sb := r.Bytes(), s.Bytes()
+					copy(sig[size-len(rb):size], rb)
+					copy(sig[2*size-len(sb):], sb)
+					return sig, nil
+				},
+			},
+		})
+	}
+	edPub, edPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys = append(keys, codeSignTestKey{
+		name: CodeSignEd25519,
+		alg:  CodeSignEd25519,
+		pem:  pemEncode("PUBLIC KEY", mustMarshalPKIX(t, edPub)),
+		signers: map[string]func([]byte) ([]byte, error){
+			"ed25519": func(digest []byte) ([]byte, error) {
+				return ed25519.Sign(edPriv, digest), nil
+			},
+		},
+	})
+
+	// Parse all keys
+	parsed := make([]*CodeSignKey, len(keys))
+	for i, k := range keys {
+		key, err := ParseCodeSignKey(k.pem)
+		if err != nil {
+			t.Fatalf("error parsing key %s: %v", k.name, err)
+		}
+		if key.Algorithm() != k.alg {
+			t.Fatalf("expected algorithm %s for key %s, got %s", k.alg, k.name, key.Algorithm())
+		}
+		parsed[i] = key
+	}
+
+	// Each signature must be valid only for the key that created it, and only for the digest that was signed
+	for i, k := range keys {
+		for sn, signer := range k.signers {
+			sig, err := signer(digest[:])
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Run(k.name+"/"+sn, func(t *testing.T) {
+				if err := parsed[i].Verify(digest[:], sig); err != nil {
+					t.Error("expected signature to be valid, got", err)
+				}
+				if err := parsed[i].Verify(otherDigest[:], sig); err == nil {
+					t.Error("expected signature to be invalid for a different digest")
+				}
+				tampered := make([]byte, len(sig))
+				copy(tampered, sig)
+				tampered[len(tampered)-1] ^= 0xFF
+				if err := parsed[i].Verify(digest[:], tampered); err == nil {
+					t.Error("expected tampered signature to be invalid")
+				}
+				for j := range keys {
+					if j == i || string(keys[j].pem) == string(k.pem) || sameRSAKey(keys[i], keys[j]) {
+						continue
+					}
+					if err := parsed[j].Verify(digest[:], sig); err == nil {
+						t.Error("expected signature to be invalid for key", keys[j].name)
+					}
+				}
+			})
+		}
+	}
+
+	// RSA-PSS keys must not accept PKCS#1 v1.5 signatures
+	t.Run("rsa-pss rejects pkcs1v15", func(t *testing.T) {
+		k, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, err := ParseCodeSignKey(pemEncode("PUBLIC KEY", marshalPSSPublicKey(t, &k.PublicKey)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig, err := rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := key.Verify(digest[:], sig); err == nil {
+			t.Error("expected PKCS#1 v1.5 signature to be invalid")
+		}
+	})
+
+	t.Run("invalid digest", func(t *testing.T) {
+		if err := parsed[0].Verify([]byte("short"), []byte("sig")); err == nil {
+			t.Error("expected error for a digest that isn't SHA-256")
+		}
+	})
+}
+
+func TestParseCodeSignKeyUnsupported(t *testing.T) {
+	rsaSmall, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p224, err := ecdsa.GenerateKey(elliptic.P224(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p521, err := ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string][]byte{
+		"rsa-1024":     pemEncode("PUBLIC KEY", mustMarshalPKIX(t, &rsaSmall.PublicKey)),
+		"ecdsa-p224":   pemEncode("PUBLIC KEY", mustMarshalPKIX(t, &p224.PublicKey)),
+		"ecdsa-p521":   pemEncode("PUBLIC KEY", mustMarshalPKIX(t, &p521.PublicKey)),
+		"not pem":      []byte("hello world"),
+		"private key":  pemEncode("RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaSmall)),
+		"invalid pkix": pemEncode("PUBLIC KEY", []byte("hello world")),
+	}
+	for name, pemKey := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := ParseCodeSignKey(pemKey); err == nil {
+				t.Error("expected error, got none")
+			}
+		})
+	}
+}
+
+// Returns the signers for a RSA key: PKCS#1 v1.5 (if enabled) and PSS with different salt lengths
+func rsaSigners(k *rsa.PrivateKey, pkcs1v15 bool) map[string]func([]byte) ([]byte, error) {
+	signers := map[string]func([]byte) ([]byte, error){
+		"pss-saltauto": func(digest []byte) ([]byte, error) {
+			return rsa.SignPSS(rand.Reader, k, crypto.SHA256, digest, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthAuto})
+		},
+		"pss-salthash": func(digest []byte) ([]byte, error) {
+			return rsa.SignPSS(rand.Reader, k, crypto.SHA256, digest, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		},
+	}
+	if pkcs1v15 {
+		signers["pkcs1v15"] = func(digest []byte) ([]byte, error) {
+			return rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest)
+		}
+	}
+	return signers
+}
+
+// Returns true if both keys are RSA keys with the same modulus (in different encodings)
+func sameRSAKey(a, b codeSignTestKey) bool {
+	ka, errA := ParseCodeSignKey(a.pem)
+	kb, errB := ParseCodeSignKey(b.pem)
+	if errA != nil || errB != nil {
+		return false
+	}
+	ra, okA := ka.key.(*rsa.PublicKey)
+	rb, okB := kb.key.(*rsa.PublicKey)
+	return okA && okB && ra.N.Cmp(rb.N) == 0
+}
+
+func marshalPSSPublicKey(t *testing.T, pub *rsa.PublicKey) []byte {
+	der, err := asn1.Marshal(struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}{
+		Algorithm: pkix.AlgorithmIdentifier{Algorithm: oidRSAPSS},
+		PublicKey: asn1.BitString{
+			Bytes:     x509.MarshalPKCS1PublicKey(pub),
+			BitLength: 8 * len(x509.MarshalPKCS1PublicKey(pub)),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+func mustMarshalPKIX(t *testing.T, pub interface{}) []byte {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+func pemEncode(typ string, der []byte) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der})
+}
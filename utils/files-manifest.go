@@ -0,0 +1,119 @@
+/*
+Copyright © 2020 Alessandro Segala (@ItalyPaleAle)
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published
+by the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package utils
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"path"
+	"sort"
+	"strings"
+)
+
+// FilesManifestName is the name of the file, in bundles assembled from delta deploys, that contains the list of files and their hashes
+// The file is removed when the app is staged
+const FilesManifestName = ".statiko-files"
+
+// SignedFilesManifest is the value of the "signed" metadata key for bundles whose signature is for the files manifest rather than for the bundle itself
+const SignedFilesManifest = "manifest"
+
+// FilesManifestEntry is a file in a FilesManifest
+type FilesManifestEntry struct {
+	// Path of the file, relative to the root of the app, using forward slashes
+	Path string `json:"path"`
+	// Hex-encoded SHA-256 hash of the file's content
+	Hash string `json:"hash"`
+}
+
+// FilesManifest is the list of files in an app, with their hashes
+// It's used by delta deploys, where the manifest is signed rather than the bundle
+type FilesManifest []FilesManifestEntry
+
+// Validate checks that all paths and hashes are valid, and that there are no duplicate paths
+// Paths are normalized and hashes are converted to lowercase
+func (fm FilesManifest) Validate() error {
+	if len(fm) == 0 {
+		return errors.New("manifest is empty")
+	}
+
+	found := make(map[string]bool, len(fm))
+	for i := range fm {
+		e := &fm[i]
+
+		// Paths must be relative and can't traverse outside of the app's folder
+		p := path.Clean(e.Path)
+		if e.Path == "" || strings.HasPrefix(p, "/") || p == "." || p == ".." || strings.HasPrefix(p, "../") || strings.ContainsAny(p, "\n\\") {
+			return errors.New("invalid path: " + e.Path)
+		}
+		if p == FilesManifestName {
+			return errors.New("path is reserved: " + e.Path)
+		}
+		if found[p] {
+			return errors.New("duplicate path: " + e.Path)
+		}
+		found[p] = true
+		e.Path = p
+
+		// Hashes are SHA-256, hex-encoded
+		h, err := hex.DecodeString(e.Hash)
+		if err != nil || len(h) != 32 {
+			return errors.New("invalid hash for file: " + e.Path)
+		}
+		e.Hash = strings.ToLower(e.Hash)
+	}
+
+	return nil
+}
+
+// Canonical returns the manifest in the format that is signed, which is the same as the output of the sha256sum command: each line contains the hex-encoded hash, two spaces, and the path
+// Lines are sorted by path and each one ends with a newline character
+func (fm FilesManifest) Canonical() []byte {
+	sorted := make(FilesManifest, len(fm))
+	copy(sorted, fm)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Path < sorted[j].Path
+	})
+
+	buf := &bytes.Buffer{}
+	for _, e := range sorted {
+		buf.WriteString(e.Hash)
+		buf.WriteString("  ")
+		buf.WriteString(e.Path)
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
+
+// ParseFilesManifest parses a manifest in the canonical format
+func ParseFilesManifest(data []byte) (FilesManifest, error) {
+	fm := FilesManifest{}
+	for _, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+		parts := strings.SplitN(line, "  ", 2)
+		if len(parts) != 2 {
+			return nil, errors.New("invalid line in manifest")
+		}
+		fm = append(fm, FilesManifestEntry{
+			Hash: parts[0],
+			Path: parts[1],
+		})
+	}
+	if err := fm.Validate(); err != nil {
+		return nil, err
+	}
+	return fm, nil
+}
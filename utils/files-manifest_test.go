@@ -0,0 +1,133 @@
+/*
+Copyright © 2020 Alessandro Segala (@ItalyPaleAle)
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published
+by the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestFilesManifest(t *testing.T) {
+	hash := func(content string) string {
+		h := sha256.Sum256([]byte(content))
+		return hex.EncodeToString(h[:])
+	}
+	entry := func(path, content string) FilesManifestEntry {
+		return FilesManifestEntry{Path: path, Hash: hash(content)}
+	}
+
+	tests := []struct {
+		name     string
+		manifest FilesManifest
+		// Expected paths after validation, sorted, or nil if the manifest is invalid
+		paths []string
+	}{
+		{
+			name:     "valid manifest",
+			manifest: FilesManifest{entry("index.html", "a"), entry("css/style.css", "b"), entry("a b  c.txt", "c")},
+			paths:    []string{"a b  c.txt", "css/style.css", "index.html"},
+		},
+		{
+			name:     "paths are normalized",
+			manifest: FilesManifest{entry("./index.html", "a"), entry("css//x/../style.css", "b")},
+			paths:    []string{"css/style.css", "index.html"},
+		},
+		{
+			name:     "uppercase hash",
+			manifest: FilesManifest{{Path: "index.html", Hash: strings.ToUpper(hash("a"))}},
+			paths:    []string{"index.html"},
+		},
+		{name: "empty manifest", manifest: FilesManifest{}},
+		{name: "empty path", manifest: FilesManifest{entry("", "a")}},
+		{name: "root path", manifest: FilesManifest{entry(".", "a")}},
+		{name: "absolute path", manifest: FilesManifest{entry("/etc/passwd", "a")}},
+		{name: "parent folder", manifest: FilesManifest{entry("..", "a")}},
+		{name: "path traversal", manifest: FilesManifest{entry("../evil", "a")}},
+		{name: "nested path traversal", manifest: FilesManifest{entry("css/../../evil", "a")}},
+		{name: "backslash in path", manifest: FilesManifest{entry("..\\evil", "a")}},
+		{name: "newline in path", manifest: FilesManifest{entry("index.html\nevil", "a")}},
+		{name: "reserved path", manifest: FilesManifest{entry(FilesManifestName, "a")}},
+		{name: "duplicate path", manifest: FilesManifest{entry("index.html", "a"), entry("index.html", "b")}},
+		{name: "duplicate path after normalization", manifest: FilesManifest{entry("index.html", "a"), entry("./css/../index.html", "b")}},
+		{name: "short hash", manifest: FilesManifest{{Path: "index.html", Hash: hash("a")[:62]}}},
+		{name: "invalid hash", manifest: FilesManifest{{Path: "index.html", Hash: "z" + hash("a")[1:]}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.manifest.Validate()
+			if tt.paths == nil {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The canonical format has one sorted line per file, and it's parsed back to the same manifest
+			canonical := tt.manifest.Canonical()
+			lines := strings.Split(strings.TrimSuffix(string(canonical), "\n"), "\n")
+			if len(lines) != len(tt.paths) {
+				t.Fatalf("expected %d lines, got %d", len(tt.paths), len(lines))
+			}
+			for i, line := range lines {
+				if !strings.HasSuffix(line, "  "+tt.paths[i]) || line[:64] != strings.ToLower(line[:64]) {
+					t.Errorf("unexpected line %d: %q", i, line)
+				}
+			}
+			parsed, err := ParseFilesManifest(canonical)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(parsed.Canonical()) != string(canonical) {
+				t.Errorf("round-trip changed the manifest: %q", string(parsed.Canonical()))
+			}
+		})
+	}
+}
+
+func TestParseFilesManifest(t *testing.T) {
+	h := strings.Repeat("ab", 32)
+	tests := []struct {
+		name string
+		data string
+		ok   bool
+	}{
+		{name: "valid", data: h + "  index.html\n" + h + "  css/style.css\n", ok: true},
+		{name: "no trailing newline", data: h + "  index.html", ok: true},
+		{name: "empty", data: ""},
+		{name: "single space", data: h + " index.html\n"},
+		{name: "empty line", data: h + "  index.html\n\n" + h + "  style.css\n"},
+		{name: "path traversal", data: h + "  ../index.html\n"},
+		{name: "duplicate path", data: h + "  index.html\n" + h + "  index.html\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseFilesManifest([]byte(tt.data))
+			if tt.ok && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			} else if !tt.ok && err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
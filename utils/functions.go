@@ -99,6 +99,23 @@ func SHA256String(str string) string {
 	return hex.EncodeToString(hash[:])
 }
 
+// DecodeSHA256Hash decodes a SHA-256 hash that is hex-encoded or base64-encoded
+func DecodeSHA256Hash(str string) ([]byte, error) {
+	var (
+		hash []byte
+		err  error
+	)
+	if len(str) == 64 {
+		hash, err = hex.DecodeString(str)
+	} else {
+		hash, err = base64.StdEncoding.DecodeString(str)
+	}
+	if err != nil || len(hash) != sha256.Size {
+		return nil, errors.New("invalid SHA-256 hash: must be hex-encoded or base64-encoded")
+	}
+	return hash, nil
+}
+
 // SerializeECDSAKey serializes an ecdsa private key
 // Source https://stackoverflow.com/a/41315404/192024
 func SerializeECDSAKey(privateKey *ecdsa.PrivateKey) ([]byte, error) {
@@ -153,6 +170,28 @@ func SanitizeAppName(name string) string {
 	return name
 }
 
+var appTagRegEx *regexp.Regexp
+
+// SanitizeAppTag validates and sanitizes the name of a tag of an app in the registry
+// Tags must be lowercase strings containing letters, numbers, dashes, underscores and dots; the first character must be a letter or number
+func SanitizeAppTag(tag string) string {
+	if appTagRegEx == nil {
+		appTagRegEx = regexp.MustCompile("^([a-z0-9][a-z0-9\\.\\-_]*)$")
+	}
+	tag = strings.ToLower(tag)
+	if !appTagRegEx.MatchString(tag) {
+		tag = ""
+	}
+
+	return tag
+}
+
+// SanitizeKeyID validates and sanitizes the ID of a key in the code signing keyring
+// Key IDs follow the same rules as tags of apps
+func SanitizeKeyID(id string) string {
+	return SanitizeAppTag(id)
+}
+
 // IsTruthy returns true if a string (e.g. a querystring parameter) is a truthy value, as a string
 func IsTruthy(val string) bool {
 	return val == "1" || val == "true" || val == "t" || val == "y" || val == "yes"
@@ -25,9 +25,10 @@ func HeaderIsAllowed(name string) bool {
 	// Lowercase the name
 	name = strings.ToLower(name)
 
-	// Allow all X-* headers, and a list of safe headers
-	// Cache-related headers and redirect headers are allowed even though they can also be set with a separate option
-	if name[0:2] == "x-" ||
+	// Allow all X-* and Access-Control-* headers, and a list of safe headers
+	// Cache-related headers, redirect headers and CORS headers are allowed even though they can also be set with a separate option
+	if strings.HasPrefix(name, "x-") ||
+		strings.HasPrefix(name, "access-control-") ||
 		name == "expires" ||
 		name == "cache-control" ||
 		name == "content-disposition" ||
@@ -49,3 +50,33 @@ func HeaderIsAllowed(name string) bool {
 	}
 	return false
 }
+
+// ProxyHeaderIsAllowed returns true if a header can be set in requests proxied to an upstream server
+func ProxyHeaderIsAllowed(name string) bool {
+	// Lowercase the name
+	name = strings.ToLower(name)
+
+	// Header names can only contain letters, numbers and dashes
+	if name == "" {
+		return false
+	}
+	for _, char := range name {
+		if (char < 'a' || char > 'z') && (char < '0' || char > '9') && char != '-' {
+			return false
+		}
+	}
+
+	// Hop-by-hop headers and headers that define the message framing are managed by the webserver
+	// Connection and Upgrade are set when WebSockets are enabled
+	if name == "connection" ||
+		name == "content-length" ||
+		name == "keep-alive" ||
+		name == "proxy-connection" ||
+		name == "te" ||
+		name == "trailer" ||
+		name == "transfer-encoding" ||
+		name == "upgrade" {
+		return false
+	}
+	return true
+}
@@ -27,6 +27,7 @@ type SiteHealth struct {
 	StatusCode   *int       `json:"statusCode,omitempty"`
 	ResponseSize *int       `json:"responseSize,omitempty"`
 	Healthy      *bool      `json:"healthy,omitempty"`
+	Maintenance  bool       `json:"maintenance,omitempty"`
 	Error        string     `json:"error,omitempty"`
 	Time         *time.Time `json:"time,omitempty"`
 }
@@ -38,6 +39,11 @@ func (h *SiteHealth) IsHealthy() bool {
 		return false
 	}
 
+	// Sites in maintenance mode aren't checked, and they're not considered unhealthy
+	if h.Maintenance {
+		return true
+	}
+
 	// If there's no app, it's healthy by default
 	if h.App == nil {
 		return true
@@ -63,6 +69,13 @@ type NodeSync struct {
 // NginxStatus contains information on the status of the Nginx server
 type NginxStatus struct {
 	Running bool `json:"running"`
+
+	// Metrics from the stub_status module; these are not set if the server isn't running or metrics couldn't be collected
+	ActiveConnections *int     `json:"activeConnections,omitempty"`
+	Reading           *int     `json:"reading,omitempty"`
+	Writing           *int     `json:"writing,omitempty"`
+	Waiting           *int     `json:"waiting,omitempty"`
+	RequestsPerSecond *float64 `json:"requestsPerSecond,omitempty"`
 }
 
 // NodeStore contains information on the status of the store
@@ -71,11 +84,21 @@ type NodeStore struct {
 	Healthy bool `json:"healthy"`
 }
 
+// NodeCache contains information on the usage of the cache of app bundles
+type NodeCache struct {
+	// Number of bundles in the cache and their total size, in bytes
+	Bundles int   `json:"bundles"`
+	Size    int64 `json:"size"`
+	// Size budget for the cache, in bytes; bundles in use by sites are kept even if the cache is larger
+	MaxSize int64 `json:"maxSize,omitempty"`
+}
+
 // NodeStatus contains the current status of the node
 type NodeStatus struct {
 	NodeName string       `json:"name"`
 	Nginx    NginxStatus  `json:"nginx"`
 	Sync     NodeSync     `json:"sync"`
 	Store    NodeStore    `json:"store"`
+	Cache    *NodeCache   `json:"cache,omitempty"`
 	Health   []SiteHealth `json:"health"`
 }
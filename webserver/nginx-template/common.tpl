@@ -0,0 +1,220 @@
+{{/* Templates shared by the configuration of sites and of the default site */}}
+
+{{define "manifesthttp"}}
+{{range $name, $u := .Item.App.Manifest.CleanUpstreams}}
+# Upstream group
+upstream {{$name}} {
+    {{if $u.CleanMethod}}
+        {{$u.CleanMethod}};
+    {{- end}}
+    {{range $u.Servers}}
+        server {{.Address}}{{if .Weight}} weight={{.Weight}}{{end}}{{if .MaxFails}} max_fails={{.MaxFails}}{{end}}{{if .FailTimeout}} fail_timeout={{.FailTimeout}}{{end}}{{if .Backup}} backup{{end}};
+    {{- end}}
+}
+{{- end}}
+
+{{with .Item.App.Manifest.CleanBulkRedirects}}
+# Table of bulk redirects
+map $uri {{.Variable}} {
+    default "";
+    {{range $from, $to := .CleanMap}}
+        {{$from}} {{$to}};
+    {{- end}}
+}
+{{- end}}
+
+{{with .Item.App.Manifest.CleanI18n}}
+# Language negotiation
+map $http_accept_language {{.AcceptVariable}} {
+    default "{{.Default}}";
+    {{range .MapEntries}}
+        {{.}};
+    {{- end}}
+}
+{{- if .Cookie}}
+map $cookie_{{.Cookie}} {{.Variable}} {
+    default {{.AcceptVariable}};
+    {{range .Languages}}
+        "{{.}}" "{{.}}";
+    {{- end}}
+}
+{{- end}}
+{{- end}}
+
+{{range $k, $v := .Item.App.Manifest.Locations}}
+{{- with $v.CORS}}{{if .Variable}}
+# Allowed origins for the CORS policy of the location {{$k}}
+map $http_origin {{.Variable}} {
+    default "";
+    {{range .MapEntries}}
+        {{.}};
+    {{- end}}
+}
+{{- end}}{{end}}
+{{- end}}
+{{end}}
+
+{{define "manifestserver"}}
+    # Bulk redirects
+    {{with .Item.App.Manifest.CleanBulkRedirects}}
+        if ({{.Variable}}) {
+            return {{.Status}} {{.Variable}}{{if .PreserveQuery}}$is_args$args{{end}};
+        }
+    {{- end}}
+
+    # Error pages
+    # Locations of error pages are internal so they can't be requested directly
+    {{range $page, $codes := .Item.App.Manifest.CleanErrorPages}}
+        error_page {{$codes}} {{$page}};
+        location = {{$page}} {
+            internal;
+        }
+    {{- end}}
+    {{if .Item.App.Manifest.ProxyErrorCodes}}
+        error_page {{.Item.App.Manifest.ProxyErrorCodes}} /.statiko/proxy-error.html;
+        location = /.statiko/proxy-error.html {
+            internal;
+            default_type text/html;
+            return 502 "<!DOCTYPE html><html><head><meta charset=\"utf-8\"><title>Service unavailable</title></head><body><h1>Service unavailable</h1><p>The server is temporarily unable to complete your request. Please try again later.</p></body></html>";
+        }
+    {{- end}}
+
+    location / {
+        {{if and .Item.App.Manifest.Locations (index .Item.App.Manifest.Locations "/") }}
+            {{with index .Item.App.Manifest.Locations "/"}}
+                {{if not .Proxy}}
+                    try_files $uri $uri/ =404;
+                {{end}}
+                {{template "locationblock" .}}
+            {{end}}
+        {{else}}
+            try_files $uri $uri/ =404;
+        {{end}}
+    }
+
+    # Redirect the root to the folder of the visitor's language
+    {{with .Item.App.Manifest.CleanI18n}}
+        location = / {
+            add_header Vary "Accept-Language{{if .Cookie}}, Cookie{{end}}";
+            return 302 /{{.Variable}}/$is_args$args;
+        }
+    {{- end}}
+
+    # Redirects
+    {{range .Item.App.Manifest.CleanRedirects}}
+        location {{.Location}} {
+            {{if .Capture}}
+                if ($uri ~ {{.Capture}}) {
+                    return {{.Return}};
+                }
+            {{- else}}
+                return {{.Return}};
+            {{- end}}
+        }
+    {{- end}}
+
+    # Rules for specific locations/files
+    {{range $k, $v := .Item.App.Manifest.Locations}}
+        {{if not (eq $k "/")}}
+            location {{$k}} {
+                {{template "locationblock" $v}}
+            }
+        {{- end}}
+    {{- end}}
+
+    # Block access to the manifest file
+    location = /{{.ManifestFile}} {
+        return 404;
+    }
+
+    # Rewrites
+    {{range $k, $v := .Item.App.Manifest.Rewrite}}
+        rewrite {{$k}} {{$v}} last;
+    {{- end}}
+{{end}}
+
+{{define "locationblock"}}
+    {{if and (not (eq .ClientCaching "")) (not (eq .ClientCaching "0"))}}
+        expires "{{.ClientCaching}}";
+        add_header Pragma public;
+        add_header Cache-Control "public";
+    {{- end}}
+    {{range $hk, $hv := .CleanHeaders}}
+        add_header "{{$hk}}" "{{$hv}}";
+    {{- end}}
+    {{if .CanaryCookie}}
+        add_header Set-Cookie "{{.CanaryCookie}}";
+    {{- end}}
+    {{if .RequireClientCert}}
+        if ($ssl_client_verify != SUCCESS) {
+            return 403;
+        }
+    {{- end}}
+    {{with .RateLimit}}
+        {{template "ratelimit" .}}
+    {{- end}}
+    {{with .CORS}}
+        {{template "corsheaders" .}}
+        if ($request_method = OPTIONS) {
+            {{template "corsheaders" .}}
+            add_header Access-Control-Allow-Methods "{{.CleanMethods}}" always;
+            {{if .CleanHeaders}}
+                add_header Access-Control-Allow-Headers "{{.CleanHeaders}}" always;
+            {{- end}}
+            {{if .MaxAge}}
+                add_header Access-Control-Max-Age {{.MaxAge}} always;
+            {{- end}}
+            return 204;
+        }
+    {{- end}}
+    {{if .Proxy}}
+        {{with .ProxyOptions}}
+            {{range $hk, $hv := .CleanHeaders}}
+                proxy_set_header "{{$hk}}" "{{$hv}}";
+            {{- end}}
+            {{if .ConnectTimeout}}
+                proxy_connect_timeout {{.ConnectTimeout}};
+            {{- end}}
+            {{if .ReadTimeout}}
+                proxy_read_timeout {{.ReadTimeout}};
+            {{- end}}
+            {{if .WebSocket}}
+                proxy_http_version 1.1;
+                proxy_set_header Upgrade $http_upgrade;
+                proxy_set_header Connection $connection_upgrade;
+            {{- end}}
+            {{if .CleanBuffering}}
+                proxy_buffering {{.CleanBuffering}};
+            {{- end}}
+            {{if .TLSServerName}}
+                proxy_ssl_server_name on;
+                proxy_ssl_name {{.TLSServerName}};
+            {{- end}}
+            {{if .TLSVerify}}
+                proxy_ssl_verify on;
+            {{- end}}
+        {{- end}}
+        proxy_pass {{.Proxy}};
+    {{- end}}
+    {{if .Deny}}
+        return 404;
+    {{- end}}
+{{end}}
+
+{{define "ratelimit"}}
+    limit_req zone={{.Zone}}{{if .Burst}} burst={{.Burst}}{{end}}{{if .NoDelay}} nodelay{{end}};
+    limit_req_status {{.Status}};
+{{end}}
+
+{{define "corsheaders"}}
+    add_header Access-Control-Allow-Origin "{{.AllowOrigin}}" always;
+    {{if .Variable}}
+        add_header Vary Origin always;
+    {{- end}}
+    {{if .Credentials}}
+        add_header Access-Control-Allow-Credentials true always;
+    {{- end}}
+    {{if .CleanExposeHeaders}}
+        add_header Access-Control-Expose-Headers "{{.CleanExposeHeaders}}" always;
+    {{- end}}
+{{end}}
@@ -19,14 +19,23 @@ package webserver
 import (
 	"bytes"
 	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"net"
+	"net/http"
 	"net/url"
 	"os"
 	"os/exec"
+	"path"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"text/template"
+	"time"
 
 	"github.com/statiko-dev/statiko/appconfig"
 	"github.com/statiko-dev/statiko/state"
@@ -38,14 +47,74 @@ import (
 // List of template files
 var templateFiles = [4]string{"nginx.conf", "mime.types", "site.conf", "default-site.conf"}
 
+// Embedded file with templates that are shared by sites and the default site
+const commonTemplateFile = "common.tpl"
+
+// Name of the cookie that keeps visitors on the same app during canary releases
+const canaryCookieName = "statiko_canary"
+
 // ConfigData is a map of each configuration file and its content
 type ConfigData map[string][]byte
 
+// Options for the maintenance mode of a site, passed to the templates
+type maintenanceConfig struct {
+	// Name of the variable that is set when the site should show the maintenance page
+	Variable   string
+	Page       string
+	RetryAfter int
+	AllowIPs   []string
+}
+
+// Options for the canary release of a site, passed to the templates
+type canaryConfig struct {
+	// Name of the variable containing the webroot folder for the request ("www" or "www-canary")
+	Variable string
+	// Names of the variables with the result of split_clients and the value for the sticky cookie
+	SplitVariable  string
+	CookieVariable string
+	// Name of the sticky cookie and value for the Set-Cookie header
+	CookieName string
+	Cookie     string
+	Percentage int
+	// Names of the apps, escaped for use in strings in the configuration
+	App       string
+	StableApp string
+}
+
+// Options for the default site, passed to the templates
+type defaultSiteConfig struct {
+	// True if the default site serves an app, whose manifest is in the Item object
+	App  bool
+	Drop bool
+	// True if the default site has its own TLS certificate
+	TLS bool
+}
+
 // NginxConfig creates the configuration for nginx
 type NginxConfig struct {
 	logger              *log.Logger
 	templates           map[string]*template.Template
 	clientCachingRegexp *regexp.Regexp
+	timeoutRegexp       *regexp.Regexp
+	hostnameRegexp      *regexp.Regexp
+	upstreamNameRegexp  *regexp.Regexp
+	serverAddrRegexp    *regexp.Regexp
+	languageRegexp      *regexp.Regexp
+	cookieNameRegexp    *regexp.Regexp
+	corsOriginRegexp    *regexp.Regexp
+	httpMethodRegexp    *regexp.Regexp
+
+	// Zones for rate limiting, set by DesiredConfiguration while generating nginx.conf
+	rateLimitZones []utils.RateLimit
+
+	// Options for the default site, set by DesiredConfiguration while generating its configuration
+	defaultSite defaultSiteConfig
+
+	// Client for requesting metrics, and number of requests at the time of the last request, used to compute the rate
+	metricsClient       *http.Client
+	metricsLock         sync.Mutex
+	metricsLastRequests int64
+	metricsLastTime     time.Time
 }
 
 // Init initializes the object and loads the templates from file
@@ -53,6 +122,11 @@ func (n *NginxConfig) Init() error {
 	// Logger
 	n.logger = log.New(os.Stdout, "nginx: ", log.Ldate|log.Ltime|log.LUTC)
 
+	// Client for requesting metrics from the local server
+	n.metricsClient = &http.Client{
+		Timeout: 1500 * time.Millisecond,
+	}
+
 	// Load the templates
 	n.templates = make(map[string]*template.Template, len(templateFiles))
 	if err := n.loadTemplates(); err != nil {
@@ -62,23 +136,27 @@ func (n *NginxConfig) Init() error {
 	// Compile the regular expression for matching ClientCaching values in apps' manifests
 	n.clientCachingRegexp = regexp.MustCompile(`^[1-9][0-9]*(ms|s|m|h|d|w|M|y)$`)
 
+	// Compile the regular expression for matching timeouts in apps' manifests
+	n.timeoutRegexp = regexp.MustCompile(`^[1-9][0-9]*(ms|s|m|h)$`)
+
+	// Compile the regular expression for matching hostnames in apps' manifests
+	n.hostnameRegexp = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9\-\.]*[A-Za-z0-9])?$`)
+
+	// Compile the regular expressions for matching names and server addresses of upstreams, languages, cookie names, and CORS origins and methods in apps' manifests
+	n.upstreamNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_\-]+$`)
+	n.languageRegexp = regexp.MustCompile(`^[a-z]{2,3}(-[a-z0-9]{2,8})*$`)
+	n.cookieNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+	n.corsOriginRegexp = regexp.MustCompile(`^https?://(\*\.)?[a-z0-9\-]+(\.[a-z0-9\-]+)*(:[0-9]{1,5})?$`)
+	n.httpMethodRegexp = regexp.MustCompile(`^[A-Z]+$`)
+	n.serverAddrRegexp = regexp.MustCompile(`^(\[[0-9A-Fa-f:\.]+\]|[A-Za-z0-9]([A-Za-z0-9\-\.]*[A-Za-z0-9])?)(:[0-9]{1,5})?$`)
+
 	return nil
 }
 
 // DesiredConfiguration builds the list of files for the desired configuration for nginx
-func (n *NginxConfig) DesiredConfiguration(sites []state.SiteState) (config ConfigData, err error) {
+func (n *NginxConfig) DesiredConfiguration(sites []state.SiteState, defaultSite *state.NodeDefaultSite) (config ConfigData, err error) {
 	config = make(ConfigData)
 
-	// Basic webserver configuration
-	config["nginx.conf"], err = n.createConfigurationFile("nginx.conf", nil)
-	if err != nil {
-		return
-	}
-	if config["nginx.conf"] == nil {
-		err = errors.New("Invalid configuration generated for file nginx.conf")
-		return
-	}
-
 	config["mime.types"], err = n.createConfigurationFile("mime.types", nil)
 	if err != nil {
 		return
@@ -88,8 +166,23 @@ func (n *NginxConfig) DesiredConfiguration(sites []state.SiteState) (config Conf
 		return
 	}
 
+	// Collect the zones for rate limiting, which are defined in nginx.conf
+	zones := make([]utils.RateLimit, 0)
+
 	// Default website configuration
-	config["conf.d/_default.conf"], err = n.createConfigurationFile("default-site.conf", nil)
+	// If the default site has an error, the built-in one is used
+	var defaultItem *state.SiteState
+	if state.Instance.GetSiteHealth("_default") != nil {
+		n.logger.Println("Using the built-in default site because of an error (in DesiredConfiguration)")
+		defaultSite = nil
+	}
+	if defaultSite != nil && defaultSite.App != nil {
+		defaultItem = &state.SiteState{
+			Domain: "_default",
+			App:    defaultSite.App,
+		}
+	}
+	config["conf.d/_default.conf"], err = n.createDefaultSiteConfiguration(defaultSite, defaultItem)
 	if err != nil {
 		return
 	}
@@ -97,6 +190,13 @@ func (n *NginxConfig) DesiredConfiguration(sites []state.SiteState) (config Conf
 		err = errors.New("Invalid configuration generated for file conf.d/_default.conf")
 		return
 	}
+	if defaultItem != nil {
+		for _, l := range defaultItem.App.Manifest.Locations {
+			if l.RateLimit != nil {
+				zones = append(zones, *l.RateLimit)
+			}
+		}
+	}
 
 	// Configuration for each site
 	for _, s := range sites {
@@ -117,11 +217,51 @@ func (n *NginxConfig) DesiredConfiguration(sites []state.SiteState) (config Conf
 			return
 		}
 		config[key] = val
+
+		if s.RateLimit != nil {
+			zones = append(zones, *s.RateLimit)
+		}
+		for _, l := range s.App.Manifest.Locations {
+			if l.RateLimit != nil {
+				zones = append(zones, *l.RateLimit)
+			}
+		}
+	}
+	sort.Slice(zones, func(i, j int) bool {
+		return zones[i].Zone < zones[j].Zone
+	})
+
+	// Basic webserver configuration
+	n.rateLimitZones = zones
+	config["nginx.conf"], err = n.createConfigurationFile("nginx.conf", nil)
+	n.rateLimitZones = nil
+	if err != nil {
+		return
+	}
+	if config["nginx.conf"] == nil {
+		err = errors.New("Invalid configuration generated for file nginx.conf")
+		return
 	}
 
 	return
 }
 
+// Create the configuration file for the default site
+// If item is not nil, it contains the app that the default site serves
+func (n *NginxConfig) createDefaultSiteConfiguration(defaultSite *state.NodeDefaultSite, item *state.SiteState) ([]byte, error) {
+	n.defaultSite = defaultSiteConfig{}
+	if defaultSite != nil {
+		n.defaultSite = defaultSiteConfig{
+			App:  item != nil,
+			Drop: defaultSite.Drop,
+			TLS:  defaultSite.TLS != nil,
+		}
+	}
+	val, err := n.createConfigurationFile("default-site.conf", item)
+	n.defaultSite = defaultSiteConfig{}
+	return val, err
+}
+
 // ExistingConfiguration reads the list of files currently on disk, and deletes some extraneous ones already
 func (n *NginxConfig) ExistingConfiguration(sites []state.SiteState) (ConfigData, bool, error) {
 	nginxConfPath := appconfig.Config.GetString("nginx.configPath")
@@ -217,12 +357,12 @@ func (n *NginxConfig) ExistingConfiguration(sites []state.SiteState) (ConfigData
 }
 
 // SyncConfiguration ensures that the configuration for the webserver matches the desired state
-func (n *NginxConfig) SyncConfiguration(sites []state.SiteState) (bool, error) {
+func (n *NginxConfig) SyncConfiguration(sites []state.SiteState, defaultSite *state.NodeDefaultSite) (bool, error) {
 	nginxConfPath := appconfig.Config.GetString("nginx.configPath")
 	updated := false
 
 	// Generate the desired configuration
-	desired, err := n.DesiredConfiguration(sites)
+	desired, err := n.DesiredConfiguration(sites, defaultSite)
 	if err != nil {
 		return false, err
 	}
@@ -242,9 +382,37 @@ func (n *NginxConfig) SyncConfiguration(sites []state.SiteState) (bool, error) {
 		return false, err
 	}
 
+	// Previous content of the files that are changed, so they can be reverted if the configuration isn't valid; nil values are for files that didn't exist
+	previous := make(map[string][]byte)
+
+	// Files are written in order, with nginx.conf and the other shared files before the sites' ones, as sites can reference objects defined in nginx.conf (such as zones for rate limiting)
+	// Sites' files that are going to be replaced are removed first, so outdated ones don't reference objects that were removed from nginx.conf while the configuration is tested
+	keys := make([]string, 0, len(desired))
+	for key, val := range desired {
+		keys = append(keys, key)
+		existingVal, ok := existing[key]
+		if ok && existingVal != nil && strings.HasPrefix(key, "conf.d/") && key != "conf.d/_default.conf" && bytes.Compare(val, existingVal) != 0 {
+			if err := os.Remove(nginxConfPath + key); err != nil {
+				return false, err
+			}
+			previous[key] = existingVal
+			delete(existing, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		iSite := strings.HasPrefix(keys[i], "conf.d/")
+		jSite := strings.HasPrefix(keys[j], "conf.d/")
+		if iSite != jSite {
+			return jSite
+		}
+		return keys[i] < keys[j]
+	})
+
 	// Iterate through the desired state looking for missing keys and different files
 	// We're guaranteed that the existing state does not contain any extraenous file already
-	for key, val := range desired {
+	sharedWritten := false
+	for i, key := range keys {
+		val := desired[key]
 		written := false
 		// Check if the file exists already
 		existingVal, ok := existing[key]
@@ -255,6 +423,9 @@ func (n *NginxConfig) SyncConfiguration(sites []state.SiteState) (bool, error) {
 				updated = true
 				written = true
 				n.logger.Println("Replacing configuration file", nginxConfPath+key)
+				if _, found := previous[key]; !found {
+					previous[key] = existingVal
+				}
 				if err := writeConfigFile(nginxConfPath+key, val); err != nil {
 					return false, err
 				}
@@ -264,11 +435,25 @@ func (n *NginxConfig) SyncConfiguration(sites []state.SiteState) (bool, error) {
 			updated = true
 			written = true
 			n.logger.Println("Creating configuration file", nginxConfPath+key)
+			if _, found := previous[key]; !found {
+				previous[key] = existingVal
+			}
 			if err := writeConfigFile(nginxConfPath+key, val); err != nil {
 				return false, err
 			}
 		}
 
+		// After writing nginx.conf and the other shared files, test the configuration before the sites' files, as an error in the shared files affects all sites
+		if written && !strings.HasPrefix(key, "conf.d/") {
+			sharedWritten = true
+		}
+		if sharedWritten && (i == len(keys)-1 || strings.HasPrefix(keys[i+1], "conf.d/")) {
+			sharedWritten = false
+			if err := n.testOrRevertConfiguration(previous); err != nil {
+				return false, err
+			}
+		}
+
 		// If we wrote a config file for a site, test the nginx configuration to see if there's any error
 		if written && strings.HasPrefix(key, "conf.d/") && key != "conf.d/_default.conf" {
 			configOk, err := n.ConfigTest()
@@ -293,11 +478,63 @@ func (n *NginxConfig) SyncConfiguration(sites []state.SiteState) (bool, error) {
 				}
 			}
 		}
+
+		// If the default site serves an app, test the configuration too, and revert to the built-in default site if there's any error
+		if written && key == "conf.d/_default.conf" && defaultSite != nil && defaultSite.App != nil {
+			configOk, err := n.ConfigTest()
+			if err != nil {
+				return false, err
+			}
+			if !configOk {
+				n.logger.Println("Error in configuration file", nginxConfPath+key, " - using the built-in default site")
+				state.Instance.SetSiteHealth("_default", errors.New("invalid nginx configuration - check manifest"))
+
+				val, err := n.createDefaultSiteConfiguration(nil, nil)
+				if err != nil {
+					return false, err
+				}
+				if err := writeConfigFile(nginxConfPath+key, val); err != nil {
+					return false, err
+				}
+			}
+		}
+	}
+
+	// Lastly, test the full configuration
+	if updated {
+		if err := n.testOrRevertConfiguration(previous); err != nil {
+			return false, err
+		}
 	}
 
 	return updated, nil
 }
 
+// Tests the nginx configuration and, if it's not valid, reverts the files that were changed to their previous content
+// The map contains the previous content of the files, or nil for files that didn't exist
+func (n *NginxConfig) testOrRevertConfiguration(previous map[string][]byte) error {
+	configOk, err := n.ConfigTest()
+	if err != nil {
+		return err
+	}
+	if configOk {
+		return nil
+	}
+
+	n.logger.Println("Error in the configuration - reverting changes")
+	nginxConfPath := appconfig.Config.GetString("nginx.configPath")
+	for key, val := range previous {
+		if val == nil {
+			if err := os.Remove(nginxConfPath + key); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		} else if err := writeConfigFile(nginxConfPath+key, val); err != nil {
+			return err
+		}
+	}
+	return errors.New("invalid nginx configuration - changes reverted")
+}
+
 // Status returns the status of the Nginx server
 func (n *NginxConfig) Status() (bool, error) {
 	result, err := exec.Command("sh", "-c", appconfig.Config.GetString("nginx.commands.status")).Output()
@@ -315,6 +552,69 @@ func (n *NginxConfig) Status() (bool, error) {
 	return running, nil
 }
 
+// Metrics returns the metrics from the stub_status module of the Nginx server
+// The rate of requests is computed since the previous time this method was invoked, and it's nil the first time
+func (n *NginxConfig) Metrics() (*utils.NginxStatus, error) {
+	resp, err := n.metricsClient.Get("http://127.0.0.1:" + appconfig.Config.GetString("nginx.statusPort") + "/nginx_status")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("invalid status code: %d", resp.StatusCode)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+
+	// Response is in the format:
+	//   Active connections: 2
+	//   server accepts handled requests
+	//    16 16 31
+	//   Reading: 0 Writing: 1 Waiting: 1
+	var active, reading, writing, waiting int
+	var accepts, handled, requests int64
+	lines := strings.Split(strings.TrimSpace(string(body)), "\n")
+	if len(lines) != 4 {
+		return nil, errors.New("invalid response from stub_status")
+	}
+	if _, err := fmt.Sscanf(strings.TrimSpace(lines[0]), "Active connections: %d", &active); err != nil {
+		return nil, err
+	}
+	if _, err := fmt.Sscanf(strings.TrimSpace(lines[2]), "%d %d %d", &accepts, &handled, &requests); err != nil {
+		return nil, err
+	}
+	if _, err := fmt.Sscanf(strings.TrimSpace(lines[3]), "Reading: %d Writing: %d Waiting: %d", &reading, &writing, &waiting); err != nil {
+		return nil, err
+	}
+
+	res := &utils.NginxStatus{
+		Running:           true,
+		ActiveConnections: &active,
+		Reading:           &reading,
+		Writing:           &writing,
+		Waiting:           &waiting,
+	}
+
+	// Compute the rate of requests since the last time
+	// The counter is reset when the server is restarted, so skip this if it has decreased
+	n.metricsLock.Lock()
+	if !n.metricsLastTime.IsZero() && requests >= n.metricsLastRequests {
+		elapsed := now.Sub(n.metricsLastTime).Seconds()
+		if elapsed > 0 {
+			rps := float64(requests-n.metricsLastRequests) / elapsed
+			res.RequestsPerSecond = &rps
+		}
+	}
+	n.metricsLastRequests = requests
+	n.metricsLastTime = now
+	n.metricsLock.Unlock()
+
+	return res, nil
+}
+
 // ConfigTest runs the Nginx's config test command and returns whether the configuration is valid
 func (n *NginxConfig) ConfigTest() (bool, error) {
 	result, err := exec.Command("sh", "-c", appconfig.Config.GetString("nginx.commands.test")).Output()
@@ -392,21 +692,119 @@ func (n *NginxConfig) loadTemplates() error {
 		"joinList": func(slice []string, separator string) string {
 			return strings.Join(slice, separator)
 		},
+		// Escapes a value to be used in a quoted string in the configuration
+		"escape": escapeConfigString,
+		// Returns a quoted string, escaping special characters but not variables
+		"quote": quoteConfigString,
+		"lower": strings.ToLower,
+		"upper": strings.ToUpper,
+		"split": strings.Split,
+		"replace": func(in, old, new string) string {
+			return strings.ReplaceAll(in, old, new)
+		},
+		"contains":  strings.Contains,
+		"hasPrefix": strings.HasPrefix,
+		"hasSuffix": strings.HasSuffix,
+		// Returns the value, or def if the value is empty or missing
+		"default": func(def string, val interface{}) string {
+			if str, ok := val.(string); ok && str != "" {
+				return str
+			}
+			return def
+		},
+	}
+
+	// Files in the override directory, if configured, replace the embedded templates with the same name
+	// Additionally, all files with the .tpl extension are parsed in every template, so they can define blocks such as "httpExtra" and "serverExtra", or redefine the ones in the embedded templates
+	overridePath := appconfig.Config.GetString("nginx.templatesPath")
+	partials := make([]string, 0)
+	if overridePath != "" {
+		if !strings.HasSuffix(overridePath, "/") {
+			overridePath += "/"
+		}
+		files, err := ioutil.ReadDir(overridePath)
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			if !f.IsDir() && strings.HasSuffix(f.Name(), ".tpl") {
+				partials = append(partials, overridePath+f.Name())
+			}
+		}
+		sort.Strings(partials)
+	}
+
+	// Templates shared by sites and the default site, which are parsed in every template before the files in the override directory
+	common, err := box.FindString(commonTemplateFile)
+	if err != nil {
+		return err
 	}
 
 	// Read all templates from the list
 	for i := 0; i < len(templateFiles); i++ {
-		str, err := box.FindString(templateFiles[i])
+		var str string
+		exists := false
+		if overridePath != "" {
+			var err error
+			exists, err = utils.FileExists(overridePath + templateFiles[i])
+			if err != nil {
+				return err
+			}
+		}
+		if exists {
+			n.logger.Println("Using template from the override directory:", overridePath+templateFiles[i])
+			read, err := ioutil.ReadFile(overridePath + templateFiles[i])
+			if err != nil {
+				return err
+			}
+			str = string(read)
+		} else {
+			var err error
+			str, err = box.FindString(templateFiles[i])
+			if err != nil {
+				return err
+			}
+		}
+		tpl, err := template.New(templateFiles[i]).Funcs(funcMap).Parse(str)
 		if err != nil {
 			return err
 		}
-		tpl, err := template.New(templateFiles[i]).Funcs(funcMap).Parse(str)
+		tpl, err = tpl.Parse(common)
 		if err != nil {
 			return err
 		}
+		for _, p := range partials {
+			read, err := ioutil.ReadFile(p)
+			if err != nil {
+				return err
+			}
+			tpl, err = tpl.Parse(string(read))
+			if err != nil {
+				return fmt.Errorf("error parsing template %s: %v", p, err)
+			}
+		}
 		n.templates[templateFiles[i]] = tpl
 	}
 
+	// Validate the templates by executing them with sample data, so errors are reported at startup rather than while syncing
+	if overridePath != "" {
+		sample := &state.SiteState{
+			Domain: "example.com",
+			TLS: &state.SiteTLS{
+				Type: state.TLSCertificateSelfSigned,
+			},
+		}
+		for i := 0; i < len(templateFiles); i++ {
+			var item *state.SiteState
+			if templateFiles[i] == "site.conf" {
+				item = sample
+			}
+			if _, err := n.createConfigurationFile(templateFiles[i], item); err != nil {
+				return fmt.Errorf("error executing template %s: %v", templateFiles[i], err)
+			}
+		}
+	}
+
 	return nil
 }
 
@@ -418,6 +816,12 @@ func (n *NginxConfig) createConfigurationFile(templateName string, itemData *sta
 		protocol = "https"
 	}
 
+	// App root
+	appRoot := appconfig.Config.GetString("appRoot")
+	if !strings.HasSuffix(appRoot, "/") {
+		appRoot += "/"
+	}
+
 	// Ensure that itemData.App.Manifest is set
 	if itemData != nil {
 		if itemData.App == nil {
@@ -427,6 +831,34 @@ func (n *NginxConfig) createConfigurationFile(templateName string, itemData *sta
 			itemData.App.Manifest = &utils.AppManifest{}
 		}
 
+		// Parse and validate the upstreams in the app's manifest
+		// Names of upstreams are namespaced with the site, so they don't collide with other sites'
+		upstreams := make(map[string]string)
+		itemData.App.Manifest.CleanUpstreams = make(map[string]utils.ManifestUpstream)
+		for name, u := range itemData.App.Manifest.Upstreams {
+			if !n.upstreamNameRegexp.MatchString(name) {
+				n.logger.Println("Ignoring upstream with invalid name:", name)
+				continue
+			}
+			clean, ok := n.sanitizeManifestUpstream(u)
+			if !ok {
+				n.logger.Println("Ignoring upstream with no valid servers:", name)
+				continue
+			}
+			upstreamName := "site_" + siteKey(itemData.Domain) + "_" + name
+			itemData.App.Manifest.CleanUpstreams[upstreamName] = clean
+			if clean.TLS {
+				upstreams[name] = "https://" + upstreamName
+			} else {
+				upstreams[name] = "http://" + upstreamName
+			}
+		}
+
+		// Rate limit for the site
+		if itemData.RateLimit != nil {
+			itemData.RateLimit = n.sanitizeRateLimit(*itemData.RateLimit, "site_"+siteKey(itemData.Domain))
+		}
+
 		// Parse and validate the app's manifest
 		itemData.App.Manifest.Locations = make(map[string]utils.ManifestRuleOptions)
 		if itemData.App.Manifest.Rules != nil && len(itemData.App.Manifest.Rules) > 0 {
@@ -479,60 +911,164 @@ func (n *NginxConfig) createConfigurationFile(templateName string, itemData *sta
 				}
 
 				// Sanitize rule options
-				options := n.sanitizeManifestRuleOptions(v.Options)
+				options := n.sanitizeManifestRuleOptions(v.Options, upstreams)
+				if options.RateLimit != nil {
+					options.RateLimit = n.sanitizeRateLimit(*options.RateLimit, "site_"+siteKey(itemData.Domain)+"_"+utils.SHA256String(location)[:8])
+				}
+				if options.CORS != nil {
+					options.CORS = n.sanitizeManifestCORS(*options.CORS, "$site_"+siteKey(itemData.Domain)+"_cors_"+utils.SHA256String(location)[:8])
+				}
 
 				// Add the element
 				itemData.App.Manifest.Locations[location] = options
 			}
 		}
 
-		// Ensure that Page404 and Page403 don't start with a /
-		if len(itemData.App.Manifest.Page404) > 1 && itemData.App.Manifest.Page404[0] == '/' {
-			itemData.App.Manifest.Page404 = itemData.App.Manifest.Page404[1:]
+		// Parse and validate the redirects
+		itemData.App.Manifest.CleanRedirects = n.sanitizeManifestRedirects(itemData.App.Manifest.Redirects.Rules, itemData.App.Manifest.Locations)
+		itemData.App.Manifest.CleanBulkRedirects = nil
+		if itemData.App.Manifest.Redirects.Bulk != nil {
+			itemData.App.Manifest.CleanBulkRedirects = n.sanitizeManifestBulkRedirects(*itemData.App.Manifest.Redirects.Bulk, itemData.Domain)
 		}
-		if len(itemData.App.Manifest.Page403) > 1 && itemData.App.Manifest.Page403[0] == '/' {
-			itemData.App.Manifest.Page403 = itemData.App.Manifest.Page403[1:]
+
+		// Language negotiation
+		itemData.App.Manifest.CleanI18n = nil
+		if itemData.App.Manifest.I18n != nil {
+			_, found := itemData.App.Manifest.Locations["= /"]
+			for _, r := range itemData.App.Manifest.CleanRedirects {
+				if r.Location == "= /" {
+					found = true
+					break
+				}
+			}
+			if found {
+				n.logger.Println("Ignoring i18n options because a rule or redirect for the location = / is already defined")
+			} else {
+				itemData.App.Manifest.CleanI18n = n.sanitizeManifestI18n(*itemData.App.Manifest.I18n, appRoot+"apps/"+itemData.App.Name, itemData.Domain)
+			}
+		}
+
+		// Error pages
+		// Page403 and Page404 are used only if the same status codes aren't in ErrorPages already
+		errorPages := make(map[string]string, len(itemData.App.Manifest.ErrorPages)+2)
+		for k, v := range itemData.App.Manifest.ErrorPages {
+			errorPages[k] = v
+		}
+		if _, found := errorPages["403"]; !found && itemData.App.Manifest.Page403 != "" {
+			errorPages["403"] = itemData.App.Manifest.Page403
+		}
+		if _, found := errorPages["404"]; !found && itemData.App.Manifest.Page404 != "" {
+			errorPages["404"] = itemData.App.Manifest.Page404
+		}
+		itemData.App.Manifest.CleanErrorPages = n.sanitizeManifestErrorPages(errorPages, appRoot+"apps/"+itemData.App.Name, itemData.App.Manifest.Locations)
+
+		// If the site has proxy rules, use the built-in page for 502 and 504 errors, unless the app has its own
+		itemData.App.Manifest.ProxyErrorCodes = ""
+		for _, l := range itemData.App.Manifest.Locations {
+			if l.Proxy == "" {
+				continue
+			}
+			codes := make([]string, 0, 2)
+			for _, code := range []string{"502", "504"} {
+				found := false
+				for _, list := range itemData.App.Manifest.CleanErrorPages {
+					if utils.StringInSlice(strings.Split(list, " "), code) {
+						found = true
+						break
+					}
+				}
+				if !found {
+					codes = append(codes, code)
+				}
+			}
+			itemData.App.Manifest.ProxyErrorCodes = strings.Join(codes, " ")
+			break
 		}
 	}
 
-	// App root
-	appRoot := appconfig.Config.GetString("appRoot")
-	if !strings.HasSuffix(appRoot, "/") {
-		appRoot += "/"
+	// Maintenance mode
+	var maintenance *maintenanceConfig
+	if itemData != nil && itemData.Maintenance != nil && itemData.Maintenance.Enabled {
+		maintenance = n.sanitizeMaintenance(itemData, appRoot)
+	}
+
+	// Canary release
+	var canary *canaryConfig
+	if itemData != nil && itemData.Canary != nil && itemData.Canary.App != nil {
+		canary = n.sanitizeCanary(itemData)
+		if canary != nil {
+			// The sticky cookie is added to every location that serves content, as add_header directives in a location override those in the server block
+			for k, v := range itemData.App.Manifest.Locations {
+				v.CanaryCookie = canary.Cookie
+				itemData.App.Manifest.Locations[k] = v
+			}
+		}
+	}
+
+	// Per-node variables for the templates
+	// Note that names are lowercased by the configuration parser
+	vars := appconfig.Config.GetStringMapString("nginx.templateVars")
+	if vars == nil {
+		vars = make(map[string]string)
+	}
+
+	// Maximum length of the chain of client certificates, for sites that authenticate clients
+	clientVerifyDepth := appconfig.Config.GetInt("tls.clientVerifyDepth")
+	if clientVerifyDepth < 1 {
+		n.logger.Println("Ignoring invalid value for tls.clientVerifyDepth:", clientVerifyDepth)
+		clientVerifyDepth = 3
 	}
 
 	// Get parameters
 	tplData := struct {
-		Item         *state.SiteState
-		AppRoot      string
-		Port         string
-		Protocol     string
-		ManifestFile string
-		User         string
-		TLS          struct {
-			Dhparams string
-			Node     struct {
+		Item           *state.SiteState
+		DefaultSite    defaultSiteConfig
+		Maintenance    *maintenanceConfig
+		Canary         *canaryConfig
+		RateLimitZones []utils.RateLimit
+		Vars           map[string]string
+		AppRoot        string
+		Port           string
+		StatusPort     string
+		Protocol       string
+		ManifestFile   string
+		User           string
+		TLS            struct {
+			Dhparams                string
+			ProxyTrustedCertificate string
+			ClientVerifyDepth       int
+			Node                    struct {
 				Enabled     bool
 				Certificate string
 				Key         string
 			}
 		}
 	}{
-		Item:         itemData,
-		AppRoot:      appRoot,
-		Port:         appconfig.Config.GetString("port"),
-		Protocol:     protocol,
-		ManifestFile: appconfig.Config.GetString("manifestFile"),
-		User:         appconfig.Config.GetString("nginx.user"),
+		Item:           itemData,
+		DefaultSite:    n.defaultSite,
+		Maintenance:    maintenance,
+		Canary:         canary,
+		RateLimitZones: n.rateLimitZones,
+		Vars:           vars,
+		AppRoot:        appRoot,
+		Port:           appconfig.Config.GetString("port"),
+		StatusPort:     appconfig.Config.GetString("nginx.statusPort"),
+		Protocol:       protocol,
+		ManifestFile:   appconfig.Config.GetString("manifestFile"),
+		User:           appconfig.Config.GetString("nginx.user"),
 		TLS: struct {
-			Dhparams string
-			Node     struct {
+			Dhparams                string
+			ProxyTrustedCertificate string
+			ClientVerifyDepth       int
+			Node                    struct {
 				Enabled     bool
 				Certificate string
 				Key         string
 			}
 		}{
-			Dhparams: appRoot + "misc/dhparams.pem",
+			Dhparams:                appRoot + "misc/dhparams.pem",
+			ProxyTrustedCertificate: appconfig.Config.GetString("nginx.proxyTrustedCertificate"),
+			ClientVerifyDepth:       clientVerifyDepth,
 			Node: struct {
 				Enabled     bool
 				Certificate string
@@ -558,7 +1094,8 @@ func (n *NginxConfig) createConfigurationFile(templateName string, itemData *sta
 }
 
 // Validates and sanitizes an ManifestRuleOptions object in the manifest
-func (n *NginxConfig) sanitizeManifestRuleOptions(v utils.ManifestRuleOptions) utils.ManifestRuleOptions {
+// The upstreams map contains the URL to use for proxying requests to each upstream defined in the manifest
+func (n *NginxConfig) sanitizeManifestRuleOptions(v utils.ManifestRuleOptions, upstreams map[string]string) utils.ManifestRuleOptions {
 	// If there's a ClientCaching value, ensure it's valid
 	if v.ClientCaching != "" {
 		if !n.clientCachingRegexp.MatchString(v.ClientCaching) {
@@ -581,6 +1118,18 @@ func (n *NginxConfig) sanitizeManifestRuleOptions(v utils.ManifestRuleOptions) u
 		}
 	}
 
+	// Resolve the upstream, which is used as URL for proxying
+	if v.Upstream != "" {
+		if v.Proxy != "" {
+			n.logger.Println("Ignoring upstream for rule that has a value for proxy:", v.Upstream)
+		} else if u, ok := upstreams[v.Upstream]; ok {
+			v.Proxy = u
+		} else {
+			n.logger.Println("Ignoring upstream that is not defined:", v.Upstream)
+		}
+		v.Upstream = ""
+	}
+
 	// Validate the URL for proxying
 	if v.Proxy != "" {
 		parsed, err := url.ParseRequestURI(v.Proxy)
@@ -590,9 +1139,671 @@ func (n *NginxConfig) sanitizeManifestRuleOptions(v utils.ManifestRuleOptions) u
 		}
 	}
 
+	// Options for proxying are used only if there's a proxy
+	if v.ProxyOptions != nil {
+		if v.Proxy != "" {
+			v.ProxyOptions = n.sanitizeManifestProxyOptions(*v.ProxyOptions, v.Proxy)
+		} else {
+			v.ProxyOptions = nil
+		}
+	}
+
 	return v
 }
 
+// Validates and sanitizes the options for proxying in a ManifestRuleOptions object
+// Returns a copy of the object, so the manifest isn't modified
+func (n *NginxConfig) sanitizeManifestProxyOptions(p utils.ManifestProxyOptions, proxy string) *utils.ManifestProxyOptions {
+	// Escape values in the headers for the upstream
+	p.CleanHeaders = nil
+	if p.Headers != nil && len(p.Headers) > 0 {
+		p.CleanHeaders = make(map[string]string, 0)
+		for hk, hv := range p.Headers {
+			// Filter out disallowed headers
+			if !utils.ProxyHeaderIsAllowed(hk) {
+				n.logger.Println("Ignoring invalid header for proxy:", hk)
+				continue
+			}
+			// Escape the header
+			p.CleanHeaders[escapeConfigString(hk)] = escapeConfigString(hv)
+		}
+	}
+
+	// Validate timeouts
+	if p.ConnectTimeout != "" && !n.timeoutRegexp.MatchString(p.ConnectTimeout) {
+		n.logger.Println("Ignoring invalid value for connectTimeout:", p.ConnectTimeout)
+		p.ConnectTimeout = ""
+	}
+	if p.ReadTimeout != "" && !n.timeoutRegexp.MatchString(p.ReadTimeout) {
+		n.logger.Println("Ignoring invalid value for readTimeout:", p.ReadTimeout)
+		p.ReadTimeout = ""
+	}
+
+	// Buffering is enabled by default in nginx, so we only need to set a value if it's explicitly configured
+	p.CleanBuffering = ""
+	if p.Buffering != nil {
+		if *p.Buffering {
+			p.CleanBuffering = "on"
+		} else {
+			p.CleanBuffering = "off"
+		}
+	}
+
+	// TLS options are valid for https upstreams only
+	if p.TLSVerify || p.TLSServerName != "" {
+		if !strings.HasPrefix(strings.ToLower(proxy), "https://") {
+			n.logger.Println("Ignoring TLS options for proxy with non-https upstream:", proxy)
+			p.TLSVerify = false
+			p.TLSServerName = ""
+		} else if p.TLSServerName != "" && !n.hostnameRegexp.MatchString(p.TLSServerName) {
+			n.logger.Println("Ignoring invalid value for tlsServerName:", p.TLSServerName)
+			p.TLSServerName = ""
+		}
+	}
+
+	return &p
+}
+
+// Validates and sanitizes an upstream in the manifest
+// Returns false if the upstream doesn't have any valid server
+func (n *NginxConfig) sanitizeManifestUpstream(u utils.ManifestUpstream) (utils.ManifestUpstream, bool) {
+	// Load balancing method
+	u.CleanMethod = ""
+	switch u.Method {
+	case "":
+		// Round-robin is the default
+	case "leastConn":
+		u.CleanMethod = "least_conn"
+	case "ipHash":
+		u.CleanMethod = "ip_hash"
+	case "random":
+		u.CleanMethod = "random"
+	default:
+		n.logger.Println("Ignoring invalid load balancing method for upstream:", u.Method)
+	}
+
+	// Validate all servers
+	// Note that we're creating a new slice so the manifest isn't modified
+	servers := make([]utils.ManifestUpstreamServer, 0, len(u.Servers))
+	for _, srv := range u.Servers {
+		if !n.serverAddrRegexp.MatchString(srv.Address) {
+			n.logger.Println("Ignoring upstream server with invalid address:", srv.Address)
+			continue
+		}
+		if srv.Weight < 0 || srv.Weight > 1000 {
+			n.logger.Println("Ignoring invalid weight for upstream server:", srv.Address)
+			srv.Weight = 0
+		}
+		if srv.MaxFails < 0 {
+			n.logger.Println("Ignoring invalid value for maxFails for upstream server:", srv.Address)
+			srv.MaxFails = 0
+		}
+		if srv.FailTimeout != "" && !n.timeoutRegexp.MatchString(srv.FailTimeout) {
+			n.logger.Println("Ignoring invalid value for failTimeout for upstream server:", srv.Address)
+			srv.FailTimeout = ""
+		}
+		// nginx doesn't support backup servers with the ip_hash and random methods
+		if srv.Backup && (u.CleanMethod == "ip_hash" || u.CleanMethod == "random") {
+			n.logger.Println("Ignoring backup server for upstream with load balancing method", u.Method+":", srv.Address)
+			continue
+		}
+		servers = append(servers, srv)
+	}
+	u.Servers = servers
+
+	// There must be at least one server that is not a backup one
+	for _, srv := range u.Servers {
+		if !srv.Backup {
+			return u, true
+		}
+	}
+	return u, false
+}
+
+// Validates the redirect rules in the manifest and returns the list of location blocks for them, in order
+// Redirects whose location is already used by a rule in the manifest are ignored
+func (n *NginxConfig) sanitizeManifestRedirects(rules []utils.ManifestRedirect, locations map[string]utils.ManifestRuleOptions) []utils.ManifestRedirectLocation {
+	result := make([]utils.ManifestRedirectLocation, 0, len(rules))
+	seen := make(map[string]bool, len(rules))
+	for _, v := range rules {
+		// Ensure that exactly one match type is set
+		count := 0
+		for _, str := range []string{v.Exact, v.Prefix, v.Match} {
+			if str != "" {
+				count++
+			}
+		}
+		if count != 1 {
+			n.logger.Println("Ignoring redirect that doesn't have exactly one match type")
+			continue
+		}
+
+		// Status code
+		status, ok := redirectStatusCode(v.Status)
+		if !ok {
+			n.logger.Println("Ignoring redirect with invalid status code:", v.Status)
+			continue
+		}
+
+		// Validate the destination; references to capture groups are allowed for "match" rules only
+		if !redirectDestinationValid(v.To, v.Match != "") {
+			n.logger.Println("Ignoring redirect with invalid destination:", v.To)
+			continue
+		}
+		to := v.To
+
+		// Get the location block
+		location := ""
+		capture := ""
+		if v.Exact != "" {
+			if !configPathValid(v.Exact) {
+				n.logger.Println("Ignoring redirect with invalid path:", v.Exact)
+				continue
+			}
+			location = "= " + v.Exact
+		} else if v.Prefix != "" {
+			if !configPathValid(v.Prefix) {
+				n.logger.Println("Ignoring redirect with invalid path:", v.Prefix)
+				continue
+			}
+			// The prefix "/" is always used by the root location
+			if v.Prefix == "/" {
+				n.logger.Println("Ignoring redirect for the prefix /, which is used by the root location")
+				continue
+			}
+			// Use a prefix location, so the precedence is the same as for prefix rules, and capture the rest of the path inside the block
+			location = "^~ " + v.Prefix
+			capture = quoteConfigString("^" + regexp.QuoteMeta(v.Prefix) + "(.*)$")
+			to += "$1"
+		} else {
+			if strings.ContainsAny(v.Match, "\r\n") {
+				n.logger.Println("Ignoring redirect with invalid regular expression:", v.Match)
+				continue
+			}
+			if v.CaseSensitive {
+				location = "~ " + quoteConfigString(v.Match)
+			} else {
+				location = "~* " + quoteConfigString(v.Match)
+			}
+		}
+		if _, found := locations[location]; found {
+			n.logger.Println("Ignoring redirect for a location that is already defined in the rules:", location)
+			continue
+		}
+		if seen[location] {
+			n.logger.Println("Ignoring redirect for a location that is already used by another redirect:", location)
+			continue
+		}
+		seen[location] = true
+
+		// Append the query string if needed
+		if v.PreserveQuery {
+			if strings.Contains(v.To, "?") {
+				n.logger.Println("Ignoring preserveQuery for redirect with a query string in the destination:", v.To)
+			} else {
+				to += "$is_args$args"
+			}
+		}
+
+		result = append(result, utils.ManifestRedirectLocation{
+			Location: location,
+			Return:   strconv.Itoa(status) + " " + to,
+			Capture:  capture,
+		})
+	}
+
+	return result
+}
+
+// Validates and sanitizes the table of bulk redirects in the manifest
+// Returns nil if there's no valid redirect in the table
+func (n *NginxConfig) sanitizeManifestBulkRedirects(b utils.ManifestBulkRedirects, domain string) *utils.ManifestBulkRedirects {
+	// Status code
+	status, ok := redirectStatusCode(b.Status)
+	if !ok {
+		n.logger.Println("Ignoring bulk redirects with invalid status code:", b.Status)
+		return nil
+	}
+	b.Status = status
+
+	// Validate each redirect
+	// Paths are limited to 200 characters so they fit in the buckets of the map's hash table
+	// Keys of nginx maps are case-insensitive, and duplicates make the configuration invalid: paths are sorted so the first one is kept consistently
+	paths := make([]string, 0, len(b.Map))
+	for from := range b.Map {
+		paths = append(paths, from)
+	}
+	sort.Strings(paths)
+	seen := make(map[string]bool, len(paths))
+	b.CleanMap = make(map[string]string, len(b.Map))
+	for _, from := range paths {
+		to := b.Map[from]
+		if seen[strings.ToLower(from)] {
+			n.logger.Println("Ignoring bulk redirect with a path that differs from another one only by case:", from)
+			continue
+		}
+		if len(from) > 200 || !configPathValid(from) {
+			n.logger.Println("Ignoring bulk redirect with invalid path:", from)
+			continue
+		}
+		if !redirectDestinationValid(to, false) {
+			n.logger.Println("Ignoring bulk redirect with invalid destination:", to)
+			continue
+		}
+		if b.PreserveQuery && strings.Contains(to, "?") {
+			n.logger.Println("Ignoring bulk redirect with a query string in the destination:", to)
+			continue
+		}
+		seen[strings.ToLower(from)] = true
+		b.CleanMap[quoteConfigString(from)] = quoteConfigString(to)
+	}
+	if len(b.CleanMap) == 0 {
+		return nil
+	}
+
+	// Variables are global in nginx, so namespace them with the site
+	b.Variable = "$site_" + siteKey(domain) + "_redirect"
+
+	return &b
+}
+
+// Validates the error pages in the manifest, ensuring that files exist in the app's folder
+// Returns a map of paths of error pages and the space-separated list of status codes they're used for
+// Pages whose location is already used by a rule in the manifest are ignored
+func (n *NginxConfig) sanitizeManifestErrorPages(errorPages map[string]string, appPath string, locations map[string]utils.ManifestRuleOptions) map[string]string {
+	// Iterate over the keys in order, so the result is the same every time
+	keys := make([]string, 0, len(errorPages))
+	for key := range errorPages {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	// Each status code can be used once only
+	// Status codes listed explicitly (e.g. "502") take precedence over ranges ("5xx"); otherwise, the first key wins
+	pages := make(map[int]string)
+	rangePages := make(map[int]string)
+	for _, key := range keys {
+		// Get the list of status codes
+		codes, rangeCodes, ok := parseErrorPageCodes(key)
+		if !ok {
+			n.logger.Println("Ignoring error page with invalid status codes:", key)
+			continue
+		}
+
+		// Validate the path, which must not point outside of the app
+		page := path.Clean("/" + errorPages[key])
+		if !configPathValid(page) || strings.HasSuffix(page, "/") {
+			n.logger.Println("Ignoring error page with invalid path:", page)
+			continue
+		}
+
+		if _, found := locations["= "+page]; found {
+			n.logger.Println("Ignoring error page for a location that is already defined in the rules:", page)
+			continue
+		}
+
+		// Ensure the file exists in the app
+		exists, err := utils.FileExists(appPath + page)
+		if err != nil || !exists {
+			n.logger.Println("Ignoring error page that does not exist in the app:", page)
+			continue
+		}
+
+		for _, code := range codes {
+			if _, found := pages[code]; !found {
+				pages[code] = page
+			}
+		}
+		for _, code := range rangeCodes {
+			if _, found := rangePages[code]; !found {
+				rangePages[code] = page
+			}
+		}
+	}
+	for code, page := range rangePages {
+		if _, found := pages[code]; !found {
+			pages[code] = page
+		}
+	}
+
+	// Build the list of status codes for each page, in order
+	codes := make([]int, 0, len(pages))
+	for code := range pages {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	result := make(map[string]string)
+	for _, code := range codes {
+		page := pages[code]
+		if result[page] != "" {
+			result[page] += " "
+		}
+		result[page] += strconv.Itoa(code)
+	}
+
+	return result
+}
+
+// Returns the list of status codes for a key of the errorPages map in the manifest, separating the ones listed explicitly from the ones in ranges
+// Keys can contain status codes (e.g. "404") or ranges ("5xx"), and multiple values separated by commas
+func parseErrorPageCodes(key string) (codes []int, rangeCodes []int, ok bool) {
+	codes = make([]int, 0)
+	rangeCodes = make([]int, 0)
+	for _, part := range strings.Split(key, ",") {
+		part = strings.ToLower(strings.TrimSpace(part))
+		if len(part) != 3 || part[0] < '3' || part[0] > '5' {
+			return nil, nil, false
+		}
+		if part[1:] == "xx" {
+			// Ranges include all status codes that are defined
+			start := int(part[0]-'0') * 100
+			for code := start; code < start+100; code++ {
+				if http.StatusText(code) != "" {
+					rangeCodes = append(rangeCodes, code)
+				}
+			}
+		} else {
+			code, err := strconv.Atoi(part)
+			if err != nil {
+				return nil, nil, false
+			}
+			codes = append(codes, code)
+		}
+	}
+	return codes, rangeCodes, len(codes)+len(rangeCodes) > 0
+}
+
+// Validates the i18n options in the manifest and builds the map for matching the Accept-Language header
+// Returns nil if there's no valid language
+func (n *NginxConfig) sanitizeManifestI18n(v utils.ManifestI18n, appPath string, domain string) *utils.ManifestI18n {
+	// Validate the list of languages, which must have a folder in the app
+	languages := make([]string, 0, len(v.Languages))
+	for _, lang := range v.Languages {
+		lang = strings.ToLower(lang)
+		if !n.languageRegexp.MatchString(lang) {
+			n.logger.Println("Ignoring invalid language:", lang)
+			continue
+		}
+		exists, err := utils.FolderExists(appPath + "/" + lang)
+		if err != nil || !exists {
+			n.logger.Println("Ignoring language that does not have a folder in the app:", lang)
+			continue
+		}
+		if !utils.StringInSlice(languages, lang) {
+			languages = append(languages, lang)
+		}
+	}
+	if len(languages) == 0 {
+		n.logger.Println("Ignoring i18n options with no valid language")
+		return nil
+	}
+	v.Languages = languages
+
+	// The default language must be one of the available ones; fallback to the first one
+	v.Default = strings.ToLower(v.Default)
+	if !utils.StringInSlice(languages, v.Default) {
+		if v.Default != "" {
+			n.logger.Println("Ignoring invalid default language:", v.Default)
+		}
+		v.Default = languages[0]
+	}
+
+	// Validate the name of the cookie
+	if v.Cookie != "" && !n.cookieNameRegexp.MatchString(v.Cookie) {
+		n.logger.Println("Ignoring invalid name for the i18n cookie:", v.Cookie)
+		v.Cookie = ""
+	}
+
+	// Build the regular expressions for the map
+	// Each one matches a language only if none of the other available ones appears before it in the header, so the client's order of preference is respected
+	// More specific languages (e.g. "pt-br") are matched before the generic ones ("pt")
+	quoted := make([]string, len(languages))
+	for i, lang := range languages {
+		quoted[i] = regexp.QuoteMeta(lang)
+	}
+	others := "(?:" + strings.Join(quoted, "|") + ")(?:[-;,]|$)"
+	sorted := make([]string, len(languages))
+	copy(sorted, languages)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return len(sorted[i]) > len(sorted[j])
+	})
+	v.MapEntries = make([]string, len(sorted))
+	for i, lang := range sorted {
+		expr := "~*^(?:(?! *" + others + ")[^,]*,)* *" + regexp.QuoteMeta(lang) + "(?:[-;,]|$)"
+		v.MapEntries[i] = quoteConfigString(expr) + " " + quoteConfigString(lang)
+	}
+
+	// Variables are global in nginx, so namespace them with the site
+	v.AcceptVariable = "$site_" + siteKey(domain) + "_lang_accept"
+	v.Variable = v.AcceptVariable
+	if v.Cookie != "" {
+		v.Variable = "$site_" + siteKey(domain) + "_lang"
+	}
+
+	return &v
+}
+
+// Returns the status code to use for a redirect, and false if it's not valid
+func redirectStatusCode(status int) (int, bool) {
+	switch status {
+	case 0:
+		// Default is a permanent redirect
+		return 301, true
+	case 301, 302, 307, 308:
+		return status, true
+	}
+	return 0, false
+}
+
+// Returns true if the destination of a redirect is a path or a http(s) URL, and it can be used safely in the configuration
+// If allowCaptures is true, the destination can contain references to capture groups such as $1
+func redirectDestinationValid(to string, allowCaptures bool) bool {
+	if !strings.HasPrefix(to, "/") && !strings.HasPrefix(to, "http://") && !strings.HasPrefix(to, "https://") {
+		return false
+	}
+	for i, char := range to {
+		if char <= ' ' || char == '"' || char == '\'' || char == ';' || char == '{' || char == '}' || char == '\\' {
+			return false
+		}
+		if char == '$' && (!allowCaptures || i == len(to)-1 || to[i+1] < '0' || to[i+1] > '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns true if the path can be used safely in a location block in the configuration
+func configPathValid(path string) bool {
+	if !strings.HasPrefix(path, "/") {
+		return false
+	}
+	for _, char := range path {
+		if char <= ' ' || char == '"' || char == '\'' || char == ';' || char == '{' || char == '}' || char == '\\' || char == '$' {
+			return false
+		}
+	}
+	return true
+}
+
+// Validates the maintenance mode options for a site
+func (n *NginxConfig) sanitizeMaintenance(site *state.SiteState, appRoot string) *maintenanceConfig {
+	m := site.Maintenance
+	res := &maintenanceConfig{
+		Variable:   "$site_" + siteKey(site.Domain) + "_maintenance",
+		AllowIPs:   make([]string, 0, len(m.AllowIPs)),
+		RetryAfter: m.RetryAfter,
+	}
+
+	// Addresses that can still see the site
+	for _, ip := range m.AllowIPs {
+		if _, _, err := net.ParseCIDR(ip); err != nil && net.ParseIP(ip) == nil {
+			n.logger.Println("Ignoring invalid IP for maintenance mode:", ip)
+			continue
+		}
+		res.AllowIPs = append(res.AllowIPs, ip)
+	}
+
+	if res.RetryAfter < 0 {
+		n.logger.Println("Ignoring invalid value for retryAfter:", res.RetryAfter)
+		res.RetryAfter = 0
+	}
+
+	// The page must exist in the app's bundle, otherwise the built-in one is used
+	if m.Page != "" {
+		if !configPathValid(m.Page) || strings.Contains(m.Page, "..") {
+			n.logger.Println("Ignoring invalid maintenance page:", m.Page)
+		} else if site.App == nil || site.App.Name == "" {
+			n.logger.Println("Ignoring maintenance page for site without an app:", m.Page)
+		} else if exists, err := utils.FileExists(appRoot + "apps/" + site.App.Name + m.Page); err != nil || !exists {
+			n.logger.Println("Ignoring maintenance page that does not exist in the app:", m.Page)
+		} else {
+			res.Page = m.Page
+		}
+	}
+
+	return res
+}
+
+// Validates the CORS policy of a rule, using variable as name for the variable containing the allowed origin
+// Returns nil if there's no valid origin
+func (n *NginxConfig) sanitizeManifestCORS(v utils.ManifestCORS, variable string) *utils.ManifestCORS {
+	// Origins
+	anyOrigin := false
+	v.MapEntries = make([]string, 0, len(v.Origins))
+	for _, o := range v.Origins {
+		o = strings.ToLower(strings.TrimSuffix(o, "/"))
+		if o == "*" {
+			anyOrigin = true
+			continue
+		}
+		if !n.corsOriginRegexp.MatchString(o) {
+			n.logger.Println("Ignoring invalid CORS origin:", o)
+			continue
+		}
+		// Origins with a wildcard for subdomains are matched with a regular expression
+		if strings.Contains(o, "://*.") {
+			parts := strings.SplitN(o, "://*.", 2)
+			expr := "~^" + regexp.QuoteMeta(parts[0]) + `://[a-z0-9\-\.]+\.` + regexp.QuoteMeta(parts[1]) + "$"
+			v.MapEntries = append(v.MapEntries, quoteConfigString(expr)+" $http_origin")
+		} else {
+			v.MapEntries = append(v.MapEntries, quoteConfigString(o)+" $http_origin")
+		}
+	}
+	if anyOrigin {
+		// Browsers don't allow credentials when any origin is allowed
+		if v.Credentials {
+			n.logger.Println("Ignoring credentials for CORS policy that allows any origin")
+			v.Credentials = false
+		}
+		v.AllowOrigin = "*"
+		v.MapEntries = nil
+	} else if len(v.MapEntries) > 0 {
+		v.Variable = variable
+		v.AllowOrigin = variable
+	} else {
+		n.logger.Println("Ignoring CORS policy with no valid origin")
+		return nil
+	}
+
+	// Methods
+	methods := make([]string, 0, len(v.Methods))
+	for _, m := range v.Methods {
+		m = strings.ToUpper(m)
+		if !n.httpMethodRegexp.MatchString(m) {
+			n.logger.Println("Ignoring invalid CORS method:", m)
+			continue
+		}
+		methods = append(methods, m)
+	}
+	if len(methods) == 0 {
+		methods = []string{"GET", "HEAD"}
+	}
+	v.CleanMethods = strings.Join(methods, ", ")
+
+	// Headers
+	filterHeaders := func(list []string) string {
+		res := make([]string, 0, len(list))
+		for _, h := range list {
+			if !utils.ProxyHeaderIsAllowed(h) {
+				n.logger.Println("Ignoring invalid CORS header:", h)
+				continue
+			}
+			res = append(res, h)
+		}
+		return strings.Join(res, ", ")
+	}
+	v.CleanHeaders = filterHeaders(v.Headers)
+	v.CleanExposeHeaders = filterHeaders(v.ExposeHeaders)
+
+	// Max age for preflight requests
+	if v.MaxAge < 0 || v.MaxAge > 86400 {
+		n.logger.Println("Ignoring invalid value for CORS maxAge:", v.MaxAge)
+		v.MaxAge = 0
+	}
+
+	return &v
+}
+
+// Validates the options for rate limiting, using zone as name for the shared memory zone
+// Returns nil if the options aren't valid
+func (n *NginxConfig) sanitizeRateLimit(v utils.RateLimit, zone string) *utils.RateLimit {
+	if v.Rate < 1 || v.Rate > utils.RateLimitMax {
+		n.logger.Println("Ignoring rate limit with invalid rate:", v.Rate)
+		return nil
+	}
+	if v.Burst < 0 || v.Burst > utils.RateLimitMax {
+		n.logger.Println("Ignoring invalid value for rate limit burst:", v.Burst)
+		v.Burst = 0
+	}
+	if v.Burst == 0 {
+		// nodelay has no effect without a burst
+		v.NoDelay = false
+	}
+	if v.Status == 0 {
+		v.Status = http.StatusTooManyRequests
+	} else if v.Status < 400 || v.Status > 599 {
+		n.logger.Println("Ignoring invalid status code for rate limit:", v.Status)
+		v.Status = http.StatusTooManyRequests
+	}
+	v.Zone = zone
+	return &v
+}
+
+// Validates the canary release options for a site
+// Returns nil if the canary can't be enabled
+func (n *NginxConfig) sanitizeCanary(site *state.SiteState) *canaryConfig {
+	if site.App == nil || site.App.Name == "" {
+		n.logger.Println("Ignoring canary for site without an app:", site.Domain)
+		return nil
+	}
+	if site.Canary.App.Name == site.App.Name {
+		n.logger.Println("Ignoring canary with the same app as the site:", site.Canary.App.Name)
+		return nil
+	}
+	if site.Canary.Percentage < 1 || site.Canary.Percentage > 99 {
+		n.logger.Println("Ignoring canary with invalid percentage:", site.Canary.Percentage)
+		return nil
+	}
+
+	prefix := "$site_" + siteKey(site.Domain) + "_canary"
+	return &canaryConfig{
+		Variable:       prefix,
+		SplitVariable:  prefix + "_split",
+		CookieVariable: prefix + "_cookie",
+		CookieName:     canaryCookieName,
+		Cookie:         canaryCookieName + "=" + prefix + "_cookie; Path=/; Max-Age=86400; Secure; HttpOnly; SameSite=Lax",
+		Percentage:     site.Canary.Percentage,
+		App:            escapeConfigString(site.Canary.App.Name),
+		StableApp:      escapeConfigString(site.App.Name),
+	}
+}
+
+// Returns the key used to namespace objects for a site, such as upstreams or variables
+// Names are based on the hash of the domain so they are always valid identifiers in the nginx configuration
+func siteKey(domain string) string {
+	return utils.SHA256String(domain)[:12]
+}
+
 // Writes data to a configuration file
 func writeConfigFile(path string, val []byte) error {
 	// Running f.Close() manually to avoid having too many open file descriptors
@@ -611,6 +1822,12 @@ func writeConfigFile(path string, val []byte) error {
 	return nil
 }
 
+// Quotes a string used in nginx's config files, escaping " and \ only
+// Unlike escapeConfigString, this doesn't escape the $ sign, so it can be used for regular expressions and other strings that don't contain variables
+func quoteConfigString(in string) string {
+	return "\"" + strings.NewReplacer("\\", "\\\\", "\"", "\\\"").Replace(in) + "\""
+}
+
 // Escapes characters in strings used in nginx's config files
 func escapeConfigString(in string) (out string) {
 	out = ""
@@ -0,0 +1,614 @@
+/*
+Copyright © 2020 Alessandro Segala (@ItalyPaleAle)
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published
+by the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package webserver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/statiko-dev/statiko/appconfig"
+	"github.com/statiko-dev/statiko/state"
+	"github.com/statiko-dev/statiko/utils"
+)
+
+// Creates a folder for an app, containing empty files at the given paths
+func createTestApp(t *testing.T, files ...string) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "statiko-app-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.RemoveAll(dir)
+	})
+	for _, f := range files {
+		p := filepath.Join(dir, filepath.FromSlash(f))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestSanitizeManifestErrorPages(t *testing.T) {
+	appPath := createTestApp(t, "404.html", "5xx.html", "502.html", "other.html")
+
+	tests := []struct {
+		name       string
+		errorPages map[string]string
+		locations  map[string]utils.ManifestRuleOptions
+		expect     map[string]string
+	}{
+		{
+			name:       "single status code",
+			errorPages: map[string]string{"404": "404.html"},
+			expect:     map[string]string{"/404.html": "404"},
+		},
+		{
+			name:       "multiple status codes",
+			errorPages: map[string]string{"404, 403": "/404.html"},
+			expect:     map[string]string{"/404.html": "403 404"},
+		},
+		{
+			name:       "exact codes take precedence over ranges",
+			errorPages: map[string]string{"5xx": "5xx.html", "502": "502.html"},
+			expect:     map[string]string{"/5xx.html": "500 501 503 504 505 506 507 508 510 511", "/502.html": "502"},
+		},
+		{
+			name:       "exact codes in a list take precedence over ranges",
+			errorPages: map[string]string{"5XX": "5xx.html", "404,502": "502.html"},
+			expect:     map[string]string{"/5xx.html": "500 501 503 504 505 506 507 508 510 511", "/502.html": "404 502"},
+		},
+		{
+			name:       "overlapping codes use the first key",
+			errorPages: map[string]string{"404,403": "other.html", "404": "404.html"},
+			expect:     map[string]string{"/404.html": "404", "/other.html": "403"},
+		},
+		{
+			name:       "overlapping ranges use the first key",
+			errorPages: map[string]string{"5xx": "5xx.html", "500,5xx": "other.html"},
+			expect:     map[string]string{"/other.html": "500 501 502 503 504 505 506 507 508 510 511"},
+		},
+		{
+			name:       "invalid status codes",
+			errorPages: map[string]string{"200": "404.html", "4x": "404.html", "abc": "404.html", "40a": "404.html", "": "404.html", "404,": "404.html"},
+			expect:     map[string]string{},
+		},
+		{
+			name:       "page outside of the app",
+			errorPages: map[string]string{"404": "../404.html"},
+			expect:     map[string]string{"/404.html": "404"},
+		},
+		{
+			name:       "invalid paths",
+			errorPages: map[string]string{"403": "/", "404": "/404.html;", "500": "/a b.html", "502": "/$uri"},
+			expect:     map[string]string{},
+		},
+		{
+			name:       "page does not exist",
+			errorPages: map[string]string{"404": "missing.html"},
+			expect:     map[string]string{},
+		},
+		{
+			name:       "location used by a rule",
+			errorPages: map[string]string{"404": "404.html", "500": "5xx.html"},
+			locations:  map[string]utils.ManifestRuleOptions{"= /404.html": {}},
+			expect:     map[string]string{"/5xx.html": "500"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Run multiple times as the order of iteration of maps is random
+			for i := 0; i < 10; i++ {
+				res := Instance.sanitizeManifestErrorPages(tt.errorPages, appPath, tt.locations)
+				if !reflect.DeepEqual(res, tt.expect) {
+					t.Fatalf("expected %v, got %v", tt.expect, res)
+				}
+			}
+		})
+	}
+}
+
+func TestSanitizeManifestI18n(t *testing.T) {
+	appPath := createTestApp(t, "en/index.html", "pt-br/index.html", "pt/index.html", "it/index.html")
+
+	tests := []struct {
+		name string
+		i18n utils.ManifestI18n
+		// Expected languages, default and cookie, or nil languages if the options are ignored
+		languages []string
+		def       string
+		cookie    string
+	}{
+		{
+			name:      "valid options",
+			i18n:      utils.ManifestI18n{Languages: []string{"en", "pt-br", "it"}, Default: "it", Cookie: "lang"},
+			languages: []string{"en", "pt-br", "it"},
+			def:       "it",
+			cookie:    "lang",
+		},
+		{
+			name:      "languages are lowercased and deduplicated",
+			i18n:      utils.ManifestI18n{Languages: []string{"EN", "pt-BR", "en"}, Default: "PT-BR"},
+			languages: []string{"en", "pt-br"},
+			def:       "pt-br",
+		},
+		{
+			name:      "invalid languages",
+			i18n:      utils.ManifestI18n{Languages: []string{"e", "english", "en_us", "../en", "en;", "*", "it"}},
+			languages: []string{"it"},
+			def:       "it",
+		},
+		{
+			name:      "languages without a folder",
+			i18n:      utils.ManifestI18n{Languages: []string{"fr", "pt"}},
+			languages: []string{"pt"},
+			def:       "pt",
+		},
+		{
+			name:      "default language is not available",
+			i18n:      utils.ManifestI18n{Languages: []string{"en", "it"}, Default: "fr"},
+			languages: []string{"en", "it"},
+			def:       "en",
+		},
+		{
+			name:      "invalid cookie name",
+			i18n:      utils.ManifestI18n{Languages: []string{"en"}, Cookie: "lang; Path=/"},
+			languages: []string{"en"},
+			def:       "en",
+		},
+		{name: "no languages", i18n: utils.ManifestI18n{}},
+		{name: "no valid languages", i18n: utils.ManifestI18n{Languages: []string{"english", "fr"}, Default: "en"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := Instance.sanitizeManifestI18n(tt.i18n, appPath, "example.com")
+			if tt.languages == nil {
+				if res != nil {
+					t.Fatalf("expected nil, got %v", res)
+				}
+				return
+			}
+			if res == nil {
+				t.Fatal("expected a result, got nil")
+			}
+			if !reflect.DeepEqual(res.Languages, tt.languages) || res.Default != tt.def || res.Cookie != tt.cookie {
+				t.Fatalf("unexpected result: languages=%v default=%q cookie=%q", res.Languages, res.Default, res.Cookie)
+			}
+
+			// There's one map entry per language, with the most specific ones first
+			sorted := make([]string, len(tt.languages))
+			copy(sorted, tt.languages)
+			sort.SliceStable(sorted, func(i, j int) bool {
+				return len(sorted[i]) > len(sorted[j])
+			})
+			if len(res.MapEntries) != len(sorted) {
+				t.Fatalf("expected %d map entries, got %d", len(sorted), len(res.MapEntries))
+			}
+			for i, lang := range sorted {
+				if !strings.HasPrefix(res.MapEntries[i], `"~*^`) || !strings.HasSuffix(res.MapEntries[i], ` "`+lang+`"`) {
+					t.Errorf("unexpected map entry %d: %s", i, res.MapEntries[i])
+				}
+			}
+
+			// Variables are namespaced with the site, and the cookie has its own variable
+			prefix := "$site_" + siteKey("example.com") + "_lang"
+			if res.AcceptVariable != prefix+"_accept" {
+				t.Errorf("unexpected accept variable: %s", res.AcceptVariable)
+			}
+			expectVariable := res.AcceptVariable
+			if tt.cookie != "" {
+				expectVariable = prefix
+			}
+			if res.Variable != expectVariable {
+				t.Errorf("unexpected variable: %s", res.Variable)
+			}
+		})
+	}
+}
+
+func TestSanitizeMaintenance(t *testing.T) {
+	appRoot := createTestApp(t, "apps/app1/maintenance.html") + "/"
+	app := &state.SiteApp{Name: "app1"}
+
+	tests := []struct {
+		name        string
+		app         *state.SiteApp
+		maintenance state.SiteMaintenance
+		expect      maintenanceConfig
+	}{
+		{
+			name:        "valid options",
+			app:         app,
+			maintenance: state.SiteMaintenance{Enabled: true, Page: "/maintenance.html", RetryAfter: 60, AllowIPs: []string{"10.0.0.1", "192.168.0.0/16", "::1", "fd00::/8"}},
+			expect:      maintenanceConfig{Page: "/maintenance.html", RetryAfter: 60, AllowIPs: []string{"10.0.0.1", "192.168.0.0/16", "::1", "fd00::/8"}},
+		},
+		{
+			name:        "invalid IPs",
+			app:         app,
+			maintenance: state.SiteMaintenance{Enabled: true, AllowIPs: []string{"10.0.0.1", "10.0.0.256", "10.0.0.0/33", "example.com", "1.2.3.4; allow all", ""}},
+			expect:      maintenanceConfig{AllowIPs: []string{"10.0.0.1"}},
+		},
+		{
+			name:        "negative retryAfter",
+			app:         app,
+			maintenance: state.SiteMaintenance{Enabled: true, RetryAfter: -1},
+			expect:      maintenanceConfig{AllowIPs: []string{}},
+		},
+		{
+			name:        "relative page",
+			app:         app,
+			maintenance: state.SiteMaintenance{Enabled: true, Page: "maintenance.html"},
+			expect:      maintenanceConfig{AllowIPs: []string{}},
+		},
+		{
+			name:        "page outside of the app",
+			app:         app,
+			maintenance: state.SiteMaintenance{Enabled: true, Page: "/../app1/maintenance.html"},
+			expect:      maintenanceConfig{AllowIPs: []string{}},
+		},
+		{
+			name:        "page with invalid characters",
+			app:         app,
+			maintenance: state.SiteMaintenance{Enabled: true, Page: "/maintenance.html;"},
+			expect:      maintenanceConfig{AllowIPs: []string{}},
+		},
+		{
+			name:        "page does not exist",
+			app:         app,
+			maintenance: state.SiteMaintenance{Enabled: true, Page: "/missing.html"},
+			expect:      maintenanceConfig{AllowIPs: []string{}},
+		},
+		{
+			name:        "page for site without an app",
+			maintenance: state.SiteMaintenance{Enabled: true, Page: "/maintenance.html"},
+			expect:      maintenanceConfig{AllowIPs: []string{}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			maintenance := tt.maintenance
+			site := &state.SiteState{Domain: "example.com", App: tt.app, Maintenance: &maintenance}
+			res := Instance.sanitizeMaintenance(site, appRoot)
+			tt.expect.Variable = "$site_" + siteKey("example.com") + "_maintenance"
+			if !reflect.DeepEqual(*res, tt.expect) {
+				t.Fatalf("expected %+v, got %+v", tt.expect, *res)
+			}
+		})
+	}
+}
+
+func TestSanitizeCanary(t *testing.T) {
+	tests := []struct {
+		name       string
+		app        *state.SiteApp
+		canary     state.SiteCanary
+		ok         bool
+		percentage int
+	}{
+		{
+			name:       "valid canary",
+			app:        &state.SiteApp{Name: "app1"},
+			canary:     state.SiteCanary{App: &state.SiteApp{Name: "app2"}, Percentage: 10},
+			ok:         true,
+			percentage: 10,
+		},
+		{
+			name:   "site without an app",
+			canary: state.SiteCanary{App: &state.SiteApp{Name: "app2"}, Percentage: 10},
+		},
+		{
+			name:   "site with an empty app",
+			app:    &state.SiteApp{},
+			canary: state.SiteCanary{App: &state.SiteApp{Name: "app2"}, Percentage: 10},
+		},
+		{
+			name:   "same app as the site",
+			app:    &state.SiteApp{Name: "app1"},
+			canary: state.SiteCanary{App: &state.SiteApp{Name: "app1"}, Percentage: 10},
+		},
+		{
+			name:   "percentage too low",
+			app:    &state.SiteApp{Name: "app1"},
+			canary: state.SiteCanary{App: &state.SiteApp{Name: "app2"}, Percentage: 0},
+		},
+		{
+			name:   "percentage too high",
+			app:    &state.SiteApp{Name: "app1"},
+			canary: state.SiteCanary{App: &state.SiteApp{Name: "app2"}, Percentage: 100},
+		},
+		{
+			name:   "negative percentage",
+			app:    &state.SiteApp{Name: "app1"},
+			canary: state.SiteCanary{App: &state.SiteApp{Name: "app2"}, Percentage: -10},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			canary := tt.canary
+			site := &state.SiteState{Domain: "example.com", App: tt.app, Canary: &canary}
+			res := Instance.sanitizeCanary(site)
+			if !tt.ok {
+				if res != nil {
+					t.Fatalf("expected nil, got %+v", res)
+				}
+				return
+			}
+			if res == nil {
+				t.Fatal("expected a result, got nil")
+			}
+			prefix := "$site_" + siteKey("example.com") + "_canary"
+			if res.Percentage != tt.percentage || res.Variable != prefix || res.SplitVariable != prefix+"_split" || res.CookieVariable != prefix+"_cookie" {
+				t.Errorf("unexpected result: %+v", res)
+			}
+			if res.App != tt.canary.App.Name || res.StableApp != tt.app.Name {
+				t.Errorf("unexpected apps: %s and %s", res.App, res.StableApp)
+			}
+		})
+	}
+}
+
+func TestSanitizeRateLimit(t *testing.T) {
+	tests := []struct {
+		name      string
+		rateLimit utils.RateLimit
+		// Expected result, or nil if the options are ignored
+		expect *utils.RateLimit
+	}{
+		{
+			name:      "valid options",
+			rateLimit: utils.RateLimit{Rate: 10, Burst: 20, NoDelay: true, Status: 503},
+			expect:    &utils.RateLimit{Rate: 10, Burst: 20, NoDelay: true, Status: 503, Zone: "zone"},
+		},
+		{
+			name:      "default status",
+			rateLimit: utils.RateLimit{Rate: 10},
+			expect:    &utils.RateLimit{Rate: 10, Status: 429, Zone: "zone"},
+		},
+		{
+			name:      "maximum values",
+			rateLimit: utils.RateLimit{Rate: utils.RateLimitMax, Burst: utils.RateLimitMax, Status: 599},
+			expect:    &utils.RateLimit{Rate: utils.RateLimitMax, Burst: utils.RateLimitMax, Status: 599, Zone: "zone"},
+		},
+		{
+			name:      "nodelay without burst",
+			rateLimit: utils.RateLimit{Rate: 10, NoDelay: true},
+			expect:    &utils.RateLimit{Rate: 10, Status: 429, Zone: "zone"},
+		},
+		{
+			name:      "negative burst",
+			rateLimit: utils.RateLimit{Rate: 10, Burst: -1, NoDelay: true},
+			expect:    &utils.RateLimit{Rate: 10, Status: 429, Zone: "zone"},
+		},
+		{
+			name:      "burst too high",
+			rateLimit: utils.RateLimit{Rate: 10, Burst: utils.RateLimitMax + 1},
+			expect:    &utils.RateLimit{Rate: 10, Status: 429, Zone: "zone"},
+		},
+		{
+			name:      "status too low",
+			rateLimit: utils.RateLimit{Rate: 10, Status: 302},
+			expect:    &utils.RateLimit{Rate: 10, Status: 429, Zone: "zone"},
+		},
+		{
+			name:      "status too high",
+			rateLimit: utils.RateLimit{Rate: 10, Status: 600},
+			expect:    &utils.RateLimit{Rate: 10, Status: 429, Zone: "zone"},
+		},
+		{name: "zero rate", rateLimit: utils.RateLimit{Rate: 0, Burst: 10}},
+		{name: "negative rate", rateLimit: utils.RateLimit{Rate: -1}},
+		{name: "rate too high", rateLimit: utils.RateLimit{Rate: utils.RateLimitMax + 1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := Instance.sanitizeRateLimit(tt.rateLimit, "zone")
+			if !reflect.DeepEqual(res, tt.expect) {
+				t.Fatalf("expected %+v, got %+v", tt.expect, res)
+			}
+		})
+	}
+}
+
+func TestSanitizeManifestCORS(t *testing.T) {
+	tests := []struct {
+		name string
+		cors utils.ManifestCORS
+		// Expected result, or nil if the policy is ignored
+		expect *utils.ManifestCORS
+	}{
+		{
+			name: "single origin",
+			cors: utils.ManifestCORS{Origins: []string{"https://example.com"}},
+			expect: &utils.ManifestCORS{
+				Origins:      []string{"https://example.com"},
+				AllowOrigin:  "$cors",
+				Variable:     "$cors",
+				MapEntries:   []string{`"https://example.com" $http_origin`},
+				CleanMethods: "GET, HEAD",
+			},
+		},
+		{
+			name: "origins are normalized",
+			cors: utils.ManifestCORS{Origins: []string{"HTTPS://Example.com/", "http://localhost:8080"}},
+			expect: &utils.ManifestCORS{
+				Origins:      []string{"HTTPS://Example.com/", "http://localhost:8080"},
+				AllowOrigin:  "$cors",
+				Variable:     "$cors",
+				MapEntries:   []string{`"https://example.com" $http_origin`, `"http://localhost:8080" $http_origin`},
+				CleanMethods: "GET, HEAD",
+			},
+		},
+		{
+			name: "wildcard for subdomains",
+			cors: utils.ManifestCORS{Origins: []string{"https://*.example.com"}},
+			expect: &utils.ManifestCORS{
+				Origins:      []string{"https://*.example.com"},
+				AllowOrigin:  "$cors",
+				Variable:     "$cors",
+				MapEntries:   []string{`"~^https://[a-z0-9\\-\\.]+\\.example\\.com$" $http_origin`},
+				CleanMethods: "GET, HEAD",
+			},
+		},
+		{
+			name: "invalid origins",
+			cors: utils.ManifestCORS{Origins: []string{"example.com", "ftp://example.com", "https://example.com/path", "https://*", "https://a.*.example.com", "https://example.com\" always", "https://example.com:123456", "https://ok.example.com"}},
+			expect: &utils.ManifestCORS{
+				Origins:      []string{"example.com", "ftp://example.com", "https://example.com/path", "https://*", "https://a.*.example.com", "https://example.com\" always", "https://example.com:123456", "https://ok.example.com"},
+				AllowOrigin:  "$cors",
+				Variable:     "$cors",
+				MapEntries:   []string{`"https://ok.example.com" $http_origin`},
+				CleanMethods: "GET, HEAD",
+			},
+		},
+		{
+			name: "any origin disables credentials",
+			cors: utils.ManifestCORS{Origins: []string{"https://example.com", "*"}, Credentials: true},
+			expect: &utils.ManifestCORS{
+				Origins:      []string{"https://example.com", "*"},
+				AllowOrigin:  "*",
+				CleanMethods: "GET, HEAD",
+			},
+		},
+		{
+			name: "methods, headers and max age",
+			cors: utils.ManifestCORS{
+				Origins:       []string{"https://example.com"},
+				Methods:       []string{"get", "POST", "DELETE;", "PUT PATCH", ""},
+				Headers:       []string{"Content-Type", "X-Custom", "Bad Header", "Connection"},
+				ExposeHeaders: []string{"X-Total", "X-Total\nInjected"},
+				Credentials:   true,
+				MaxAge:        600,
+			},
+			expect: &utils.ManifestCORS{
+				Origins:            []string{"https://example.com"},
+				Methods:            []string{"get", "POST", "DELETE;", "PUT PATCH", ""},
+				Headers:            []string{"Content-Type", "X-Custom", "Bad Header", "Connection"},
+				ExposeHeaders:      []string{"X-Total", "X-Total\nInjected"},
+				Credentials:        true,
+				MaxAge:             600,
+				AllowOrigin:        "$cors",
+				Variable:           "$cors",
+				MapEntries:         []string{`"https://example.com" $http_origin`},
+				CleanMethods:       "GET, POST",
+				CleanHeaders:       "Content-Type, X-Custom",
+				CleanExposeHeaders: "X-Total",
+			},
+		},
+		{
+			name: "negative max age",
+			cors: utils.ManifestCORS{Origins: []string{"*"}, MaxAge: -1},
+			expect: &utils.ManifestCORS{
+				Origins:      []string{"*"},
+				AllowOrigin:  "*",
+				CleanMethods: "GET, HEAD",
+			},
+		},
+		{
+			name: "max age too high",
+			cors: utils.ManifestCORS{Origins: []string{"*"}, MaxAge: 86401},
+			expect: &utils.ManifestCORS{
+				Origins:      []string{"*"},
+				AllowOrigin:  "*",
+				CleanMethods: "GET, HEAD",
+			},
+		},
+		{name: "no origins", cors: utils.ManifestCORS{}},
+		{name: "no valid origins", cors: utils.ManifestCORS{Origins: []string{"example.com", "https://example.com;"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := Instance.sanitizeManifestCORS(tt.cors, "$cors")
+			if !reflect.DeepEqual(res, tt.expect) {
+				t.Fatalf("expected %+v, got %+v", tt.expect, res)
+			}
+		})
+	}
+}
+
+func TestSyncConfigurationRevert(t *testing.T) {
+	dir, err := ioutil.TempDir("", "statiko-nginx-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The configuration test fails when nginx.conf uses the "invalid" user
+	for key, val := range map[string]string{
+		"nginx.configPath":    dir + "/",
+		"nginx.commands.test": `! grep -q "^user invalid;" "` + dir + `/nginx.conf" || echo "invalid configuration"`,
+		"nginx.user":          "valid",
+	} {
+		prev := appconfig.Config.Get(key)
+		appconfig.Config.Set(key, val)
+		defer appconfig.Config.Set(key, prev)
+	}
+
+	// Create a valid configuration
+	updated, err := Instance.SyncConfiguration([]state.SiteState{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !updated {
+		t.Fatal("expected the configuration to be updated")
+	}
+	valid, err := ioutil.ReadFile(dir + "/nginx.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Changes that make the configuration invalid are reverted
+	appconfig.Config.Set("nginx.user", "invalid")
+	if _, err := Instance.SyncConfiguration([]state.SiteState{}, nil); err == nil {
+		t.Fatal("expected an error")
+	}
+	read, err := ioutil.ReadFile(dir + "/nginx.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(read) != string(valid) {
+		t.Error("nginx.conf was not reverted")
+	}
+	for _, name := range []string{"mime.types", "conf.d/_default.conf"} {
+		if exists, _ := utils.FileExists(dir + "/" + name); !exists {
+			t.Errorf("file %s was removed", name)
+		}
+	}
+
+	// Once the error is fixed, the configuration is unchanged
+	appconfig.Config.Set("nginx.user", "valid")
+	updated, err = Instance.SyncConfiguration([]state.SiteState{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated {
+		t.Error("expected the configuration not to be updated")
+	}
+}
@@ -49,6 +49,7 @@ func startController() {
 func startLeaderWorkers(ctx context.Context) {
 	startDHParamsWorker(ctx)
 	startCertMonitorWorker(ctx)
+	startSiteExpiryWorker(ctx)
 }
 
 // Start the workers that run on all nodes
@@ -57,6 +58,7 @@ func startSharedWorkers() {
 	ctx := context.Background()
 	startHealthWorker(ctx)
 	startNodeCertMonitorWorker(ctx)
+	startUploadsWorker(ctx)
 }
 
 // Waits for first sync to complete
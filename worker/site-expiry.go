@@ -0,0 +1,110 @@
+/*
+Copyright © 2020 Alessandro Segala (@ItalyPaleAle)
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published
+by the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package worker
+
+import (
+	"context"
+	"log"
+	"os"
+	"time"
+
+	"github.com/statiko-dev/statiko/appconfig"
+	"github.com/statiko-dev/statiko/notifications"
+	"github.com/statiko-dev/statiko/state"
+	"github.com/statiko-dev/statiko/sync"
+)
+
+// Logger for this file
+var siteExpiryLogger *log.Logger
+
+// Notifications sent, with the expiry time of the site when they were sent
+var siteExpiryNotifications map[string]time.Time
+
+// In background, periodically delete sites that have expired
+func startSiteExpiryWorker(ctx context.Context) {
+	// Set variables
+	siteExpiryInterval := time.Duration(time.Minute) // Run every minute
+	siteExpiryLogger = log.New(os.Stdout, "worker/site-expiry: ", log.Ldate|log.Ltime|log.LUTC)
+	siteExpiryNotifications = make(map[string]time.Time)
+
+	go func() {
+		// Wait for startup
+		waitForStartup()
+
+		// Run on ticker
+		ticker := time.NewTicker(siteExpiryInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				err := siteExpiryWorker()
+				if err != nil {
+					siteExpiryLogger.Println("Worker error:", err)
+				}
+			case <-ctx.Done():
+				siteExpiryLogger.Println("Worker's context canceled")
+				return
+			}
+		}
+	}()
+}
+
+// Look up all sites to delete those that have expired, and notify admins of those about to expire
+func siteExpiryWorker() error {
+	now := time.Now()
+	notifyBefore := appconfig.Config.GetDuration("temporarySites.notifyBefore")
+
+	// Collect the sites to delete first, as deleting them modifies the list
+	expired := make([]string, 0)
+	for _, el := range state.Instance.GetSites() {
+		// Only temporary sites expire
+		if el.Expires == nil || !el.Temporary {
+			continue
+		}
+
+		if !el.Expires.After(now) {
+			expired = append(expired, el.Domain)
+			continue
+		}
+
+		// Send a notification once, unless the expiry time has changed since then
+		if notifyBefore > 0 && el.Expires.Before(now.Add(notifyBefore)) {
+			if sent, found := siteExpiryNotifications[el.Domain]; !found || !sent.Equal(*el.Expires) {
+				siteExpiryNotifications[el.Domain] = *el.Expires
+				message := "Site " + el.Domain + " expires on " + el.Expires.UTC().Format(time.RFC1123) + " and will be deleted"
+				go notifications.SendNotification(message)
+			}
+		}
+	}
+
+	// Delete expired sites
+	for _, domain := range expired {
+		siteExpiryLogger.Println("Deleting expired site", domain)
+		if err := state.Instance.DeleteSite(domain); err != nil {
+			return err
+		}
+		delete(siteExpiryNotifications, domain)
+		go notifications.SendNotification("Site " + domain + " has expired and was deleted")
+	}
+
+	if len(expired) > 0 {
+		sync.QueueRun()
+	}
+
+	return nil
+}
@@ -0,0 +1,58 @@
+/*
+Copyright © 2020 Alessandro Segala (@ItalyPaleAle)
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published
+by the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package worker
+
+import (
+	"context"
+	"log"
+	"os"
+	"time"
+
+	"github.com/statiko-dev/statiko/uploads"
+)
+
+// Logger for this file
+var uploadsLogger *log.Logger
+
+// In background, periodically remove upload sessions that were abandoned and old import jobs
+func startUploadsWorker(ctx context.Context) {
+	// Set variables
+	uploadsInterval := time.Duration(15 * time.Minute) // Run every 15 minutes
+	uploadsLogger = log.New(os.Stdout, "worker/uploads: ", log.Ldate|log.Ltime|log.LUTC)
+
+	go func() {
+		// Wait for startup
+		waitForStartup()
+
+		// Run on ticker
+		ticker := time.NewTicker(uploadsInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				err := uploads.Instance.RemoveExpired()
+				if err != nil {
+					uploadsLogger.Println("Worker error:", err)
+				}
+			case <-ctx.Done():
+				uploadsLogger.Println("Worker's context canceled")
+				return
+			}
+		}
+	}()
+}